@@ -4,6 +4,7 @@ go 1.24.1
 
 require (
 	github.com/btcsuite/btcutil v1.0.2
+	github.com/itchyny/gojq v0.12.17
 	github.com/prequel-dev/prequel-logmatch v0.0.13
 	github.com/rs/zerolog v1.34.0
 	gopkg.in/yaml.v2 v2.4.0
@@ -12,7 +13,6 @@ require (
 
 require (
 	github.com/goccy/go-yaml v1.15.23 // indirect
-	github.com/itchyny/gojq v0.12.17 // indirect
 	github.com/itchyny/timefmt-go v0.1.6 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
 	github.com/mattn/go-isatty v0.0.20 // indirect
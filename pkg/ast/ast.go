@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
 	"github.com/prequel-dev/prequel-compiler/pkg/schema"
 	"github.com/prequel-dev/prequel-logmatch/pkg/match"
 	"github.com/rs/zerolog/log"
@@ -27,6 +28,7 @@ var (
 	ErrMissingOrigin           = errors.New("missing origin event")
 	ErrInvalidAnchor           = errors.New("invalid negate anchor")
 	ErrNoTermIdx               = errors.New("no term idx")
+	ErrCorrelationSource       = errors.New("correlation keys must cover every event source")
 )
 
 type AstT struct {
@@ -54,8 +56,10 @@ type AstMetadataT struct {
 	ParentAddress *AstNodeAddressT `json:"parent_address"` // Address of the parent node
 	NegateOpts    *AstNegateOptsT  `json:"negate_opts"`    // Optional egate options for the node
 	RuleId        string           `json:"rule_id"`        // Consistent identifier for the rule that remains consistent through rule logic changes
+	CreId         string           `json:"cre_id"`         // Identifier of the CRE the rule detects
 	Scope         string           `json:"scope"`          // Scope can be an individual node, a cluster, or a set of clusters
 	NegIdx        int              `json:"neg_idx"`        // Index into children where negative conditions begin. Equals -1 if no children or no negative conditions
+	Pos           pqerr.Pos        `json:"pos"`            // Position of the node in the rule document
 }
 
 // NegateOptsT contains optional negate settings for the matcher object
@@ -72,7 +76,77 @@ type AstFieldT struct {
 	JsonValue  string          `json:"json_value"`
 	RegexValue string          `json:"regex_value"`
 	TermValue  match.TermT     `json:"term_value"`
+	Predicates []AstPredicateT `json:"predicates,omitempty"`
+	Exclude    []AstFieldT     `json:"exclude,omitempty"` // Terms that must not match the same event
+	Bindings   []AstBindingT   `json:"bindings,omitempty"`
 	NegateOpts *AstNegateOptsT `json:"negate_opts"`
+	Pos        pqerr.Pos       `json:"pos"` // Position of the term in the rule document
+}
+
+// String describes the term, e.g. `msg regex "fail(ed)?"`.
+func (f AstFieldT) String() string {
+
+	var parts []string
+
+	if len(f.Predicates) > 0 {
+		for _, p := range f.Predicates {
+			parts = append(parts, p.Field+" "+termString(p.TermValue))
+		}
+		return strings.Join(parts, " and ")
+	}
+
+	if f.Field != "" {
+		parts = append(parts, f.Field)
+	}
+	parts = append(parts, termString(f.TermValue))
+
+	for _, ex := range f.Exclude {
+		parts = append(parts, "exclude", ex.String())
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func termString(t match.TermT) string {
+	switch t.Type {
+	case match.TermRegex:
+		return fmt.Sprintf("regex %q", t.Value)
+	case match.TermJqJson, match.TermJqYaml:
+		return fmt.Sprintf("jq %q", t.Value)
+	}
+	return fmt.Sprintf("%q", t.Value)
+}
+
+// AstBindingT binds a variable to a value extracted from a matching event,
+// either by a jq expression or by a named capture group of the term regex.
+// Terms binding the same variable only match together when the values agree.
+type AstBindingT struct {
+	Name string `json:"name"`
+	Jq   string `json:"jq,omitempty"` // Empty for regex captures
+}
+
+// AstPredicateT is one field condition of a multi-field term. All the
+// predicates of a term must hold on the same event.
+type AstPredicateT struct {
+	Field     string      `json:"field"`
+	TermValue match.TermT `json:"term_value"`
+	Pos       pqerr.Pos   `json:"pos"`
+}
+
+// AstCorrelationT defines how a correlation key is extracted from the events
+// of each source below a set or sequence.
+type AstCorrelationT struct {
+	Name    string                        `json:"name"`
+	Sources map[string]AstCorrelationKeyT `json:"sources"`
+}
+
+// AstCorrelationKeyT extracts the value of the named correlation key from an
+// event with exactly one of a field, a jq expression or a regex capture.
+type AstCorrelationKeyT struct {
+	Name  string `json:"name"`
+	Field string `json:"field,omitempty"`
+	Jq    string `json:"jq,omitempty"`
+	Regex string `json:"regex,omitempty"`
 }
 
 type AstEventT struct {
@@ -114,12 +188,37 @@ func Build(data []byte) (*AstT, error) {
 	return BuildTree(parseTree)
 }
 
+type BuildOptT func(*buildOptsT)
+
+// WithDiagnostics keeps building past rules that fail. The valid rules are
+// returned as a partial AST along with a pqerr.List holding every error found.
+func WithDiagnostics() func(*buildOptsT) {
+	return func(o *buildOptsT) {
+		o.diagnostics = true
+	}
+}
+
+type buildOptsT struct {
+	diagnostics bool
+}
+
+func buildOpts(opts ...BuildOptT) *buildOptsT {
+	o := &buildOptsT{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
 // Build AST from the given parser node in pre-order DFS traversal
-func BuildTree(tree *parser.TreeT) (*AstT, error) {
+func BuildTree(tree *parser.TreeT, opts ...BuildOptT) (*AstT, error) {
 	var (
+		o   = buildOpts(opts...)
 		ast = &AstT{
 			Nodes: make([]*AstNodeT, 0),
 		}
+		diags pqerr.List
 	)
 
 	for _, parserNode := range tree.Nodes {
@@ -132,18 +231,27 @@ func BuildTree(tree *parser.TreeT) (*AstT, error) {
 		)
 
 		// Recursively build tree
-		if rule, err = rb.buildTree(parserNode, nil, &termIdx); err != nil {
-			return nil, err
+		if rule, err = rb.buildTree(parserNode, nil, &termIdx); err == nil && !rb.HasOrigin {
+			err = parserNode.WrapError(ErrMissingOrigin)
 		}
 
-		if !rb.HasOrigin {
-			return nil, parserNode.WrapError(ErrMissingOrigin)
+		if err != nil {
+			if !o.diagnostics {
+				return nil, err
+			}
+			// Keep going so every broken rule is reported in one pass
+			if _, ok := pqerr.PosOf(err); !ok {
+				err = parserNode.WrapError(err)
+			}
+			diags.Add(err)
+			continue
 		}
 
 		ast.Nodes = append(ast.Nodes, rule)
 	}
 
-	return ast, nil
+	// In diagnostics mode the partial AST is returned along with the errors
+	return ast, diags.Err()
 }
 
 func (b *builderT) buildTree(parserNode *parser.NodeT, parentMachineAddress *AstNodeAddressT, termIdx *uint32) (*AstNodeT, error) {
@@ -197,11 +305,13 @@ func newAstNode(parserNode *parser.NodeT, typ schema.NodeTypeT, scope string, pa
 	return &AstNodeT{
 		Metadata: AstMetadataT{
 			RuleId:        parserNode.Metadata.RuleId,
+			CreId:         parserNode.Metadata.CreId,
 			Address:       address,
 			ParentAddress: parentAddress,
 			NegIdx:        parserNode.NegIdx,
 			Type:          typ,
 			Scope:         scope,
+			Pos:           parserNode.Metadata.Pos,
 		},
 	}
 }
@@ -285,6 +395,24 @@ func (b *builderT) buildMachineChildren(parserNode *parser.NodeT, machineAddress
 			err             error
 		)
 
+		if det, ok := child.(*parser.DetectionT); ok {
+			if err = checkAnchor(parserNode, det.NegateOpts); err != nil {
+				return nil, err
+			}
+			err = b.descendTree(func() error {
+				if matchNode, err = b.buildDetectionNode(parserNode, det, machineAddress, &termIdx); err != nil {
+					return err
+				}
+				addNegateOpts(matchNode, det.NegateOpts)
+				children = append(children, matchNode)
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
 		if parserChildNode, ok = child.(*parser.NodeT); !ok {
 			return nil, parserNode.WrapError(ErrInvalidNodeType)
 		}
@@ -292,10 +420,8 @@ func (b *builderT) buildMachineChildren(parserNode *parser.NodeT, machineAddress
 		if parserChildNode.Metadata.NegateOpts != nil {
 			negateOpts = parserChildNode.Metadata.NegateOpts
 
-			if negateOpts.Anchor > uint32(len(parserNode.Children)) {
-				log.Error().
-					Msg("Negate anchor is greater than the number of children")
-				return nil, parserNode.WrapError(ErrInvalidAnchor)
+			if err = checkAnchor(parserNode, negateOpts); err != nil {
+				return nil, err
 			}
 		}
 
@@ -345,6 +471,15 @@ func (b *builderT) buildMachineChildren(parserNode *parser.NodeT, machineAddress
 	return children, nil
 }
 
+func checkAnchor(parserNode *parser.NodeT, negateOpts *parser.NegateOptsT) error {
+	if negateOpts != nil && negateOpts.Anchor > uint32(len(parserNode.Children)) {
+		log.Error().
+			Msg("Negate anchor is greater than the number of children")
+		return parserNode.WrapError(ErrInvalidAnchor)
+	}
+	return nil
+}
+
 func addNegateOpts(assert *AstNodeT, negateOpts *parser.NegateOptsT) {
 	if negateOpts == nil {
 		return
@@ -465,9 +600,10 @@ func DrawTree(tree *AstT, path string) error {
 
 	for _, node := range tree.Nodes {
 		if err = traverseTree(node, f, 0); err != nil {
+			f.Close()
 			return err
 		}
 	}
 
-	return nil
+	return f.Close()
 }
@@ -0,0 +1,73 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrDetectionWindow = errors.New("'clusters' requires a window")
+)
+
+// AstDetectionT matches the detections of a CRE reported by the clusters of
+// an organization. It is a term of an organization scope machine.
+type AstDetectionT struct {
+	CreId    string        `json:"cre_id"`
+	Cluster  string        `json:"cluster,omitempty"`  // Only detections from this cluster
+	Clusters int           `json:"clusters,omitempty"` // Distinct clusters required within the window
+	Window   time.Duration `json:"window"`             // Window of the parent machine
+}
+
+// String describes the detection term, e.g. "detection CRE-2025-0071
+// clusters 3".
+func (d AstDetectionT) String() string {
+	switch {
+	case d.Cluster != "":
+		return fmt.Sprintf("detection %s cluster %s", d.CreId, d.Cluster)
+	case d.Clusters > 1:
+		return fmt.Sprintf("detection %s clusters %d", d.CreId, d.Clusters)
+	}
+	return fmt.Sprintf("detection %s", d.CreId)
+}
+
+// machineScope is the scope a machine node is evaluated in.
+func machineScope(parserNode *parser.NodeT) string {
+	if parserNode.Metadata.Scope == schema.ScopeOrganization {
+		return schema.ScopeOrganization
+	}
+	return schema.ScopeCluster
+}
+
+func (b *builderT) buildDetectionNode(parserNode *parser.NodeT, det *parser.DetectionT, machineAddress *AstNodeAddressT, termIdx *uint32) (*AstNodeT, error) {
+
+	if det.Clusters > 1 && parserNode.Metadata.Window == 0 {
+		log.Error().
+			Any("address", machineAddress).
+			Str("cre_id", det.CreId).
+			Msg("Detections across clusters require a window")
+		return nil, parserNode.WrapError(ErrDetectionWindow)
+	}
+
+	var (
+		address = b.newAstNodeAddress(parserNode.Metadata.RuleHash, schema.NodeTypeDetection.String(), termIdx)
+		node    = newAstNode(parserNode, schema.NodeTypeDetection, schema.ScopeOrganization, machineAddress, address)
+	)
+
+	// Detections are the origin events of organization scope rules
+	b.HasOrigin = true
+
+	node.Metadata.NegIdx = -1
+	node.Object = &AstDetectionT{
+		CreId:    det.CreId,
+		Cluster:  det.Cluster,
+		Clusters: det.Clusters,
+		Window:   parserNode.Metadata.Window,
+	}
+
+	return node, nil
+}
@@ -0,0 +1,327 @@
+package ast
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+var (
+	ErrRuleNotFound = errors.New("rule not found in tree")
+)
+
+type GraphOptT func(*graphOptsT)
+
+// WithRule renders only the rules matching the given rule hash, rule id or
+// CRE id.
+func WithRule(rule string) GraphOptT {
+	return func(o *graphOptsT) {
+		o.rule = rule
+	}
+}
+
+type graphOptsT struct {
+	rule string
+}
+
+func graphOpts(opts ...GraphOptT) *graphOptsT {
+	o := &graphOptsT{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// graphNodeT is a node of the exported graph with its label lines.
+type graphNodeT struct {
+	id     string
+	label  []string
+	parent string
+	edge   string
+	negate bool
+}
+
+// graphRuleT holds the nodes of one rule in pre-order.
+type graphRuleT struct {
+	label string
+	nodes []graphNodeT
+}
+
+// WriteDot writes the AST as a Graphviz DOT digraph with one cluster per
+// rule. Edges are labeled with the term index of the child; edges to the
+// negate terms of a machine are dashed.
+func WriteDot(w io.Writer, tree *AstT, opts ...GraphOptT) error {
+
+	rules, err := graphRules(tree, graphOpts(opts...))
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString("digraph ast {\n")
+	sb.WriteString("  node [shape=box, fontname=\"monospace\"];\n")
+
+	for i, r := range rules {
+		fmt.Fprintf(&sb, "  subgraph cluster_%d {\n", i)
+		fmt.Fprintf(&sb, "    label=%s;\n", dotString(r.label))
+		for _, n := range r.nodes {
+			fmt.Fprintf(&sb, "    %s [label=%s];\n", n.id, dotLabel(n.label))
+		}
+		sb.WriteString("  }\n")
+
+		for _, n := range r.nodes {
+			if n.parent == "" {
+				continue
+			}
+			attrs := fmt.Sprintf("label=%s", dotString(n.edge))
+			if n.negate {
+				attrs += ", style=dashed"
+			}
+			fmt.Fprintf(&sb, "  %s -> %s [%s];\n", n.parent, n.id, attrs)
+		}
+	}
+
+	sb.WriteString("}\n")
+
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+// WriteMermaid writes the AST as a Mermaid flowchart with one subgraph per
+// rule. Edges are labeled with the term index of the child; edges to the
+// negate terms of a machine are dotted.
+func WriteMermaid(w io.Writer, tree *AstT, opts ...GraphOptT) error {
+
+	rules, err := graphRules(tree, graphOpts(opts...))
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+
+	sb.WriteString("flowchart TD\n")
+
+	for i, r := range rules {
+		fmt.Fprintf(&sb, "  subgraph rule%d [\"%s\"]\n", i, mermaidString(r.label))
+		for _, n := range r.nodes {
+			fmt.Fprintf(&sb, "    %s[\"%s\"]\n", n.id, mermaidLabel(n.label))
+		}
+		sb.WriteString("  end\n")
+
+		for _, n := range r.nodes {
+			if n.parent == "" {
+				continue
+			}
+			arrow := "-->"
+			if n.negate {
+				arrow = "-.->"
+			}
+			fmt.Fprintf(&sb, "  %s %s|\"%s\"| %s\n", n.parent, arrow, mermaidString(n.edge), n.id)
+		}
+	}
+
+	_, err = io.WriteString(w, sb.String())
+	return err
+}
+
+func graphRules(tree *AstT, o *graphOptsT) ([]graphRuleT, error) {
+
+	var (
+		rules []graphRuleT
+		next  int
+	)
+
+	for _, root := range tree.Nodes {
+
+		if o.rule != "" && !matchRule(root, o.rule) {
+			continue
+		}
+
+		var r = graphRuleT{
+			label: fmt.Sprintf("rule %s cre %s", root.Metadata.RuleId, root.Metadata.CreId),
+		}
+
+		addGraphNodes(&r, root, "", &next)
+		rules = append(rules, r)
+	}
+
+	if o.rule != "" && len(rules) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrRuleNotFound, o.rule)
+	}
+
+	return rules, nil
+}
+
+func matchRule(root *AstNodeT, rule string) bool {
+	return rule == root.Metadata.Address.GetRuleHash() ||
+		rule == root.Metadata.RuleId ||
+		rule == root.Metadata.CreId
+}
+
+func addGraphNodes(r *graphRuleT, node *AstNodeT, parent string, next *int) {
+
+	var n = graphNodeT{
+		id:     fmt.Sprintf("n%d", *next),
+		label:  nodeLabel(node),
+		parent: parent,
+	}
+	*next++
+
+	if idx, err := node.Metadata.Address.GetTermIdx(); err == nil {
+		n.edge = fmt.Sprintf("t%d", idx)
+	}
+
+	r.nodes = append(r.nodes, n)
+
+	for i, c := range node.Children {
+		before := len(r.nodes)
+		addGraphNodes(r, c, n.id, next)
+		if node.Metadata.NegIdx >= 0 && i >= node.Metadata.NegIdx {
+			r.nodes[before].negate = true
+			r.nodes[before].edge = "negate " + r.nodes[before].edge
+		}
+	}
+}
+
+// nodeLabel returns the lines describing a node: its type and address, its
+// window and event source, its negate options, terms and correlations.
+func nodeLabel(node *AstNodeT) []string {
+
+	var (
+		md    = node.Metadata
+		addr  = md.Address
+		lines = []string{
+			fmt.Sprintf("%s d%d.n%d", md.Type, addr.GetDepth(), addr.GetNodeId()),
+		}
+	)
+
+	if md.Scope != "" {
+		lines = append(lines, "scope "+md.Scope)
+	}
+
+	if opts := negateString(md.NegateOpts); opts != "" {
+		lines = append(lines, "negate "+opts)
+	}
+
+	switch o := node.Object.(type) {
+	case *AstSeqMatcherT:
+		lines = append(lines, machineLines(o.Window.String(), node.Metadata.NegIdx, o.Correlations, o.CorrelationKeys)...)
+
+	case *AstSetMatcherT:
+		lines = append(lines, machineLines(o.Window.String(), node.Metadata.NegIdx, o.Correlations, o.CorrelationKeys)...)
+
+	case *AstLogMatcherT:
+		src := "source " + o.Event.Source
+		if o.Event.Origin {
+			src += " (origin)"
+		}
+		lines = append(lines, src)
+		if o.Window > 0 {
+			lines = append(lines, "window "+o.Window.String())
+		}
+		for i, f := range o.Match {
+			lines = append(lines, fmt.Sprintf("%d: %s", i, f.String()))
+		}
+		for i, f := range o.Negate {
+			line := fmt.Sprintf("%d: not %s", len(o.Match)+i, f.String())
+			if opts := negateString(f.NegateOpts); opts != "" {
+				line += " [" + opts + "]"
+			}
+			lines = append(lines, line)
+		}
+		for _, k := range o.CorrelationKeys {
+			lines = append(lines, "key "+correlationKeyString(k))
+		}
+
+	case *AstDetectionT:
+		lines = append(lines, o.String())
+	}
+
+	return lines
+}
+
+func machineLines(window string, negIdx int, correlations []string, keys []AstCorrelationT) []string {
+
+	var lines = []string{"window " + window}
+
+	if negIdx >= 0 {
+		lines = append(lines, fmt.Sprintf("negate from t%d", negIdx))
+	}
+
+	if len(correlations) > 0 {
+		lines = append(lines, "correlations "+strings.Join(correlations, ", "))
+	}
+
+	for _, c := range keys {
+		lines = append(lines, "correlation "+c.Name)
+	}
+
+	return lines
+}
+
+func negateString(o *AstNegateOptsT) string {
+
+	if o == nil {
+		return ""
+	}
+
+	var parts []string
+
+	if o.Window != 0 {
+		parts = append(parts, "window "+o.Window.String())
+	}
+	if o.Slide != 0 {
+		parts = append(parts, "slide "+o.Slide.String())
+	}
+	if o.Anchor != 0 {
+		parts = append(parts, fmt.Sprintf("anchor %d", o.Anchor))
+	}
+	if o.Absolute {
+		parts = append(parts, "absolute")
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func correlationKeyString(k AstCorrelationKeyT) string {
+	switch {
+	case k.Field != "":
+		return fmt.Sprintf("%s field %s", k.Name, k.Field)
+	case k.Jq != "":
+		return fmt.Sprintf("%s jq %q", k.Name, k.Jq)
+	case k.Regex != "":
+		return fmt.Sprintf("%s regex %q", k.Name, k.Regex)
+	}
+	return k.Name
+}
+
+// dotString quotes s as a DOT string.
+func dotString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// dotLabel joins the lines of a label, left justified.
+func dotLabel(lines []string) string {
+	var quoted = make([]string, 0, len(lines))
+	for _, l := range lines {
+		q := dotString(l)
+		quoted = append(quoted, q[1:len(q)-1])
+	}
+	return `"` + strings.Join(quoted, `\l`) + `\l"`
+}
+
+// mermaidString escapes s for a quoted Mermaid label.
+func mermaidString(s string) string {
+	return strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace(s)
+}
+
+func mermaidLabel(lines []string) string {
+	var escaped = make([]string, 0, len(lines))
+	for _, l := range lines {
+		escaped = append(escaped, mermaidString(l))
+	}
+	return strings.Join(escaped, "<br/>")
+}
@@ -0,0 +1,305 @@
+package ast
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	AstFormat        = "prequel-ast"
+	AstFormatVersion = 1
+)
+
+// Discriminators of the node objects in the JSON form of an AST
+const (
+	ObjTypeSeq       = "seq"
+	ObjTypeSet       = "set"
+	ObjTypeLog       = "log"
+	ObjTypeDetection = "detection"
+)
+
+var (
+	ErrAstFormat     = errors.New("not a serialized AST")
+	ErrAstVersion    = errors.New("unsupported AST format version")
+	ErrAstObjectType = errors.New("unknown AST object type")
+	ErrAstTermRef    = errors.New("AST term does not reference a child")
+)
+
+// astDocT is the JSON form of an AST. Node objects carry a type
+// discriminator, and the terms of machines reference their children by
+// index so the decoded terms share the metadata of the children.
+type astDocT struct {
+	Format  string      `json:"format"`
+	Version int         `json:"version"`
+	Nodes   []*astNodeJ `json:"nodes"`
+}
+
+type astNodeJ struct {
+	Metadata   AstMetadataT    `json:"metadata"`
+	ObjectType string          `json:"object_type,omitempty"`
+	Object     json.RawMessage `json:"object,omitempty"`
+	Children   []*astNodeJ     `json:"children,omitempty"`
+}
+
+// astMachineJ is the JSON form of AstSeqMatcherT and AstSetMatcherT. Terms
+// are indexes into the children of the node.
+type astMachineJ struct {
+	Terms           []int             `json:"terms"`
+	Negate          []int             `json:"negate"`
+	Correlations    []string          `json:"correlations"`
+	CorrelationKeys []AstCorrelationT `json:"correlation_keys"`
+	Bindings        []string          `json:"bindings"`
+	Window          time.Duration     `json:"window"`
+}
+
+// MarshalJSON encodes the AST in a versioned, self-describing form that
+// UnmarshalJSON decodes back into the same tree.
+func (a AstT) MarshalJSON() ([]byte, error) {
+
+	var doc = astDocT{
+		Format:  AstFormat,
+		Version: AstFormatVersion,
+		Nodes:   make([]*astNodeJ, 0, len(a.Nodes)),
+	}
+
+	for _, node := range a.Nodes {
+		n, err := encodeNode(node)
+		if err != nil {
+			return nil, err
+		}
+		doc.Nodes = append(doc.Nodes, n)
+	}
+
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON decodes an AST encoded by MarshalJSON. The terms of machines
+// point at the metadata of their children and the children share the
+// address of their parent, as in a built tree.
+func (a *AstT) UnmarshalJSON(data []byte) error {
+
+	var doc astDocT
+
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	if doc.Format != AstFormat {
+		return fmt.Errorf("%w: format %q", ErrAstFormat, doc.Format)
+	}
+
+	if doc.Version < 1 || doc.Version > AstFormatVersion {
+		return fmt.Errorf("%w: %d", ErrAstVersion, doc.Version)
+	}
+
+	var nodes = make([]*AstNodeT, 0, len(doc.Nodes))
+
+	for _, n := range doc.Nodes {
+		node, err := decodeNode(n, nil)
+		if err != nil {
+			return err
+		}
+		nodes = append(nodes, node)
+	}
+
+	a.Nodes = nodes
+
+	return nil
+}
+
+func encodeNode(node *AstNodeT) (*astNodeJ, error) {
+
+	var (
+		n = &astNodeJ{
+			Metadata: node.Metadata,
+		}
+		obj any
+		err error
+	)
+
+	switch o := node.Object.(type) {
+	case nil:
+	case *AstSeqMatcherT:
+		n.ObjectType = ObjTypeSeq
+		obj, err = encodeMachine(node, o.Order, o.Negate, o.Correlations, o.CorrelationKeys, o.Bindings, o.Window)
+	case *AstSetMatcherT:
+		n.ObjectType = ObjTypeSet
+		obj, err = encodeMachine(node, o.Match, o.Negate, o.Correlations, o.CorrelationKeys, o.Bindings, o.Window)
+	case *AstLogMatcherT:
+		n.ObjectType = ObjTypeLog
+		obj = o
+	case *AstDetectionT:
+		n.ObjectType = ObjTypeDetection
+		obj = o
+	default:
+		return nil, fmt.Errorf("%w: %T", ErrAstObjectType, node.Object)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if obj != nil {
+		if n.Object, err = json.Marshal(obj); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range node.Children {
+		child, err := encodeNode(c)
+		if err != nil {
+			return nil, err
+		}
+		n.Children = append(n.Children, child)
+	}
+
+	return n, nil
+}
+
+func encodeMachine(node *AstNodeT, terms, negate []*AstMetadataT, correlations []string, keys []AstCorrelationT, bindings []string, window time.Duration) (*astMachineJ, error) {
+
+	var (
+		m = &astMachineJ{
+			Correlations:    correlations,
+			CorrelationKeys: keys,
+			Bindings:        bindings,
+			Window:          window,
+		}
+		err error
+	)
+
+	if m.Terms, err = termIndexes(node, terms); err != nil {
+		return nil, err
+	}
+
+	if m.Negate, err = termIndexes(node, negate); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// termIndexes returns the index of the child holding each term metadata.
+func termIndexes(node *AstNodeT, terms []*AstMetadataT) ([]int, error) {
+
+	var idxs = make([]int, 0, len(terms))
+
+TERMS:
+	for _, term := range terms {
+		for i, c := range node.Children {
+			if &c.Metadata == term {
+				idxs = append(idxs, i)
+				continue TERMS
+			}
+		}
+		return nil, fmt.Errorf("%w: %s", ErrAstTermRef, addressString(node.Metadata.Address))
+	}
+
+	return idxs, nil
+}
+
+func decodeNode(n *astNodeJ, parent *AstNodeT) (*AstNodeT, error) {
+
+	var node = &AstNodeT{
+		Metadata: n.Metadata,
+	}
+
+	// Children share the address of their parent
+	if parent != nil && sameAddress(node.Metadata.ParentAddress, parent.Metadata.Address) {
+		node.Metadata.ParentAddress = parent.Metadata.Address
+	}
+
+	for _, c := range n.Children {
+		child, err := decodeNode(c, node)
+		if err != nil {
+			return nil, err
+		}
+		node.Children = append(node.Children, child)
+	}
+
+	var err error
+
+	switch n.ObjectType {
+	case "":
+	case ObjTypeSeq:
+		var m astMachineJ
+		if err = json.Unmarshal(n.Object, &m); err != nil {
+			return nil, err
+		}
+		seq := &AstSeqMatcherT{
+			Correlations:    m.Correlations,
+			CorrelationKeys: m.CorrelationKeys,
+			Bindings:        m.Bindings,
+			Window:          m.Window,
+		}
+		if seq.Order, err = termMetadata(node, m.Terms); err != nil {
+			return nil, err
+		}
+		if seq.Negate, err = termMetadata(node, m.Negate); err != nil {
+			return nil, err
+		}
+		node.Object = seq
+	case ObjTypeSet:
+		var m astMachineJ
+		if err = json.Unmarshal(n.Object, &m); err != nil {
+			return nil, err
+		}
+		set := &AstSetMatcherT{
+			Correlations:    m.Correlations,
+			CorrelationKeys: m.CorrelationKeys,
+			Bindings:        m.Bindings,
+			Window:          m.Window,
+		}
+		if set.Match, err = termMetadata(node, m.Terms); err != nil {
+			return nil, err
+		}
+		if set.Negate, err = termMetadata(node, m.Negate); err != nil {
+			return nil, err
+		}
+		node.Object = set
+	case ObjTypeLog:
+		var lm AstLogMatcherT
+		if err = json.Unmarshal(n.Object, &lm); err != nil {
+			return nil, err
+		}
+		node.Object = &lm
+	case ObjTypeDetection:
+		var det AstDetectionT
+		if err = json.Unmarshal(n.Object, &det); err != nil {
+			return nil, err
+		}
+		node.Object = &det
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrAstObjectType, n.ObjectType)
+	}
+
+	return node, nil
+}
+
+// termMetadata returns the metadata of the children at idxs.
+func termMetadata(node *AstNodeT, idxs []int) ([]*AstMetadataT, error) {
+
+	var terms = make([]*AstMetadataT, 0, len(idxs))
+
+	for _, i := range idxs {
+		if i < 0 || i >= len(node.Children) {
+			return nil, fmt.Errorf("%w: %s term %d", ErrAstTermRef, addressString(node.Metadata.Address), i)
+		}
+		terms = append(terms, &node.Children[i].Metadata)
+	}
+
+	return terms, nil
+}
+
+func sameAddress(a, b *AstNodeAddressT) bool {
+	return a != nil && b != nil && a.String() == b.String()
+}
+
+func addressString(a *AstNodeAddressT) string {
+	if a == nil {
+		return "<nil>"
+	}
+	return a.String()
+}
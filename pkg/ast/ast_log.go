@@ -2,6 +2,9 @@ package ast
 
 import (
 	"errors"
+	"regexp"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/prequel-dev/prequel-compiler/pkg/parser"
@@ -16,10 +19,12 @@ var (
 )
 
 type AstLogMatcherT struct {
-	Event  AstEventT
-	Match  []AstFieldT
-	Negate []AstFieldT
-	Window time.Duration
+	Event           AstEventT            `json:"event"`
+	Match           []AstFieldT          `json:"match"`
+	Negate          []AstFieldT          `json:"negate"`
+	Window          time.Duration        `json:"window"`
+	Bindings        []string             `json:"bindings"`         // Variables bound by the terms, sorted
+	CorrelationKeys []AstCorrelationKeyT `json:"correlation_keys"` // Keys of the enclosing correlations for this event source
 }
 
 func validateLogSeq(n *parser.NodeT, matches int) error {
@@ -146,59 +151,162 @@ func (b *builderT) doBuildLogMatcherNode(parserNode *parser.NodeT, machineAddres
 	var (
 		address   = b.newAstNodeAddress(parserNode.Metadata.RuleHash, parserNode.Metadata.Type.String(), termIdx)
 		matchNode = newAstNode(parserNode, parserNode.Metadata.Type, schema.ScopeNode, machineAddress, address)
+		bindings  = logBindings(matchFields, negateFields)
 	)
 
-	matchNode.Object = &AstLogMatcherT{
+	lm := &AstLogMatcherT{
 		Event: AstEventT{
 			Origin: parserNode.Metadata.Event.Origin,
 			Source: parserNode.Metadata.Event.Source,
 		},
-		Match:  matchFields,
-		Negate: negateFields,
-		Window: parserNode.Metadata.Window,
+		Match:    matchFields,
+		Negate:   negateFields,
+		Window:   parserNode.Metadata.Window,
+		Bindings: bindings,
 	}
 
+	if err := attachCorrelationKeys(parserNode, correlationKeys(parserNode.Metadata.CorrelationKeys), []*AstLogMatcherT{lm}); err != nil {
+		return nil, err
+	}
+
+	matchNode.Object = lm
+
 	return matchNode, nil
 }
 
+// logBindings returns the sorted variables bound by the terms of a log
+// matcher. Terms may bind different variables; the values of a variable
+// bound by several terms must agree for the terms to match together.
+func logBindings(matchFields, negateFields []AstFieldT) []string {
+
+	var bindings []string
+
+	for _, field := range slices.Concat(matchFields, negateFields) {
+		bindings = append(bindings, bindingNames(field.Bindings)...)
+	}
+
+	slices.Sort(bindings)
+
+	return slices.Compact(bindings)
+}
+
+func bindingNames(bindings []AstBindingT) []string {
+	var names []string
+	for _, b := range bindings {
+		names = append(names, b.Name)
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
 func newMatchTerm(field parser.FieldT) (AstFieldT, error) {
 	var (
 		t     AstFieldT
-		count = 0
+		count int
+		err   error
 	)
 
 	t = AstFieldT{
 		Field: field.Field,
+		Pos:   field.Pos,
+	}
+
+	t.TermValue, count = termValue(field.StrValue, field.JqValue, field.RegexValue)
+
+	if count > 1 {
+		log.Error().Msg("Only one of str, json, or regex value can be set")
+		return AstFieldT{}, ErrInvalidNodeType
+	}
+
+	for _, p := range field.Fields {
+		pred := AstPredicateT{
+			Field: p.Field,
+			Pos:   p.Pos,
+		}
+
+		// The parser rejects predicates with more than one value
+		pred.TermValue, _ = termValue(p.StrValue, p.JqValue, p.RegexValue)
+
+		t.Predicates = append(t.Predicates, pred)
+	}
+
+	t.Bindings = termBindings(field)
+
+	for _, ex := range field.Exclude {
+		var exclude AstFieldT
+		if exclude, err = newMatchTerm(ex); err != nil {
+			return AstFieldT{}, err
+		}
+		// Exclusions only veto a match; captures in their regex bind nothing
+		exclude.Bindings = nil
+		t.Exclude = append(t.Exclude, exclude)
 	}
 
-	if field.StrValue != "" {
-		t.TermValue = match.TermT{
+	return t, nil
+}
+
+// termBindings returns the bindings of a term sorted by name; regex
+// captures come before jq expressions binding the same name.
+func termBindings(field parser.FieldT) []AstBindingT {
+
+	var bindings []AstBindingT
+
+	if field.RegexValue != "" {
+		// The parser has already compiled the regex
+		if re, err := regexp.Compile(field.RegexValue); err == nil {
+			for _, name := range re.SubexpNames() {
+				if name != "" {
+					bindings = append(bindings, AstBindingT{Name: name})
+				}
+			}
+		}
+	}
+
+	for name, expr := range field.Bind {
+		bindings = append(bindings, AstBindingT{Name: name, Jq: expr})
+	}
+
+	slices.SortStableFunc(bindings, func(a, b AstBindingT) int {
+		if a.Name != b.Name {
+			return strings.Compare(a.Name, b.Name)
+		}
+		return strings.Compare(a.Jq, b.Jq)
+	})
+
+	return bindings
+}
+
+// termValue returns the match term for a str, jq or regex value along with
+// the number of values set.
+func termValue(str, jq, regex string) (match.TermT, int) {
+	var (
+		term  match.TermT
+		count = 0
+	)
+
+	if str != "" {
+		term = match.TermT{
 			Type:  match.TermRaw,
-			Value: field.StrValue,
+			Value: str,
 		}
 		count++
 	}
-	if field.JqValue != "" {
-		t.TermValue = match.TermT{
+	if jq != "" {
+		term = match.TermT{
 			Type:  match.TermJqJson,
-			Value: field.JqValue,
+			Value: jq,
 		}
 		count++
 	}
-	if field.RegexValue != "" {
-		t.TermValue = match.TermT{
+	if regex != "" {
+		term = match.TermT{
 			Type:  match.TermRegex,
-			Value: field.RegexValue,
+			Value: regex,
 		}
 		count++
 	}
 
-	if count > 1 {
-		log.Error().Msg("Only one of str, json, or regex value can be set")
-		return AstFieldT{}, ErrInvalidNodeType
-	}
-
-	return t, nil
+	return term, count
 }
 
 func newNegateTerm(field parser.FieldT, anchors uint32) (AstFieldT, error) {
@@ -1,6 +1,9 @@
 package ast
 
 import (
+	"fmt"
+	"maps"
+	"slices"
 	"time"
 
 	"github.com/prequel-dev/prequel-compiler/pkg/parser"
@@ -9,24 +12,28 @@ import (
 )
 
 type AstSeqMatcherT struct {
-	Order        []*AstMetadataT
-	Negate       []*AstMetadataT
-	Correlations []string
-	Window       time.Duration
+	Order           []*AstMetadataT
+	Negate          []*AstMetadataT
+	Correlations    []string
+	CorrelationKeys []AstCorrelationT
+	Bindings        []string // Variables bound by more than one child; their values must agree
+	Window          time.Duration
 }
 
 type AstSetMatcherT struct {
-	Match        []*AstMetadataT
-	Negate       []*AstMetadataT
-	Correlations []string
-	Window       time.Duration
+	Match           []*AstMetadataT
+	Negate          []*AstMetadataT
+	Correlations    []string
+	CorrelationKeys []AstCorrelationT
+	Bindings        []string // Variables bound by more than one child; their values must agree
+	Window          time.Duration
 }
 
 func (b *builderT) buildMachineNode(parserNode *parser.NodeT, parentMachineAddress, machineAddress *AstNodeAddressT, children []*AstNodeT) (*AstNodeT, error) {
 	var (
 		seqMatcher *AstSeqMatcherT
 		setMatcher *AstSetMatcherT
-		matchNode  = newAstNode(parserNode, parserNode.Metadata.Type, schema.ScopeCluster, parentMachineAddress, machineAddress)
+		matchNode  = newAstNode(parserNode, parserNode.Metadata.Type, machineScope(parserNode), parentMachineAddress, machineAddress)
 		err        error
 	)
 
@@ -67,6 +74,12 @@ func buildSeqMatcher(n *parser.NodeT, children []*AstNodeT) (*AstSeqMatcherT, er
 	}
 
 	sm.Order, sm.Negate = buildTermDescriptors(n, children)
+	sm.Bindings = sharedBindings(children)
+	sm.CorrelationKeys = correlationKeys(n.Metadata.CorrelationKeys)
+
+	if err := attachCorrelationKeys(n, sm.CorrelationKeys, logMatchers(children)); err != nil {
+		return nil, err
+	}
 
 	return sm, nil
 }
@@ -86,6 +99,12 @@ func buildSetMatcher(n *parser.NodeT, children []*AstNodeT) (*AstSetMatcherT, er
 	}
 
 	sm.Match, sm.Negate = buildTermDescriptors(n, children)
+	sm.Bindings = sharedBindings(children)
+	sm.CorrelationKeys = correlationKeys(n.Metadata.CorrelationKeys)
+
+	if err := attachCorrelationKeys(n, sm.CorrelationKeys, logMatchers(children)); err != nil {
+		return nil, err
+	}
 
 	return sm, nil
 }
@@ -112,3 +131,117 @@ func buildTermDescriptors(parserNode *parser.NodeT, children []*AstNodeT) ([]*As
 
 	return match, negate
 }
+
+// sharedBindings returns the sorted variables bound under more than one of
+// the children. The runtime only advances the machine on child matches that
+// agree on the values of these variables.
+func sharedBindings(children []*AstNodeT) []string {
+
+	var (
+		counts   = make(map[string]int)
+		bindings = make([]string, 0)
+	)
+
+	for _, child := range children {
+		for _, name := range nodeBindings(child) {
+			counts[name]++
+		}
+	}
+
+	for name, cnt := range counts {
+		if cnt > 1 {
+			bindings = append(bindings, name)
+		}
+	}
+
+	slices.Sort(bindings)
+
+	return bindings
+}
+
+// nodeBindings returns the variables bound anywhere under a node.
+func nodeBindings(node *AstNodeT) []string {
+
+	if lm, ok := node.Object.(*AstLogMatcherT); ok {
+		return lm.Bindings
+	}
+
+	var names []string
+	for _, child := range node.Children {
+		names = append(names, nodeBindings(child)...)
+	}
+
+	slices.Sort(names)
+
+	return slices.Compact(names)
+}
+
+func correlationKeys(corrs []parser.CorrelationT) []AstCorrelationT {
+
+	var keys []AstCorrelationT
+
+	for _, corr := range corrs {
+		c := AstCorrelationT{
+			Name:    corr.Name,
+			Sources: make(map[string]AstCorrelationKeyT, len(corr.Sources)),
+		}
+		for source, key := range corr.Sources {
+			c.Sources[source] = AstCorrelationKeyT{
+				Name:  corr.Name,
+				Field: key.Field,
+				Jq:    key.Jq,
+				Regex: key.Regex,
+			}
+		}
+		keys = append(keys, c)
+	}
+
+	return keys
+}
+
+// attachCorrelationKeys gives each log matcher the key of every correlation
+// for its event source. Every source must have a key and every key must
+// apply to a source. Keys defined closer to a matcher take precedence.
+func attachCorrelationKeys(n *parser.NodeT, corrs []AstCorrelationT, matchers []*AstLogMatcherT) error {
+
+	for _, corr := range corrs {
+
+		var used = make(map[string]bool, len(corr.Sources))
+
+		for _, lm := range matchers {
+			key, ok := corr.Sources[lm.Event.Source]
+			if !ok {
+				return n.WrapError(fmt.Errorf("%w: '%s' has no key for source %s", ErrCorrelationSource, corr.Name, lm.Event.Source))
+			}
+			used[lm.Event.Source] = true
+
+			if !slices.ContainsFunc(lm.CorrelationKeys, func(k AstCorrelationKeyT) bool { return k.Name == corr.Name }) {
+				lm.CorrelationKeys = append(lm.CorrelationKeys, key)
+			}
+		}
+
+		for _, source := range slices.Sorted(maps.Keys(corr.Sources)) {
+			if !used[source] {
+				return n.WrapError(fmt.Errorf("%w: '%s' key for source %s matches no events", ErrCorrelationSource, corr.Name, source))
+			}
+		}
+	}
+
+	return nil
+}
+
+// logMatchers returns the log matchers below nodes.
+func logMatchers(nodes []*AstNodeT) []*AstLogMatcherT {
+
+	var matchers []*AstLogMatcherT
+
+	for _, node := range nodes {
+		if lm, ok := node.Object.(*AstLogMatcherT); ok {
+			matchers = append(matchers, lm)
+			continue
+		}
+		matchers = append(matchers, logMatchers(node.Children)...)
+	}
+
+	return matchers
+}
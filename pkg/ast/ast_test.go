@@ -1,15 +1,19 @@
 package ast
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/prequel-dev/prequel-compiler/pkg/parser"
 	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
 	"github.com/prequel-dev/prequel-compiler/pkg/testdata"
 	"github.com/rs/zerolog/log"
 )
@@ -65,6 +69,14 @@ func TestAstSuccess(t *testing.T) {
 			rule:              testdata.TestSuccessNegateOptions2,
 			expectedNodeTypes: []string{"machine_seq", "log_seq", "log_set", "log_set"},
 		},
+		"Success_OrgClusters": {
+			rule:              testdata.TestSuccessOrgClusters,
+			expectedNodeTypes: []string{"machine_set", "detection"},
+		},
+		"Success_OrgSequence": {
+			rule:              testdata.TestSuccessOrgSequence,
+			expectedNodeTypes: []string{"machine_seq", "detection", "detection", "detection"},
+		},
 	}
 
 	for name, test := range tests {
@@ -77,7 +89,7 @@ func TestAstSuccess(t *testing.T) {
 				t.Fatalf("Error parsing rule: %v", err)
 			}
 
-			if err = DrawTree(ast, fmt.Sprintf("rule_%s.dot", name)); err != nil {
+			if err = DrawTree(ast, filepath.Join(t.TempDir(), fmt.Sprintf("rule_%s.dot", name))); err != nil {
 				t.Fatalf("Error drawing tree: %v", err)
 			}
 
@@ -177,6 +189,18 @@ func TestAstFail(t *testing.T) {
 			line: 11,
 			col:  9,
 		},
+		"Fail_CorrelationSource": {
+			rule: testdata.TestFailCorrelationSource,
+			err:  ErrCorrelationSource,
+			line: 11,
+			col:  9,
+		},
+		"Fail_DetectionWindow": {
+			rule: testdata.TestFailDetectionWindow,
+			err:  ErrDetectionWindow,
+			line: 11,
+			col:  9,
+		},
 	}
 
 	for name, test := range tests {
@@ -248,3 +272,293 @@ func TestFailureExamples(t *testing.T) {
 		}
 	}
 }
+
+func TestAstDiagnostics(t *testing.T) {
+
+	tree, err := parser.Parse([]byte(testdata.TestDiagnosticsAstRules))
+	if err != nil {
+		t.Fatalf("Error parsing rules: %v", err)
+	}
+
+	ast, err := BuildTree(tree, WithDiagnostics())
+	if err == nil {
+		t.Fatalf("Expected diagnostics error")
+	}
+
+	if ast == nil || len(ast.Nodes) != 1 {
+		t.Fatalf("Expected partial ast with 1 valid rule, got %v", ast)
+	}
+
+	diags := pqerr.ListOf(err)
+	if len(diags) != 1 {
+		t.Fatalf("Expected 1 diagnostic, got %d: %v", len(diags), err)
+	}
+
+	if !errors.Is(diags[0], ErrInvalidWindow) {
+		t.Errorf("Expected error %v, got %v", ErrInvalidWindow, diags[0])
+	}
+
+	if diags[0].CreId != "TestDiagnosticsSingleMatchWindow" {
+		t.Errorf("Expected cre id TestDiagnosticsSingleMatchWindow, got %s", diags[0].CreId)
+	}
+
+	if diags[0].Pos.Line != 12 || diags[0].Pos.Col != 17 {
+		t.Errorf("Expected error position line=12 col=17, got line=%d col=%d", diags[0].Pos.Line, diags[0].Pos.Col)
+	}
+}
+
+func TestAstOrgScope(t *testing.T) {
+
+	ast, err := Build([]byte(testdata.TestSuccessOrgSequence))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	root := ast.Nodes[0]
+	if root.Metadata.Scope != schema.ScopeOrganization {
+		t.Errorf("Expected root scope %s, got %s", schema.ScopeOrganization, root.Metadata.Scope)
+	}
+
+	sm, ok := root.Object.(*AstSeqMatcherT)
+	if !ok {
+		t.Fatalf("Expected sequence matcher, got %T", root.Object)
+	}
+
+	if len(sm.Order) != 2 || len(sm.Negate) != 1 {
+		t.Fatalf("Expected 2 order and 1 negate terms, got %d and %d", len(sm.Order), len(sm.Negate))
+	}
+
+	for i, child := range root.Children {
+		if child.Metadata.Scope != schema.ScopeOrganization {
+			t.Errorf("Expected child %d scope %s, got %s", i, schema.ScopeOrganization, child.Metadata.Scope)
+		}
+		if idx, err := child.Metadata.Address.GetTermIdx(); err != nil || idx != uint32(i) {
+			t.Errorf("Expected child %d term idx %d, got %d (%v)", i, i, idx, err)
+		}
+	}
+
+	det, ok := root.Children[1].Object.(*AstDetectionT)
+	if !ok {
+		t.Fatalf("Expected detection, got %T", root.Children[1].Object)
+	}
+
+	if det.CreId != "KAFKA-CONSUMER-LAG" || det.Cluster != "consumers-b" || det.Window != 10*time.Minute {
+		t.Errorf("Unexpected detection %+v", det)
+	}
+
+	// Cluster rules keep their scope
+	ast, err = Build([]byte(testdata.TestSuccessSimpleRule1))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	if scope := ast.Nodes[0].Metadata.Scope; scope != schema.ScopeCluster {
+		t.Errorf("Expected root scope %s, got %s", schema.ScopeCluster, scope)
+	}
+}
+
+// checkShared reports terms and parent addresses that are copies instead of
+// pointers into the tree.
+func checkShared(t *testing.T, node *AstNodeT) {
+
+	var terms []*AstMetadataT
+
+	switch o := node.Object.(type) {
+	case *AstSeqMatcherT:
+		terms = append(append(terms, o.Order...), o.Negate...)
+	case *AstSetMatcherT:
+		terms = append(append(terms, o.Match...), o.Negate...)
+	}
+
+	for i, term := range terms {
+		if i >= len(node.Children) || term != &node.Children[i].Metadata {
+			t.Errorf("Term %d of %s is not the metadata of its child", i, node.Metadata.Address.String())
+		}
+	}
+
+	for _, c := range node.Children {
+		if c.Metadata.ParentAddress != node.Metadata.Address {
+			t.Errorf("Parent address of %s is a copy", c.Metadata.Address.String())
+		}
+		checkShared(t, c)
+	}
+}
+
+func TestAstJSON(t *testing.T) {
+
+	rules, err := filepath.Glob(filepath.Join("../testdata", "success_examples", "*.yaml"))
+	if err != nil {
+		t.Fatalf("Error finding CRE test files: %v", err)
+	}
+
+	var docs = map[string][]byte{
+		"Success_Complex2":    []byte(testdata.TestSuccessComplexRule2),
+		"Success_OrgSequence": []byte(testdata.TestSuccessOrgSequence),
+		"Success_Bind":        []byte(testdata.TestSuccessBind),
+		"Success_BindMixed":   []byte(testdata.TestSuccessBindMixed),
+		"Success_BindOverlap": []byte(testdata.TestSuccessBindOverlap),
+	}
+
+	for _, rule := range rules {
+		if docs[filepath.Base(rule)], err = os.ReadFile(rule); err != nil {
+			t.Fatalf("Error reading test file %s: %v", rule, err)
+		}
+	}
+
+	for name, data := range docs {
+		t.Run(name, func(t *testing.T) {
+
+			tree, err := Build(data)
+			if err != nil {
+				t.Fatalf("Error building rule: %v", err)
+			}
+
+			encoded, err := json.Marshal(tree)
+			if err != nil {
+				t.Fatalf("Error encoding AST: %v", err)
+			}
+
+			var decoded AstT
+			if err = json.Unmarshal(encoded, &decoded); err != nil {
+				t.Fatalf("Error decoding AST: %v", err)
+			}
+
+			if !reflect.DeepEqual(tree, &decoded) {
+				t.Errorf("Decoded AST differs from the built AST")
+			}
+
+			for _, node := range decoded.Nodes {
+				checkShared(t, node)
+			}
+
+			reencoded, err := json.Marshal(decoded)
+			if err != nil {
+				t.Fatalf("Error encoding decoded AST: %v", err)
+			}
+
+			if string(encoded) != string(reencoded) {
+				t.Errorf("Encoding is not stable")
+			}
+		})
+	}
+}
+
+func TestAstJSONFail(t *testing.T) {
+
+	var tests = map[string]struct {
+		data string
+		err  error
+	}{
+		"Format":     {data: `{"format":"other","version":1,"nodes":[]}`, err: ErrAstFormat},
+		"Version":    {data: `{"format":"prequel-ast","version":2,"nodes":[]}`, err: ErrAstVersion},
+		"ObjectType": {data: `{"format":"prequel-ast","version":1,"nodes":[{"metadata":{},"object_type":"tree","object":{}}]}`, err: ErrAstObjectType},
+		"TermRef":    {data: `{"format":"prequel-ast","version":1,"nodes":[{"metadata":{},"object_type":"seq","object":{"terms":[0,1],"negate":[]}}]}`, err: ErrAstTermRef},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var tree AstT
+			if err := json.Unmarshal([]byte(test.data), &tree); !errors.Is(err, test.err) {
+				t.Errorf("Expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestGraph(t *testing.T) {
+
+	tree, err := Build([]byte(testdata.TestSuccessNegateOptions2))
+	if err != nil {
+		t.Fatalf("Error building rule: %v", err)
+	}
+
+	var dot, mermaid strings.Builder
+
+	if err = WriteDot(&dot, tree); err != nil {
+		t.Fatalf("Error writing DOT: %v", err)
+	}
+
+	if err = WriteMermaid(&mermaid, tree); err != nil {
+		t.Fatalf("Error writing Mermaid: %v", err)
+	}
+
+	var tests = map[string]struct {
+		out  string
+		want []string
+	}{
+		"Dot": {
+			out: dot.String(),
+			want: []string{
+				"digraph ast {",
+				"subgraph cluster_0 {",
+				`window 30s\lnegate from t2\lcorrelations hostname\l`,
+				`source log (origin)\lwindow 10s\l0: \"Discarding message\"\l`,
+				`11: not \"SIGTERM\"\l`,
+				`negate window 10s slide 1s\l`,
+				`n0 -> n1 [label="t0"];`,
+				`n0 -> n3 [label="negate t2", style=dashed];`,
+			},
+		},
+		"Mermaid": {
+			out: mermaid.String(),
+			want: []string{
+				"flowchart TD",
+				"subgraph rule0 [",
+				"window 30s<br/>negate from t2<br/>correlations hostname",
+				"11: not #quot;SIGTERM#quot;",
+				"negate window 10s slide 1s",
+				`n0 -->|"t0"| n1`,
+				`n0 -.->|"negate t2"| n3`,
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			for _, want := range test.want {
+				if !strings.Contains(test.out, want) {
+					t.Errorf("Expected %q in:\n%s", want, test.out)
+				}
+			}
+		})
+	}
+}
+
+func TestGraphRule(t *testing.T) {
+
+	var tree = &AstT{}
+
+	for _, data := range []string{testdata.TestSuccessSimpleRule1, testdata.TestSuccessOrgSequence} {
+		pt, err := parser.Parse([]byte(data), parser.WithGenIds())
+		if err != nil {
+			t.Fatalf("Error parsing rule: %v", err)
+		}
+		ast, err := BuildTree(pt)
+		if err != nil {
+			t.Fatalf("Error building tree: %v", err)
+		}
+		tree.Nodes = append(tree.Nodes, ast.Nodes...)
+	}
+
+	var all strings.Builder
+	if err := WriteDot(&all, tree); err != nil {
+		t.Fatalf("Error writing DOT: %v", err)
+	}
+
+	if !strings.Contains(all.String(), "cluster_1") {
+		t.Errorf("Expected a cluster for each rule:\n%s", all.String())
+	}
+
+	var one strings.Builder
+	if err := WriteMermaid(&one, tree, WithRule(tree.Nodes[1].Metadata.CreId)); err != nil {
+		t.Fatalf("Error writing Mermaid: %v", err)
+	}
+
+	if strings.Contains(one.String(), "rule1") || !strings.Contains(one.String(), "detection") {
+		t.Errorf("Expected only the second rule:\n%s", one.String())
+	}
+
+	if err := WriteDot(&one, tree, WithRule("unknown")); !errors.Is(err, ErrRuleNotFound) {
+		t.Errorf("Expected %v, got %v", ErrRuleNotFound, err)
+	}
+}
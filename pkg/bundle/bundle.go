@@ -0,0 +1,210 @@
+// Package bundle stores compiled rules in a versioned, checksummed binary
+// file so runtimes can load them without parsing YAML or building the AST.
+package bundle
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-compiler/pkg/compiler"
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+)
+
+const (
+	BundleVersion = 1
+	Magic         = "PQRB"
+
+	// Upper bound on the compressed payload, to reject corrupt lengths
+	maxPayload = 1 << 30
+)
+
+var (
+	ErrBundleMagic      = errors.New("not a rule bundle")
+	ErrBundleVersion    = errors.New("unsupported rule bundle version")
+	ErrBundleAstVersion = errors.New("rule bundle AST version mismatch")
+	ErrBundleChecksum   = errors.New("rule bundle checksum mismatch")
+	ErrBundleSize       = errors.New("invalid rule bundle size")
+	ErrBundleRules      = errors.New("rule bundle rules do not match the AST")
+)
+
+// headerT is the fixed size header of a bundle, little endian. The
+// checksum is the SHA-256 of the payload.
+type headerT struct {
+	Magic      [4]byte
+	Version    uint16
+	AstVersion uint16
+	Size       uint64
+	Checksum   [sha256.Size]byte
+}
+
+// RuleT holds the metadata and CRE data of a rule in a bundle.
+type RuleT struct {
+	Metadata parser.ParseRuleMetadataT `json:"metadata"`
+	Cre      parser.ParseCreT          `json:"cre"`
+}
+
+// BundleT is a set of rules compiled to an AST. Rules are in the order of
+// the rule nodes of the tree.
+type BundleT struct {
+	Rules []RuleT   `json:"rules"`
+	Tree  *ast.AstT `json:"tree"`
+}
+
+// Build parses a rules document and builds the bundle of its rules.
+func Build(data []byte, opts ...parser.ParseOptT) (*BundleT, error) {
+
+	var (
+		config *parser.RulesT
+		tree   *parser.TreeT
+		b      = &BundleT{}
+		err    error
+	)
+
+	if config, err = parser.Unmarshal(data); err != nil {
+		return nil, err
+	}
+
+	if tree, err = parser.Parse(data, opts...); err != nil {
+		return nil, err
+	}
+
+	if len(tree.Nodes) != len(config.Rules) {
+		return nil, ErrBundleRules
+	}
+
+	if b.Tree, err = ast.BuildTree(tree); err != nil {
+		return nil, err
+	}
+
+	for i, r := range config.Rules {
+		// Ids and hashes may have been generated by the parser
+		meta := r.Metadata
+		meta.Id = tree.Nodes[i].Metadata.RuleId
+		meta.Hash = tree.Nodes[i].Metadata.RuleHash
+
+		b.Rules = append(b.Rules, RuleT{
+			Metadata: meta,
+			Cre:      r.Cre,
+		})
+	}
+
+	return b, nil
+}
+
+// Rule returns the rule with the given hash.
+func (b *BundleT) Rule(hash string) (RuleT, bool) {
+	for _, r := range b.Rules {
+		if r.Metadata.Hash == hash {
+			return r, true
+		}
+	}
+	return RuleT{}, false
+}
+
+// Compile compiles the objects of a scope from the AST of the bundle.
+func (b *BundleT) Compile(scope string, opts ...compiler.CompilerOptT) (compiler.ObjsT, error) {
+	return compiler.CompileAst(b.Tree, scope, opts...)
+}
+
+// Write writes the bundle: the header, then the compressed JSON encoding
+// of the rules and the typed AST.
+func (b *BundleT) Write(w io.Writer) error {
+
+	var (
+		payload bytes.Buffer
+		zw      = gzip.NewWriter(&payload)
+	)
+
+	if err := json.NewEncoder(zw).Encode(b); err != nil {
+		return err
+	}
+
+	if err := zw.Close(); err != nil {
+		return err
+	}
+
+	var hdr = headerT{
+		Version:    BundleVersion,
+		AstVersion: ast.AstVersion,
+		Size:       uint64(payload.Len()),
+		Checksum:   sha256.Sum256(payload.Bytes()),
+	}
+	copy(hdr.Magic[:], Magic)
+
+	if err := binary.Write(w, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+
+	_, err := w.Write(payload.Bytes())
+	return err
+}
+
+// Load reads a bundle written by Write. Bundles of another format version
+// or AST version, or whose checksum does not match, are rejected.
+func Load(r io.Reader) (*BundleT, error) {
+
+	var hdr headerT
+
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBundleMagic, err)
+	}
+
+	if string(hdr.Magic[:]) != Magic {
+		return nil, ErrBundleMagic
+	}
+
+	if hdr.Version != BundleVersion {
+		return nil, fmt.Errorf("%w: %d", ErrBundleVersion, hdr.Version)
+	}
+
+	if hdr.AstVersion != ast.AstVersion {
+		return nil, fmt.Errorf("%w: %d != %d", ErrBundleAstVersion, hdr.AstVersion, ast.AstVersion)
+	}
+
+	if hdr.Size > maxPayload {
+		return nil, fmt.Errorf("%w: %d", ErrBundleSize, hdr.Size)
+	}
+
+	// The header is not verified yet; grow the buffer with the data read
+	// rather than allocating the declared size up front.
+	var buf bytes.Buffer
+
+	if _, err := buf.ReadFrom(io.LimitReader(r, int64(hdr.Size))); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrBundleSize, err)
+	}
+
+	if uint64(buf.Len()) != hdr.Size {
+		return nil, fmt.Errorf("%w: %d != %d", ErrBundleSize, buf.Len(), hdr.Size)
+	}
+
+	var payload = buf.Bytes()
+
+	if sha256.Sum256(payload) != hdr.Checksum {
+		return nil, ErrBundleChecksum
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	var b BundleT
+
+	if err = json.NewDecoder(zr).Decode(&b); err != nil {
+		return nil, err
+	}
+
+	if b.Tree == nil || len(b.Tree.Nodes) != len(b.Rules) {
+		return nil, ErrBundleRules
+	}
+
+	return &b, nil
+}
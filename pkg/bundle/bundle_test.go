@@ -0,0 +1,135 @@
+package bundle
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/prequel-dev/prequel-compiler/pkg/testdata"
+)
+
+func writeBundle(t *testing.T, data []byte) (*BundleT, []byte) {
+
+	b, err := Build(data, parser.WithGenIds())
+	if err != nil {
+		t.Fatalf("Error building bundle: %v", err)
+	}
+
+	var buf bytes.Buffer
+	if err = b.Write(&buf); err != nil {
+		t.Fatalf("Error writing bundle: %v", err)
+	}
+
+	return b, buf.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+
+	rules, err := filepath.Glob(filepath.Join("../testdata", "success_examples", "*.yaml"))
+	if err != nil {
+		t.Fatalf("Error finding CRE test files: %v", err)
+	}
+
+	for _, rule := range rules {
+		t.Run(filepath.Base(rule), func(t *testing.T) {
+
+			data, err := os.ReadFile(rule)
+			if err != nil {
+				t.Fatalf("Error reading test file: %v", err)
+			}
+
+			b, raw := writeBundle(t, data)
+
+			loaded, err := Load(bytes.NewReader(raw))
+			if err != nil {
+				t.Fatalf("Error loading bundle: %v", err)
+			}
+
+			if !reflect.DeepEqual(b, loaded) {
+				t.Errorf("Loaded bundle differs from the written bundle")
+			}
+
+			if _, err = loaded.Compile(schema.ScopeCluster); err != nil {
+				t.Errorf("Error compiling loaded bundle: %v", err)
+			}
+		})
+	}
+}
+
+func TestRules(t *testing.T) {
+
+	b, raw := writeBundle(t, []byte(testdata.TestSuccessComplexRule2))
+
+	loaded, err := Load(bytes.NewReader(raw))
+	if err != nil {
+		t.Fatalf("Error loading bundle: %v", err)
+	}
+
+	r, ok := loaded.Rule(b.Tree.Nodes[0].Metadata.Address.GetRuleHash())
+	if !ok {
+		t.Fatalf("Expected the rule of the tree")
+	}
+
+	if r.Cre.Id != "TestSuccessComplexRule2" || r.Cre.Severity != 1 || r.Metadata.Id != "J7uRQTGpGMyL1iFpssnBeS" {
+		t.Errorf("Unexpected rule %+v", r)
+	}
+}
+
+func TestLoadFail(t *testing.T) {
+
+	_, raw := writeBundle(t, []byte(testdata.TestSuccessBind))
+
+	corrupt := func(fn func([]byte)) []byte {
+		data := bytes.Clone(raw)
+		fn(data)
+		return data
+	}
+
+	var tests = map[string]struct {
+		data []byte
+		err  error
+	}{
+		"Magic": {
+			data: corrupt(func(d []byte) { d[0] = 'X' }),
+			err:  ErrBundleMagic,
+		},
+		"Version": {
+			data: corrupt(func(d []byte) { binary.LittleEndian.PutUint16(d[4:], BundleVersion+1) }),
+			err:  ErrBundleVersion,
+		},
+		"AstVersion": {
+			data: corrupt(func(d []byte) { binary.LittleEndian.PutUint16(d[6:], 0) }),
+			err:  ErrBundleAstVersion,
+		},
+		"Checksum": {
+			data: corrupt(func(d []byte) { d[len(d)-1] ^= 0xff }),
+			err:  ErrBundleChecksum,
+		},
+		"Truncated": {
+			data: raw[:len(raw)-1],
+			err:  ErrBundleSize,
+		},
+		"Oversized": {
+			data: corrupt(func(d []byte) { binary.LittleEndian.PutUint64(d[8:], maxPayload) }),
+			err:  ErrBundleSize,
+		},
+		"Empty": {
+			data: nil,
+			err:  ErrBundleMagic,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := Load(bytes.NewReader(test.data)); !errors.Is(err, test.err) {
+				t.Errorf("Expected %v, got %v", test.err, err)
+			}
+		})
+	}
+}
@@ -13,6 +13,8 @@ var (
 	ErrExpectedReteMatcher = errors.New("expected rete matcher")
 	ErrExpectedJsonMatcher = errors.New("expected jq json matcher")
 	ErrExpectedLogMatcher  = errors.New("expected log matcher")
+	ErrExpectedMachine     = errors.New("expected state machine")
+	ErrExpectedDetection   = errors.New("expected detection matcher")
 	ErrExpectedCbDetect    = errors.New("expected detect callback")
 	ErrInvalidCbArgs       = errors.New("invalid callback arguments")
 	ErrNotFound            = errors.New("not found")
@@ -90,6 +92,32 @@ func GetLogSingleMatcher(obj *ObjT) (*lm.MatchSingle, error) {
 	return m, nil
 }
 
+func GetMachineMatcher(obj *ObjT) (*MachineMatcher, error) {
+	var (
+		m  *MachineMatcher
+		ok bool
+	)
+
+	if m, ok = obj.Object.(*MachineMatcher); !ok {
+		return nil, ErrExpectedMachine
+	}
+
+	return m, nil
+}
+
+func GetDetectionMatcher(obj *ObjT) (*DetectionMatcher, error) {
+	var (
+		m  *DetectionMatcher
+		ok bool
+	)
+
+	if m, ok = obj.Object.(*DetectionMatcher); !ok {
+		return nil, ErrExpectedDetection
+	}
+
+	return m, nil
+}
+
 // -----
 type NoopRuntime struct{}
 
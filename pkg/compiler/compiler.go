@@ -17,8 +17,10 @@ var (
 )
 
 var (
-	defaultPlugin  = &NodePlugin{}
-	defaultRuntime = &NoopRuntime{}
+	defaultPlugin        = &NodePlugin{}
+	defaultClusterPlugin = &ClusterPlugin{}
+	defaultOrgPlugin     = &OrganizationPlugin{}
+	defaultRuntime       = &NoopRuntime{}
 )
 
 type ObjsT []*ObjT
@@ -36,6 +38,7 @@ func (o ObjTypeT) String() string {
 
 type ObjT struct {
 	RuleId        string               `json:"rule_id"`
+	CreId         string               `json:"cre_id"`
 	Address       *ast.AstNodeAddressT `json:"address"`
 	ParentAddress *ast.AstNodeAddressT `json:"parent_address"`
 	Scope         string               `json:"scope"`
@@ -43,13 +46,18 @@ type ObjT struct {
 	ObjectType    ObjTypeT             `json:"object_type"`
 	Event         ast.AstEventT        `json:"event"`
 	Object        any                  `json:"object"`
+	Bindings      []string             `json:"bindings,omitempty"`     // Variables bound by the matcher
+	Correlations  []*CorrelationKeyT   `json:"correlations,omitempty"` // Correlation keys for the matcher's events
 	Cb            CallbackT            `json:"cb"`
+	Dependents    ObjsT                `json:"dependents,omitempty"` // Identical matchers sharing this object, see WithDedupe
 }
 
 type compilerOptsT struct {
 	debugTree string
 	runtime   RuntimeI
 	plugins   map[string]PluginI
+	sources   []string
+	dedupe    bool
 }
 
 type CompilerOptT func(*compilerOptsT)
@@ -75,9 +83,33 @@ func WithPlugin(scope string, plugin PluginI) CompilerOptT {
 	}
 }
 
+// WithSources sets the event sources known to the runtime. The source index
+// reports those that no compiled matcher consumes.
+func WithSources(sources ...string) CompilerOptT {
+	return func(o *compilerOptsT) {
+		o.sources = append(o.sources, sources...)
+	}
+}
+
+// WithDedupe compiles identical log matchers of different rules, e.g. the
+// same literal on the same source, into one object. Its callback fans the
+// matches out to the callbacks of the dependent objects. A term that several
+// different matchers of a source contain is evaluated once per event through
+// a gate that those matchers share, so the matchers of a source must scan
+// each event in turn from one goroutine.
+func WithDedupe() CompilerOptT {
+	return func(o *compilerOptsT) {
+		o.dedupe = true
+	}
+}
+
 func parseOpts(opts []CompilerOptT) compilerOptsT {
 	o := compilerOptsT{
-		plugins: map[string]PluginI{"node": defaultPlugin},
+		plugins: map[string]PluginI{
+			schema.ScopeNode:         defaultPlugin,
+			schema.ScopeCluster:      defaultClusterPlugin,
+			schema.ScopeOrganization: defaultOrgPlugin,
+		},
 		runtime: defaultRuntime,
 	}
 	for _, opt := range opts {
@@ -98,6 +130,7 @@ func traverseTree(node *ast.AstNodeT, scope string, callback func(node *ast.AstN
 func NewObj(node *ast.AstNodeT, objType ObjTypeT) *ObjT {
 	return &ObjT{
 		RuleId:        node.Metadata.RuleId,
+		CreId:         node.Metadata.CreId,
 		Address:       node.Metadata.Address,
 		ParentAddress: node.Metadata.ParentAddress,
 		Scope:         node.Metadata.Scope,
@@ -159,8 +192,13 @@ func compile(o compilerOptsT, tree *ast.AstT, scope string) (ObjsT, error) {
 	var (
 		err     error
 		outObjs ObjsT
+		dedupe  *dedupeT
 	)
 
+	if o.dedupe {
+		dedupe = newDedupe()
+	}
+
 	compile := func(node *ast.AstNodeT) error {
 
 		if node.Metadata.Scope != scope {
@@ -182,7 +220,18 @@ func compile(o compilerOptsT, tree *ast.AstT, scope string) (ObjsT, error) {
 			return err
 		}
 
-		outObjs = append(outObjs, objs...)
+		for _, obj := range objs {
+			if dedupe != nil {
+				keep, err := dedupe.add(node, obj)
+				if err != nil {
+					return err
+				}
+				if !keep {
+					continue
+				}
+			}
+			outObjs = append(outObjs, obj)
+		}
 
 		return nil
 	}
@@ -193,6 +242,13 @@ func compile(o compilerOptsT, tree *ast.AstT, scope string) (ObjsT, error) {
 		}
 	}
 
+	if dedupe != nil {
+		if err = dedupe.shareTerms(); err != nil {
+			return nil, err
+		}
+		dedupe.fanOut()
+	}
+
 	sortObjs(outObjs, schema.NodeTypeSeq)
 	sortObjs(outObjs, schema.NodeTypeSet)
 
@@ -226,3 +282,58 @@ func Compile(data []byte, scope string, opts ...CompilerOptT) (ObjsT, error) {
 
 	return compile(o, tree, scope)
 }
+
+// CompileIndex compiles the objects of a scope like Compile, and indexes
+// their matchers by event source.
+func CompileIndex(data []byte, scope string, opts ...CompilerOptT) (ObjsT, *SourceIndexT, error) {
+
+	tree, err := ast.Build(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return CompileAstIndex(tree, scope, opts...)
+}
+
+// CompileAstIndex compiles the objects of a scope like CompileAst, and
+// indexes their matchers by event source.
+func CompileAstIndex(tree *ast.AstT, scope string, opts ...CompilerOptT) (ObjsT, *SourceIndexT, error) {
+
+	var o = parseOpts(opts)
+
+	objs, err := CompileAst(tree, scope, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return objs, NewSourceIndex(tree, objs, o.sources...), nil
+}
+
+// CompilePrefilter compiles the objects of a scope like Compile, along with
+// the prefilter of their log matchers.
+func CompilePrefilter(data []byte, scope string, opts ...CompilerOptT) (ObjsT, *PrefilterT, error) {
+
+	tree, err := ast.Build(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return CompileAstPrefilter(tree, scope, opts...)
+}
+
+// CompileAstPrefilter compiles the objects of a scope like CompileAst, along
+// with the prefilter of their log matchers.
+func CompileAstPrefilter(tree *ast.AstT, scope string, opts ...CompilerOptT) (ObjsT, *PrefilterT, error) {
+
+	objs, err := CompileAst(tree, scope, opts...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	p, err := NewPrefilter(tree, objs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return objs, p, nil
+}
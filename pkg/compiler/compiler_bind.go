@@ -0,0 +1,416 @@
+package compiler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/itchyny/gojq"
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+)
+
+var (
+	ErrInvalidBinding = errors.New("invalid binding")
+)
+
+const (
+	// Separates the bound values in a partition key
+	bindKeySep = "\x00"
+)
+
+// bindFuncT extracts the variables bound by a term from a matching event
+// into vals. It returns false when a value cannot be extracted or differs
+// from a value already bound for the same event.
+type bindFuncT func(ev *bindEventT, vals map[string]string) bool
+
+// bindEventT decodes a JSON event at most once for the binders of a scan.
+type bindEventT struct {
+	line    string
+	value   any
+	err     error
+	decoded bool
+}
+
+func (e *bindEventT) json() (any, error) {
+	if !e.decoded {
+		e.err = json.Unmarshal([]byte(e.line), &e.value)
+		e.decoded = true
+	}
+	return e.value, e.err
+}
+
+// BindMatcher evaluates a log matcher whose terms bind variables, e.g. a
+// regex named capture (?P<host>\S+). Events are partitioned by the values of
+// the variables bound by more than one term, and every partition runs its
+// own copy of the logmatch object, so a sequence only advances on events
+// that agree on the values. Events that match terms binding none of these
+// variables are passed to every partition; events binding only some of them
+// cannot agree with any partition and are dropped. Matches made only of
+// shared events are dropped; a hit must bind the variables.
+//
+// Like ExcludeMatcher, the inner objects are compiled with one sentinel
+// token per term and scanned lines are prefixed with the matching tokens.
+type BindMatcher struct {
+	vars  []string
+	gates []gateT
+	parts *partitionsT
+	err   error
+}
+
+// newBindMatcher rewrites the match and reset terms to sentinel tokens in
+// place. build creates a logmatch object from the rewritten terms; it is
+// called once here to validate them and again for every new partition.
+func newBindMatcher(lm *ast.AstLogMatcherT, terms []match.TermT, resets []match.ResetT, shared *sharedTermsT, build func() (any, error)) (*BindMatcher, error) {
+
+	gates, err := newGates(lm, terms, resets, shared)
+	if err != nil {
+		return nil, err
+	}
+
+	var m = &BindMatcher{
+		vars:  sharedVars(lm),
+		gates: gates,
+		parts: newPartitions(buildMatcher(build), bindRetention(lm)),
+	}
+
+	if _, err := m.parts.build(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// sharedVars returns the sorted variables bound by more than one term of a
+// log matcher. Variables bound by a single term constrain nothing.
+func sharedVars(lm *ast.AstLogMatcherT) []string {
+
+	var (
+		counts = make(map[string]int)
+		vars   = make([]string, 0)
+	)
+
+	for _, field := range lm.Match {
+		for _, name := range fieldVars(field) {
+			counts[name]++
+		}
+	}
+
+	for _, field := range lm.Negate {
+		for _, name := range fieldVars(field) {
+			counts[name]++
+		}
+	}
+
+	for name, cnt := range counts {
+		if cnt > 1 {
+			vars = append(vars, name)
+		}
+	}
+
+	slices.Sort(vars)
+
+	return vars
+}
+
+func fieldVars(field ast.AstFieldT) []string {
+	var names []string
+	for _, b := range field.Bindings {
+		names = append(names, b.Name)
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+// bindRetention is how long a partition or a shared event can still take
+// part in a match: the matcher window plus the longest negate window.
+func bindRetention(lm *ast.AstLogMatcherT) int64 {
+
+	var opts []*ast.AstNegateOptsT
+
+	for _, field := range lm.Negate {
+		opts = append(opts, field.NegateOpts)
+	}
+
+	return retention(lm.Window, opts)
+}
+
+// retention is the window plus the longest negate window and slide.
+func retention(window time.Duration, opts []*ast.AstNegateOptsT) int64 {
+
+	var negate int64
+
+	for _, o := range opts {
+		if o == nil {
+			continue
+		}
+		slide := o.Slide.Nanoseconds()
+		if slide < 0 {
+			slide = -slide
+		}
+		negate = max(negate, o.Window.Nanoseconds()+slide)
+	}
+
+	return window.Nanoseconds() + negate
+}
+
+func (m *BindMatcher) Scan(e match.LogEntry) match.Hits {
+
+	var (
+		ev     = &bindEventT{line: e.Line}
+		shared strings.Builder
+		bound  = make(map[string]string)
+		keys   []string
+	)
+
+	for _, g := range m.gates {
+		if !g.matches(e.Line) {
+			continue
+		}
+
+		if len(g.binders) == 0 {
+			shared.WriteString(g.token)
+			continue
+		}
+
+		key, n, ok := g.bind(ev, m.vars)
+		switch {
+		case !ok:
+			continue
+		case n == len(m.vars):
+		case n == 0:
+			shared.WriteString(g.token)
+			continue
+		default:
+			// Partially bound; cannot agree with any partition
+			continue
+		}
+
+		if _, ok := bound[key]; !ok {
+			keys = append(keys, key)
+		}
+		bound[key] += g.token
+	}
+
+	hits, err := m.parts.scan(e, shared.String(), bound, keys)
+	if err != nil && m.err == nil {
+		m.err = err
+	}
+
+	return hits
+}
+
+// Err returns the first error of a scan, e.g. a partition that could not be
+// created. match.Matcher has no error result, so runtimes check it after
+// each scan.
+func (m *BindMatcher) Err() error {
+	return m.err
+}
+
+func (m *BindMatcher) Eval(clock int64) match.Hits {
+	return m.parts.eval(clock)
+}
+
+// GarbageCollect drops the partitions and shared events that are too old
+// to take part in a match.
+func (m *BindMatcher) GarbageCollect(clock int64) {
+	m.parts.gc(clock)
+}
+
+// Values returns the variables bound by the events of a hit, or false when
+// the events disagree on a value.
+func (m *BindMatcher) Values(logs []match.LogEntry) (map[string]string, bool) {
+
+	var vals = make(map[string]string, len(m.vars))
+
+	for _, e := range logs {
+		ev := &bindEventT{line: e.Line}
+		for _, g := range m.gates {
+			if len(g.binders) == 0 || !g.matches(e.Line) {
+				continue
+			}
+			for _, bind := range g.binders {
+				if !bind(ev, vals) {
+					return nil, false
+				}
+			}
+		}
+	}
+
+	return vals, true
+}
+
+// bind returns the partition key of an event matching the gate, made of the
+// bound values in vars order, and how many of vars the gate binds. It
+// returns false when a binding of the gate fails.
+func (g *gateT) bind(ev *bindEventT, vars []string) (string, int, bool) {
+
+	var vals = make(map[string]string, len(vars))
+
+	for _, bind := range g.binders {
+		if !bind(ev, vals) {
+			return "", 0, false
+		}
+	}
+
+	var values = make([]string, 0, len(vars))
+	for _, name := range vars {
+		if v, ok := vals[name]; ok {
+			values = append(values, v)
+		}
+	}
+
+	return strings.Join(values, bindKeySep), len(values), true
+}
+
+// newBinders compiles the bindings of a term: one binder for the named
+// captures of its regex and one per jq expression.
+func newBinders(field ast.AstFieldT) ([]bindFuncT, error) {
+
+	var (
+		binders  []bindFuncT
+		captures bool
+	)
+
+	for _, b := range field.Bindings {
+		if b.Jq == "" {
+			captures = true
+			continue
+		}
+		bind, err := jqBinder(b.Name, b.Jq)
+		if err != nil {
+			return nil, err
+		}
+		binders = append(binders, bind)
+	}
+
+	if captures {
+		bind, err := regexBinder(field)
+		if err != nil {
+			return nil, err
+		}
+		binders = append([]bindFuncT{bind}, binders...)
+	}
+
+	return binders, nil
+}
+
+// regexBinder binds the named captures of the term regex. A field scoped
+// term captures from the field value rather than the whole line.
+func regexBinder(field ast.AstFieldT) (bindFuncT, error) {
+
+	re, err := regexp.Compile(field.TermValue.Value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBinding, err)
+	}
+
+	var path *gojq.Code
+
+	if field.Field != "" {
+		query, err := jqPath(field.Field)
+		if err != nil {
+			return nil, err
+		}
+		if path, err = compileJq(query); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidBinding, err)
+		}
+	}
+
+	return func(ev *bindEventT, vals map[string]string) bool {
+
+		var s = ev.line
+
+		if path != nil {
+			v, ok := firstOutput(path, ev)
+			if !ok {
+				return false
+			}
+			s = bindString(v)
+		}
+
+		sub := re.FindStringSubmatch(s)
+		if sub == nil {
+			return false
+		}
+
+		for i, name := range re.SubexpNames() {
+			if name != "" && !bindVar(vals, name, sub[i]) {
+				return false
+			}
+		}
+
+		return true
+	}, nil
+}
+
+// jqBinder binds name to the first non-null output of a jq expression run
+// on the JSON event.
+func jqBinder(name, expr string) (bindFuncT, error) {
+
+	code, err := compileJq(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBinding, err)
+	}
+
+	return func(ev *bindEventT, vals map[string]string) bool {
+		v, ok := firstOutput(code, ev)
+		if !ok {
+			return false
+		}
+		return bindVar(vals, name, bindString(v))
+	}, nil
+}
+
+func compileJq(expr string) (*gojq.Code, error) {
+
+	query, err := gojq.Parse(expr)
+	if err != nil {
+		return nil, fmt.Errorf("%q: %w", expr, err)
+	}
+
+	return gojq.Compile(query)
+}
+
+func firstOutput(code *gojq.Code, ev *bindEventT) (any, bool) {
+
+	v, err := ev.json()
+	if err != nil {
+		return nil, false
+	}
+
+	iter := code.Run(v)
+	for {
+		res, ok := iter.Next()
+		if !ok {
+			return nil, false
+		}
+		if _, ok := res.(error); ok {
+			return nil, false
+		}
+		if res != nil {
+			return res, true
+		}
+	}
+}
+
+// bindString renders a bound value; non-string values are JSON encoded so
+// 1 and "1" bind differently.
+func bindString(v any) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
+
+func bindVar(vals map[string]string, name, value string) bool {
+	if prev, ok := vals[name]; ok && prev != value {
+		return false
+	}
+	vals[name] = value
+	return true
+}
@@ -0,0 +1,111 @@
+package compiler
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+
+	"github.com/itchyny/gojq"
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+)
+
+var (
+	ErrInvalidCorrelation = errors.New("invalid correlation key")
+)
+
+// CorrelationKeyT extracts the value of a correlation key from the events
+// of a log matcher, e.g. hostname from rabbitmq's host field.
+type CorrelationKeyT struct {
+	Name    string `json:"name"`
+	Field   string `json:"field,omitempty"`
+	Jq      string `json:"jq,omitempty"`
+	Regex   string `json:"regex,omitempty"`
+	extract func(line string) (string, bool)
+}
+
+// Extract returns the key value for an event, or false when the event does
+// not yield one.
+func (k *CorrelationKeyT) Extract(line string) (string, bool) {
+	return k.extract(line)
+}
+
+func newCorrelationKeys(keys []ast.AstCorrelationKeyT) ([]*CorrelationKeyT, error) {
+
+	var out = make([]*CorrelationKeyT, 0, len(keys))
+
+	for _, key := range keys {
+		k, err := newCorrelationKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: '%s': %w", ErrInvalidCorrelation, key.Name, err)
+		}
+		out = append(out, k)
+	}
+
+	return out, nil
+}
+
+func newCorrelationKey(key ast.AstCorrelationKeyT) (*CorrelationKeyT, error) {
+
+	var k = &CorrelationKeyT{
+		Name:  key.Name,
+		Field: key.Field,
+		Jq:    key.Jq,
+		Regex: key.Regex,
+	}
+
+	switch {
+	case key.Regex != "":
+		re, err := regexp.Compile(key.Regex)
+		if err != nil {
+			return nil, err
+		}
+
+		// The group named after the key, or the first group
+		group := re.SubexpIndex(key.Name)
+		if group < 0 {
+			group = 1
+		}
+		if group > re.NumSubexp() {
+			return nil, fmt.Errorf("regex %q has no capture group", key.Regex)
+		}
+
+		k.extract = func(line string) (string, bool) {
+			sub := re.FindStringSubmatch(line)
+			if sub == nil {
+				return "", false
+			}
+			return sub[group], true
+		}
+
+	case key.Field != "" || key.Jq != "":
+		query := key.Jq
+		if key.Field != "" {
+			var err error
+			if query, err = jqPath(key.Field); err != nil {
+				return nil, err
+			}
+		}
+
+		code, err := compileJq(query)
+		if err != nil {
+			return nil, err
+		}
+
+		k.extract = func(line string) (string, bool) {
+			return jqKey(code, line)
+		}
+
+	default:
+		return nil, errors.New("no field, jq or regex")
+	}
+
+	return k, nil
+}
+
+func jqKey(code *gojq.Code, line string) (string, bool) {
+	v, ok := firstOutput(code, &bindEventT{line: line})
+	if !ok {
+		return "", false
+	}
+	return bindString(v), true
+}
@@ -0,0 +1,278 @@
+package compiler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+)
+
+// dedupeKeyT identifies the log matchers that behave the same on every
+// event: same source, type, terms, window, bindings and correlation keys.
+// Positions and origins do not change what a matcher matches.
+type dedupeKeyT struct {
+	Source          string                   `json:"source"`
+	Type            schema.NodeTypeT         `json:"type"`
+	NegIdx          int                      `json:"neg_idx"`
+	Match           []ast.AstFieldT          `json:"match"`
+	Negate          []ast.AstFieldT          `json:"negate"`
+	Window          int64                    `json:"window"`
+	Bindings        []string                 `json:"bindings"`
+	CorrelationKeys []ast.AstCorrelationKeyT `json:"correlation_keys"`
+}
+
+// dedupeT shares one compiled object between the identical log matchers of
+// all the rules of a tree, and one gate between the terms that different
+// matchers have in common.
+type dedupeT struct {
+	shared   map[string]*ObjT
+	matchers []dedupeMatcherT // Kept log matchers, in compile order
+	terms    *sharedTermsT
+}
+
+type dedupeMatcherT struct {
+	node *ast.AstNodeT
+	lm   *ast.AstLogMatcherT
+	obj  *ObjT
+}
+
+// termKeyT identifies a term evaluated against the events of a source.
+type termKeyT struct {
+	Source string
+	Term   match.TermT
+}
+
+// sharedTermsT holds the gates of the terms used by more than one log
+// matcher.
+type sharedTermsT struct {
+	terms map[termKeyT]*sharedTermT
+}
+
+// sharedTermT evaluates a term once per event for every matcher that
+// consults it. The matchers of a source scan the same line in turn, so the
+// result of the last line is kept.
+type sharedTermT struct {
+	match match.MatchFunc
+	line  string
+	hit   bool
+	valid bool
+	evals int
+}
+
+func newDedupe() *dedupeT {
+	return &dedupeT{
+		shared: make(map[string]*ObjT),
+		terms: &sharedTermsT{
+			terms: make(map[termKeyT]*sharedTermT),
+		},
+	}
+}
+
+// add returns false when obj, compiled from node, is identical to an
+// object already compiled. obj is then a dependent of that object.
+func (d *dedupeT) add(node *ast.AstNodeT, obj *ObjT) (bool, error) {
+
+	lm, ok := node.Object.(*ast.AstLogMatcherT)
+	if !ok || obj.ObjectType != ObjTypeMatcher {
+		return true, nil
+	}
+
+	key, err := json.Marshal(dedupeKeyT{
+		Source:          lm.Event.Source,
+		Type:            node.Metadata.Type,
+		NegIdx:          node.Metadata.NegIdx,
+		Match:           withoutPos(lm.Match),
+		Negate:          withoutPos(lm.Negate),
+		Window:          lm.Window.Nanoseconds(),
+		Bindings:        lm.Bindings,
+		CorrelationKeys: lm.CorrelationKeys,
+	})
+	if err != nil {
+		return false, err
+	}
+
+	shared, ok := d.shared[string(key)]
+	if !ok {
+		d.shared[string(key)] = obj
+		d.matchers = append(d.matchers, dedupeMatcherT{node: node, lm: lm, obj: obj})
+		return true, nil
+	}
+
+	// The dependent only keeps the callback to its parent
+	obj.Object = nil
+	shared.Dependents = append(shared.Dependents, obj)
+
+	return false, nil
+}
+
+// fanOut makes the callback of each shared object deliver its results to
+// the callbacks of its dependents as well. Every callback is called, even
+// after one fails, and the errors are joined.
+func (d *dedupeT) fanOut() {
+
+	for _, obj := range d.shared {
+
+		if len(obj.Dependents) == 0 {
+			continue
+		}
+
+		var cbs = []CallbackT{obj.Cb}
+		for _, dep := range obj.Dependents {
+			cbs = append(cbs, dep.Cb)
+		}
+
+		obj.Cb = func(ctx context.Context, param any) error {
+			var errs []error
+			for _, cb := range cbs {
+				if err := cb(ctx, param); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			return errors.Join(errs...)
+		}
+	}
+}
+
+// shareTerms creates one gate for each term that more than one kept log
+// matcher of a source contains, and rebuilds the objects of those matchers
+// to consult it.
+func (d *dedupeT) shareTerms() error {
+
+	var (
+		counts = make(map[termKeyT]int)
+		keys   = make([][]termKeyT, len(d.matchers))
+	)
+
+	for i, m := range d.matchers {
+		if _, ok := m.obj.Object.(match.Matcher); !ok {
+			continue
+		}
+		k, err := termKeys(m.lm, m.node.Metadata.NegIdx)
+		if err != nil {
+			return err
+		}
+		for _, key := range k {
+			counts[key]++
+		}
+		keys[i] = k
+	}
+
+	for key, n := range counts {
+		if n < 2 {
+			continue
+		}
+		m, err := key.Term.NewMatcher()
+		if err != nil {
+			return err
+		}
+		d.terms.terms[key] = &sharedTermT{match: m}
+	}
+
+	for i, m := range d.matchers {
+
+		if !slices.ContainsFunc(keys[i], d.terms.has) {
+			continue
+		}
+
+		obj, err := logObject(m.node, m.lm, d.terms)
+		if err != nil {
+			return err
+		}
+		m.obj.Object = obj
+	}
+
+	return nil
+}
+
+// termKeys returns the distinct match, reset and exclude terms of a log
+// matcher.
+func termKeys(lm *ast.AstLogMatcherT, negIdx int) ([]termKeyT, error) {
+
+	var (
+		keys   []termKeyT
+		fields = lm.Match
+	)
+
+	if negIdx > 0 {
+		fields = append(slices.Clone(fields), lm.Negate...)
+	}
+
+	add := func(field ast.AstFieldT) error {
+		term, err := fieldTerm(field)
+		if err != nil {
+			return err
+		}
+		key := termKeyT{Source: lm.Event.Source, Term: term}
+		if !slices.Contains(keys, key) {
+			keys = append(keys, key)
+		}
+		return nil
+	}
+
+	for _, field := range fields {
+		if err := add(field); err != nil {
+			return nil, err
+		}
+		for _, ex := range field.Exclude {
+			if err := add(ex); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+func (s *sharedTermsT) has(key termKeyT) bool {
+	_, ok := s.terms[key]
+	return ok
+}
+
+// get returns the shared gate of a term, or nil when s is nil or the term
+// is not shared.
+func (s *sharedTermsT) get(source string, term match.TermT) *sharedTermT {
+	if s == nil {
+		return nil
+	}
+	return s.terms[termKeyT{Source: source, Term: term}]
+}
+
+func (t *sharedTermT) matches(line string) bool {
+	if !t.valid || t.line != line {
+		t.line = line
+		t.hit = t.match(line)
+		t.valid = true
+		t.evals++
+	}
+	return t.hit
+}
+
+func withoutPos(fields []ast.AstFieldT) []ast.AstFieldT {
+
+	if fields == nil {
+		return nil
+	}
+
+	var out = make([]ast.AstFieldT, 0, len(fields))
+
+	for _, f := range fields {
+		f.Pos = pqerr.Pos{}
+		f.Exclude = withoutPos(f.Exclude)
+		if f.Predicates != nil {
+			preds := make([]ast.AstPredicateT, 0, len(f.Predicates))
+			for _, p := range f.Predicates {
+				p.Pos = pqerr.Pos{}
+				preds = append(preds, p)
+			}
+			f.Predicates = preds
+		}
+		out = append(out, f)
+	}
+
+	return out
+}
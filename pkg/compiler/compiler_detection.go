@@ -0,0 +1,136 @@
+package compiler
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/rs/zerolog/log"
+)
+
+// DetectionT is a detection of a CRE reported by a cluster. Detections are
+// the input of organization scope rules.
+type DetectionT struct {
+	CreId     string            `json:"cre_id"`
+	Cluster   string            `json:"cluster"`
+	Timestamp int64             `json:"timestamp"`
+	Keys      map[string]string `json:"keys,omitempty"` // Correlation key values of the detection
+}
+
+// DetectionMatcher is the executable form of a detection term. It filters
+// the detections reported by the clusters of an organization and returns
+// the assert for its parent machine. When Clusters is above one, the term
+// only matches once detections with the same keys were reported by that
+// many distinct clusters within the window.
+type DetectionMatcher struct {
+	CreId    string `json:"cre_id"`
+	Cluster  string `json:"cluster,omitempty"`
+	Clusters int    `json:"clusters,omitempty"`
+	Window   int64  `json:"window"`
+	termIdx  uint32
+	seen     map[string]map[string]int64 // Keys, then cluster, then last detection
+}
+
+func ObjDetection(runtime RuntimeI, node *ast.AstNodeT) (*ObjT, error) {
+
+	var (
+		obj = NewObj(node, ObjTypeMatcher)
+		det *ast.AstDetectionT
+		ok  bool
+	)
+
+	if det, ok = node.Object.(*ast.AstDetectionT); !ok {
+		log.Error().Interface("detection", node.Object).Msg("Failed to compile detection")
+		return nil, ErrInvalidMatcher
+	}
+
+	termIdx, err := node.Metadata.Address.GetTermIdx()
+	if err != nil {
+		return nil, err
+	}
+
+	obj.Object = &DetectionMatcher{
+		CreId:    det.CreId,
+		Cluster:  det.Cluster,
+		Clusters: det.Clusters,
+		Window:   det.Window.Nanoseconds(),
+		termIdx:  termIdx,
+		seen:     make(map[string]map[string]int64),
+	}
+
+	obj.Cb = runtime.NewCbMatch(MatchParamsT{
+		Address:       node.Metadata.Address,
+		ParentAddress: node.Metadata.ParentAddress,
+		Origin:        true,
+	})
+
+	return obj, nil
+}
+
+// Detect returns the assert of the term for a detection, or false when the
+// detection does not match. Detections must be delivered in timestamp order.
+func (m *DetectionMatcher) Detect(d DetectionT) (AssertT, bool) {
+
+	if d.CreId != m.CreId || (m.Cluster != "" && d.Cluster != m.Cluster) {
+		return AssertT{}, false
+	}
+
+	var a = AssertT{
+		TermIdx:   m.termIdx,
+		Timestamp: d.Timestamp,
+		Keys:      d.Keys,
+		Clusters:  []string{d.Cluster},
+	}
+
+	if m.Clusters <= 1 {
+		return a, true
+	}
+
+	var group = detectionGroup(d.Keys)
+
+	clusters, ok := m.seen[group]
+	if !ok {
+		clusters = make(map[string]int64)
+		m.seen[group] = clusters
+	}
+
+	clusters[d.Cluster] = d.Timestamp
+	maps.DeleteFunc(clusters, func(_ string, ts int64) bool {
+		return ts < d.Timestamp-m.Window
+	})
+
+	if len(clusters) < m.Clusters {
+		return AssertT{}, false
+	}
+
+	// Start over so the next match needs as many new detections
+	delete(m.seen, group)
+	a.Clusters = slices.Sorted(maps.Keys(clusters))
+
+	return a, true
+}
+
+// GarbageCollect drops the detections that are outside the window.
+func (m *DetectionMatcher) GarbageCollect(clock int64) {
+	for group, clusters := range m.seen {
+		maps.DeleteFunc(clusters, func(_ string, ts int64) bool {
+			return ts < clock-m.Window
+		})
+		if len(clusters) == 0 {
+			delete(m.seen, group)
+		}
+	}
+}
+
+// detectionGroup joins the keys of a detection in name order.
+func detectionGroup(keys map[string]string) string {
+
+	var parts = make([]string, 0, len(keys)*2)
+
+	for _, name := range slices.Sorted(maps.Keys(keys)) {
+		parts = append(parts, name, keys[name])
+	}
+
+	return strings.Join(parts, bindKeySep)
+}
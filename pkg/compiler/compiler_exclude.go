@@ -0,0 +1,182 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+)
+
+const (
+	// Separates the gate tokens from the original line
+	excludeSep = "\x01"
+)
+
+// ExcludeMatcher evaluates every term of a log matcher together with its
+// 'exclude' terms against a single event. The wrapped logmatch object is
+// compiled with one sentinel token per term; each scanned line is prefixed
+// with the tokens of the terms that match without an exclusion before it is
+// passed on, and the prefix is stripped from the returned hits. With
+// WithDedupe, the matchers that have terms in common with other matchers
+// are gated the same way so the shared terms are evaluated once per event.
+type ExcludeMatcher struct {
+	inner match.Matcher
+	gates []gateT
+}
+
+type gateT struct {
+	token   string
+	match   match.MatchFunc
+	shared  *sharedTermT // Set when match is shared with other matchers
+	exclude []match.MatchFunc
+	binders []bindFuncT
+}
+
+func hasExclude(fields []ast.AstFieldT) bool {
+	for _, field := range fields {
+		if len(field.Exclude) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// newExcludeMatcher replaces the match and reset terms with sentinel tokens
+// in place. The caller builds the inner logmatch object from the rewritten
+// terms and sets it with wrap.
+func newExcludeMatcher(lm *ast.AstLogMatcherT, terms []match.TermT, resets []match.ResetT, shared *sharedTermsT) (*ExcludeMatcher, error) {
+
+	gates, err := newGates(lm, terms, resets, shared)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ExcludeMatcher{gates: gates}, nil
+}
+
+// newGates returns one gate per match and reset term, in that order, and
+// rewrites each term to the raw sentinel token of its gate. The terms found
+// in shared use the gate of the shared term.
+func newGates(lm *ast.AstLogMatcherT, terms []match.TermT, resets []match.ResetT, shared *sharedTermsT) ([]gateT, error) {
+
+	var gates []gateT
+
+	gate := func(field ast.AstFieldT, term *match.TermT) error {
+
+		var (
+			g = gateT{
+				token: fmt.Sprintf("\x00%d\x00", len(gates)),
+			}
+			err error
+		)
+
+		if g.shared = shared.get(lm.Event.Source, *term); g.shared != nil {
+			g.match = g.shared.matches
+		} else if g.match, err = term.NewMatcher(); err != nil {
+			return err
+		}
+
+		for _, ex := range field.Exclude {
+			exTerm, err := fieldTerm(ex)
+			if err != nil {
+				return err
+			}
+			if exShared := shared.get(lm.Event.Source, exTerm); exShared != nil {
+				g.exclude = append(g.exclude, exShared.matches)
+				continue
+			}
+			exMatch, err := exTerm.NewMatcher()
+			if err != nil {
+				return err
+			}
+			g.exclude = append(g.exclude, exMatch)
+		}
+
+		if g.binders, err = newBinders(field); err != nil {
+			return err
+		}
+
+		*term = match.TermT{Type: match.TermRaw, Value: g.token}
+		gates = append(gates, g)
+
+		return nil
+	}
+
+	for i := range terms {
+		if err := gate(lm.Match[i], &terms[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range resets {
+		if err := gate(lm.Negate[i], &resets[i].Term); err != nil {
+			return nil, err
+		}
+	}
+
+	return gates, nil
+}
+
+func (m *ExcludeMatcher) wrap(obj any) (any, error) {
+	inner, ok := obj.(match.Matcher)
+	if !ok {
+		return nil, ErrExpectedLogMatcher
+	}
+	m.inner = inner
+	return m, nil
+}
+
+func (m *ExcludeMatcher) Scan(e match.LogEntry) match.Hits {
+
+	var sb strings.Builder
+
+	for _, g := range m.gates {
+		if g.matches(e.Line) {
+			sb.WriteString(g.token)
+		}
+	}
+
+	sb.WriteString(excludeSep)
+	sb.WriteString(e.Line)
+	e.Line = sb.String()
+
+	return stripTokens(m.inner.Scan(e))
+}
+
+func (m *ExcludeMatcher) Eval(clock int64) match.Hits {
+	return stripTokens(m.inner.Eval(clock))
+}
+
+func (m *ExcludeMatcher) GarbageCollect(clock int64) {
+	m.inner.GarbageCollect(clock)
+}
+
+func (g *gateT) matches(line string) bool {
+	if !g.match(line) {
+		return false
+	}
+	for _, exclude := range g.exclude {
+		if exclude(line) {
+			return false
+		}
+	}
+	return true
+}
+
+// stripTokens restores the original lines on a copy of the hits; the logs may
+// share storage with the inner object.
+func stripTokens(hits match.Hits) match.Hits {
+	if len(hits.Logs) == 0 {
+		return hits
+	}
+	logs := make([]match.LogEntry, len(hits.Logs))
+	for i, e := range hits.Logs {
+		if _, line, ok := strings.Cut(e.Line, excludeSep); ok {
+			e.Line = line
+		}
+		logs[i] = e
+	}
+	hits.Logs = logs
+	return hits
+}
@@ -0,0 +1,170 @@
+package compiler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+)
+
+var (
+	ErrInvalidField = errors.New("invalid field")
+)
+
+var (
+	jqIdentRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// fieldTerm scopes a term to a field of a structured (JSON) event. The term
+// is rewritten as a jq query that extracts the field before applying the raw,
+// regex or jq match, so "field: reason, value: Killing" only matches events
+// whose reason contains Killing. Terms without a field are returned as is.
+func fieldTerm(field ast.AstFieldT) (match.TermT, error) {
+
+	if len(field.Predicates) > 0 {
+		return predicatesTerm(field.Predicates)
+	}
+
+	if field.Field == "" {
+		return field.TermValue, nil
+	}
+
+	query, err := fieldQuery(field.Field, field.TermValue)
+	if err != nil {
+		return match.TermT{}, err
+	}
+
+	return match.TermT{
+		Type:  match.TermJqJson,
+		Value: query,
+	}, nil
+}
+
+// predicatesTerm joins the predicates of a multi-field term into a single
+// jq conjunction so they are evaluated against the same event.
+func predicatesTerm(preds []ast.AstPredicateT) (match.TermT, error) {
+
+	var parts = make([]string, 0, len(preds))
+
+	for _, p := range preds {
+		query, err := fieldQuery(p.Field, p.TermValue)
+		if err != nil {
+			return match.TermT{}, pqerr.Wrap(p.Pos, "", "", "", err)
+		}
+		parts = append(parts, fmt.Sprintf("([%s] | any)", query))
+	}
+
+	return match.TermT{
+		Type:  match.TermJqJson,
+		Value: strings.Join(parts, " and "),
+	}, nil
+}
+
+// fieldQuery returns a jq query applying term to the named field.
+func fieldQuery(field string, term match.TermT) (string, error) {
+
+	path, err := jqPath(field)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case term.Value == "":
+		// A field without a value matches when the field is present
+		return fmt.Sprintf("%s != null", path), nil
+	case term.Type == match.TermRaw:
+		return fmt.Sprintf("%s | select(. != null) | tostring | contains(%s)", path, jqString(term.Value)), nil
+	case term.Type == match.TermRegex:
+		return fmt.Sprintf("%s | select(. != null) | tostring | test(%s)", path, jqString(term.Value)), nil
+	case term.Type == match.TermJqJson || term.Type == match.TermJqYaml:
+		return fmt.Sprintf("%s | (%s)", path, term.Value), nil
+	}
+
+	return "", fmt.Errorf("%w: unsupported term type %s", ErrInvalidField, term.Type)
+}
+
+// jqPath converts a dotted field name such as involvedObject.kind into a jq
+// path. Keys that are not jq identifiers are quoted, e.g. metadata.labels.app-name
+// becomes .metadata.labels["app-name"]. Fields starting with '.' are taken
+// as jq paths verbatim for keys that themselves contain dots.
+func jqPath(field string) (string, error) {
+
+	if strings.HasPrefix(field, ".") {
+		return field, nil
+	}
+
+	var sb strings.Builder
+
+	for _, key := range strings.Split(field, ".") {
+		switch {
+		case key == "":
+			return "", fmt.Errorf("%w: empty key in %q", ErrInvalidField, field)
+		case jqIdentRegex.MatchString(key):
+			sb.WriteString(".")
+			sb.WriteString(key)
+		default:
+			if sb.Len() == 0 {
+				sb.WriteString(".")
+			}
+			sb.WriteString("[")
+			sb.WriteString(jqString(key))
+			sb.WriteString("]")
+		}
+	}
+
+	return sb.String(), nil
+}
+
+// jqString quotes s as a jq string literal; JSON escaping is valid jq.
+func jqString(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// TermMatcher returns a function that matches a line against a single term
+// of a log matcher, honoring its field scope and exclusions. Counts and
+// bindings are not evaluated; it is meant to trace which term an event
+// matched, not to replace the compiled matcher.
+func TermMatcher(field ast.AstFieldT) (match.MatchFunc, error) {
+
+	term, err := fieldTerm(field)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := term.NewMatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	var excludes = make([]match.MatchFunc, 0, len(field.Exclude))
+
+	for _, ex := range field.Exclude {
+		exTerm, err := fieldTerm(ex)
+		if err != nil {
+			return nil, err
+		}
+		exMatch, err := exTerm.NewMatcher()
+		if err != nil {
+			return nil, err
+		}
+		excludes = append(excludes, exMatch)
+	}
+
+	return func(line string) bool {
+		if !m(line) {
+			return false
+		}
+		for _, ex := range excludes {
+			if ex(line) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
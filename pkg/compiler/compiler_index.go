@@ -0,0 +1,119 @@
+package compiler
+
+import (
+	"slices"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+)
+
+// SourceIndexT maps event sources to the matcher objects that consume them,
+// so a runtime only runs the matchers of the source of each event.
+// Matchers without an event source, such as detection matchers, are not
+// indexed.
+type SourceIndexT struct {
+	Sources  map[string]*SourceEntryT `json:"sources"`
+	Unused   []string                 `json:"unused,omitempty"` // Known sources that no matcher consumes
+	Objects  int                      `json:"objects"`          // Compiled objects
+	Matchers int                      `json:"matchers"`         // Indexed matcher objects
+}
+
+// SourceEntryT holds the matchers of one event source in compile order.
+type SourceEntryT struct {
+	Source   string         `json:"source"`
+	Matchers []*IndexedObjT `json:"matchers"`
+}
+
+// IndexedObjT is an indexed matcher and the addresses of its parent
+// machines, from the immediate parent to the root of the rule. With
+// WithDedupe, the matchers that share Obj are its dependents, each with the
+// parents of its own rule.
+type IndexedObjT struct {
+	Obj        *ObjT                  `json:"obj"`
+	Parents    []*ast.AstNodeAddressT `json:"parents"`
+	Dependents []*IndexedObjT         `json:"dependents,omitempty"`
+}
+
+// Lookup returns the matchers of an event source.
+func (idx *SourceIndexT) Lookup(source string) []*IndexedObjT {
+	if e, ok := idx.Sources[source]; ok {
+		return e.Matchers
+	}
+	return nil
+}
+
+// Counts returns the number of matchers of each event source.
+func (idx *SourceIndexT) Counts() map[string]int {
+	var counts = make(map[string]int, len(idx.Sources))
+	for src, e := range idx.Sources {
+		counts[src] = len(e.Matchers)
+	}
+	return counts
+}
+
+// NewSourceIndex indexes the matchers of objs compiled from tree by event
+// source. Known sources without matchers are reported as unused.
+func NewSourceIndex(tree *ast.AstT, objs ObjsT, sources ...string) *SourceIndexT {
+
+	var (
+		idx = &SourceIndexT{
+			Sources: make(map[string]*SourceEntryT),
+			Objects: len(objs),
+		}
+		parents = make(map[*ast.AstNodeAddressT][]*ast.AstNodeAddressT)
+	)
+
+	for _, node := range tree.Nodes {
+		indexParents(node, nil, parents)
+	}
+
+	for _, obj := range objs {
+
+		if obj.ObjectType != ObjTypeMatcher || obj.Event.Source == "" {
+			continue
+		}
+
+		e, ok := idx.Sources[obj.Event.Source]
+		if !ok {
+			e = &SourceEntryT{Source: obj.Event.Source}
+			idx.Sources[obj.Event.Source] = e
+		}
+
+		var indexed = &IndexedObjT{
+			Obj:     obj,
+			Parents: parents[obj.Address],
+		}
+
+		for _, dep := range obj.Dependents {
+			indexed.Dependents = append(indexed.Dependents, &IndexedObjT{
+				Obj:     dep,
+				Parents: parents[dep.Address],
+			})
+		}
+
+		e.Matchers = append(e.Matchers, indexed)
+		idx.Matchers++
+	}
+
+	for _, src := range sources {
+		if _, ok := idx.Sources[src]; !ok && !slices.Contains(idx.Unused, src) {
+			idx.Unused = append(idx.Unused, src)
+		}
+	}
+
+	slices.Sort(idx.Unused)
+
+	return idx
+}
+
+func indexParents(node *ast.AstNodeT, chain []*ast.AstNodeAddressT, parents map[*ast.AstNodeAddressT][]*ast.AstNodeAddressT) {
+
+	parents[node.Metadata.Address] = chain
+
+	var next = make([]*ast.AstNodeAddressT, 0, len(chain)+1)
+	next = append(next, node.Metadata.Address)
+	next = append(next, chain...)
+
+	for _, c := range node.Children {
+		indexParents(c, next, parents)
+	}
+}
@@ -16,19 +16,24 @@ var (
 	ErrNoFields             = errors.New("no fields")
 )
 
-func toLogResets(terms []ast.AstFieldT) []match.ResetT {
+func toLogResets(terms []ast.AstFieldT) ([]match.ResetT, error) {
 	resets := make([]match.ResetT, 0, len(terms))
 	for _, term := range terms {
 
+		value, err := fieldTerm(term)
+		if err != nil {
+			return nil, err
+		}
+
 		if term.NegateOpts == nil {
 			resets = append(resets, match.ResetT{
-				Term: term.TermValue,
+				Term: value,
 			})
 			continue
 		}
 
 		resets = append(resets, match.ResetT{
-			Term:     term.TermValue,
+			Term:     value,
 			Window:   term.NegateOpts.Window.Nanoseconds(),
 			Slide:    term.NegateOpts.Slide.Nanoseconds(),
 			Anchor:   uint8(term.NegateOpts.Anchor),
@@ -37,15 +42,19 @@ func toLogResets(terms []ast.AstFieldT) []match.ResetT {
 
 		log.Debug().Any("reset", resets[len(resets)-1]).Msg("Adding log resets")
 	}
-	return resets
+	return resets, nil
 }
 
-func toLogTerms(fields []ast.AstFieldT) []match.TermT {
+func toLogTerms(fields []ast.AstFieldT) ([]match.TermT, error) {
 	terms := make([]match.TermT, 0, len(fields))
 	for _, field := range fields {
-		terms = append(terms, field.TermValue)
+		term, err := fieldTerm(field)
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, term)
 	}
-	return terms
+	return terms, nil
 }
 
 func ObjLogMatcher(runtime RuntimeI, node *ast.AstNodeT) (*ObjT, error) {
@@ -63,6 +72,12 @@ func ObjLogMatcher(runtime RuntimeI, node *ast.AstNodeT) (*ObjT, error) {
 
 	obj.Event.Origin = lm.Event.Origin
 	obj.Event.Source = lm.Event.Source
+	obj.Bindings = lm.Bindings
+
+	if obj.Correlations, err = newCorrelationKeys(lm.CorrelationKeys); err != nil {
+		log.Error().Err(err).Msg("Failed to compile correlation keys")
+		return nil, err
+	}
 
 	params := MatchParamsT{
 		Address:       node.Metadata.Address,
@@ -72,83 +87,139 @@ func ObjLogMatcher(runtime RuntimeI, node *ast.AstNodeT) (*ObjT, error) {
 
 	obj.Cb = runtime.NewCbMatch(params)
 
+	if obj.Object, err = logObject(node, lm, nil); err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+// logObject creates the logmatch object of a log matcher node. The terms
+// found in shared are evaluated through their shared gates.
+func logObject(node *ast.AstNodeT, lm *ast.AstLogMatcherT, shared *sharedTermsT) (any, error) {
+
 	switch node.Metadata.Type {
 	case schema.NodeTypeLogSeq:
-		if obj.Object, err = makeLogSeqObjects(lm, node.Metadata.NegIdx); err != nil {
-			return nil, err
-		}
+		return makeLogSeqObjects(lm, node.Metadata.NegIdx, shared)
 
 	case schema.NodeTypeLogSet:
-
-		if obj.Object, err = makeLogSetObjects(lm, node.Metadata.NegIdx); err != nil {
-			return nil, err
-		}
-
-	default:
-		log.Error().Type("node_type", node.Metadata.Type).Msg("Unsupported node type")
-		return nil, ErrUnsupportedNodeType
+		return makeLogSetObjects(lm, node.Metadata.NegIdx, shared)
 	}
 
-	return obj, nil
+	log.Error().Type("node_type", node.Metadata.Type).Msg("Unsupported node type")
+	return nil, ErrUnsupportedNodeType
 }
 
-func makeLogSeqObjects(lm *ast.AstLogMatcherT, negIdx int) (any, error) {
+// makeLogObjects converts the terms of a log matcher and creates the logmatch
+// object with build. Terms with exclusions or bindings are rewritten to
+// sentinel tokens and the object is wrapped in an ExcludeMatcher or a
+// BindMatcher, which evaluates the original terms on each event. So are the
+// terms of a matcher that has shared terms.
+func makeLogObjects(lm *ast.AstLogMatcherT, negIdx int, shared *sharedTermsT, build func([]match.TermT, []match.ResetT) (any, error)) (any, error) {
 
 	var (
-		obj any
-		err error
+		terms  []match.TermT
+		resets []match.ResetT
+		err    error
 	)
 
+	if terms, err = toLogTerms(lm.Match); err != nil {
+		log.Error().Err(err).Msg("Failed to create match terms")
+		return nil, err
+	}
+
 	if negIdx > 0 {
-		log.Trace().Any("terms", toLogTerms(lm.Match)).Msg("Creating inverse match sequence")
-		if obj, err = match.NewInverseSeq(lm.Window.Nanoseconds(), toLogTerms(lm.Match), toLogResets(lm.Negate)); err != nil {
-			log.Error().Err(err).Msg("Failed to create inverse match sequence")
+		if resets, err = toLogResets(lm.Negate); err != nil {
+			log.Error().Err(err).Msg("Failed to create negate terms")
 			return nil, err
 		}
-	} else {
-		if len(lm.Match) == 1 {
-			log.Error().Msg("Sequence with single match (use set instead)")
-			return nil, ErrSequenceSingleMatch
-		} else {
-			log.Debug().Any("terms", toLogTerms(lm.Match)).Msg("Creating match sequence")
-			if obj, err = match.NewMatchSeq(lm.Window.Nanoseconds(), toLogTerms(lm.Match)...); err != nil {
-				log.Error().Err(err).Msg("Failed to create match sequence")
-				return nil, err
-			}
+	}
+
+	switch {
+	case len(lm.Bindings) > 0:
+		return newBindMatcher(lm, terms, resets, shared, func() (any, error) {
+			return build(terms, resets)
+		})
+
+	case hasExclude(lm.Match) || hasExclude(lm.Negate) || shared != nil:
+		exclude, err := newExcludeMatcher(lm, terms, resets, shared)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to create exclude terms")
+			return nil, err
+		}
+
+		obj, err := build(terms, resets)
+		if err != nil {
+			return nil, err
 		}
+
+		return exclude.wrap(obj)
 	}
 
-	return obj, nil
+	return build(terms, resets)
 }
 
-func makeLogSetObjects(lm *ast.AstLogMatcherT, negIdx int) (any, error) {
+func makeLogSeqObjects(lm *ast.AstLogMatcherT, negIdx int, shared *sharedTermsT) (any, error) {
+	return makeLogObjects(lm, negIdx, shared, func(terms []match.TermT, resets []match.ResetT) (any, error) {
 
-	var (
-		err error
-		obj any
-	)
+		var (
+			obj any
+			err error
+		)
 
-	if negIdx > 0 {
-		log.Debug().Any("terms", toLogTerms(lm.Match)).Msg("Creating inverse match set")
-		if obj, err = match.NewInverseSet(lm.Window.Nanoseconds(), toLogTerms(lm.Match), toLogResets(lm.Negate)); err != nil {
-			log.Error().Err(err).Msg("Failed to create inverse match set")
-			return nil, err
-		}
-	} else {
-		if len(lm.Match) == 1 {
-			log.Debug().Any("term", toLogTerms(lm.Match)[0]).Msg("Creating match single")
-			if obj, err = match.NewMatchSingle(toLogTerms(lm.Match)[0]); err != nil {
-				log.Error().Err(err).Msg("Failed to create match single")
+		if negIdx > 0 {
+			log.Trace().Any("terms", terms).Msg("Creating inverse match sequence")
+			if obj, err = match.NewInverseSeq(lm.Window.Nanoseconds(), terms, resets); err != nil {
+				log.Error().Err(err).Msg("Failed to create inverse match sequence")
 				return nil, err
 			}
 		} else {
-			log.Debug().Any("terms", toLogTerms(lm.Match)).Msg("Creating match set")
-			if obj, err = match.NewMatchSet(lm.Window.Nanoseconds(), toLogTerms(lm.Match)...); err != nil {
-				log.Error().Err(err).Msg("Failed to create match set")
+			if len(lm.Match) == 1 {
+				log.Error().Msg("Sequence with single match (use set instead)")
+				return nil, ErrSequenceSingleMatch
+			} else {
+				log.Debug().Any("terms", terms).Msg("Creating match sequence")
+				if obj, err = match.NewMatchSeq(lm.Window.Nanoseconds(), terms...); err != nil {
+					log.Error().Err(err).Msg("Failed to create match sequence")
+					return nil, err
+				}
+			}
+		}
+
+		return obj, nil
+	})
+}
+
+func makeLogSetObjects(lm *ast.AstLogMatcherT, negIdx int, shared *sharedTermsT) (any, error) {
+	return makeLogObjects(lm, negIdx, shared, func(terms []match.TermT, resets []match.ResetT) (any, error) {
+
+		var (
+			obj any
+			err error
+		)
+
+		if negIdx > 0 {
+			log.Debug().Any("terms", terms).Msg("Creating inverse match set")
+			if obj, err = match.NewInverseSet(lm.Window.Nanoseconds(), terms, resets); err != nil {
+				log.Error().Err(err).Msg("Failed to create inverse match set")
 				return nil, err
 			}
+		} else {
+			if len(lm.Match) == 1 {
+				log.Debug().Any("term", terms[0]).Msg("Creating match single")
+				if obj, err = match.NewMatchSingle(terms[0]); err != nil {
+					log.Error().Err(err).Msg("Failed to create match single")
+					return nil, err
+				}
+			} else {
+				log.Debug().Any("terms", terms).Msg("Creating match set")
+				if obj, err = match.NewMatchSet(lm.Window.Nanoseconds(), terms...); err != nil {
+					log.Error().Err(err).Msg("Failed to create match set")
+					return nil, err
+				}
+			}
 		}
-	}
 
-	return obj, nil
+		return obj, nil
+	})
 }
@@ -0,0 +1,260 @@
+package compiler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrInvalidTermIdx = errors.New("invalid term idx")
+	ErrMissingKey     = errors.New("assert missing correlation key")
+)
+
+// AssertT is a match of one of a machine's terms, delivered by the runtime
+// when the child node at TermIdx fires.
+type AssertT struct {
+	Id        uint64            `json:"id,omitempty"` // Set by the runtime to find the child match of a hit
+	TermIdx   uint32            `json:"term_idx"`
+	Timestamp int64             `json:"timestamp"`
+	Keys      map[string]string `json:"keys,omitempty"`     // Correlation key values and bound variables of the match
+	Clusters  []string          `json:"clusters,omitempty"` // Clusters that reported the detections of an organization scope match
+}
+
+// MachineHitT is a match of a state machine: one assert per positive term,
+// in term order.
+type MachineHitT struct {
+	Asserts []AssertT `json:"asserts"`
+}
+
+// MachineMatcher is the executable form of a machine_seq or machine_set
+// node. Child matches are asserted by term index and fed, as one sentinel
+// token per term, to a logmatch sequence or set built with the window and
+// negate options of the node. Asserts are partitioned by correlation key
+// values so only matches on the same key advance together; variables bound
+// by several children partition them further.
+type MachineMatcher struct {
+	Correlations []string `json:"correlations"`
+	Bindings     []string `json:"bindings"`
+	Terms        int      `json:"terms"` // Positive terms followed by negate terms
+	build        func() (match.Matcher, error)
+	retention    int64
+	groups       map[string]*partitionsT
+}
+
+func machineToken(termIdx int) string {
+	return fmt.Sprintf("\x00%d\x00", termIdx)
+}
+
+func ObjMachine(runtime RuntimeI, node *ast.AstNodeT) (*ObjT, error) {
+
+	var (
+		obj    = NewObj(node, ObjTypeAssert)
+		m      = &MachineMatcher{groups: make(map[string]*partitionsT)}
+		order  []*ast.AstMetadataT
+		negate []*ast.AstMetadataT
+		window time.Duration
+		seq    bool
+	)
+
+	switch sm := node.Object.(type) {
+	case *ast.AstSeqMatcherT:
+		order, negate, window, seq = sm.Order, sm.Negate, sm.Window, true
+		m.Correlations, m.Bindings = sm.Correlations, sm.Bindings
+	case *ast.AstSetMatcherT:
+		order, negate, window = sm.Match, sm.Negate, sm.Window
+		m.Correlations, m.Bindings = sm.Correlations, sm.Bindings
+	default:
+		log.Error().Interface("machine", node.Object).Msg("Failed to compile state machine")
+		return nil, ErrInvalidMatcher
+	}
+
+	var (
+		terms  = make([]match.TermT, 0, len(order))
+		resets = make([]match.ResetT, 0, len(negate))
+		opts   []*ast.AstNegateOptsT
+	)
+
+	for _, md := range order {
+		idx, err := md.Address.GetTermIdx()
+		if err != nil {
+			return nil, err
+		}
+		terms = append(terms, match.TermT{Type: match.TermRaw, Value: machineToken(int(idx))})
+	}
+
+	for _, md := range negate {
+		idx, err := md.Address.GetTermIdx()
+		if err != nil {
+			return nil, err
+		}
+
+		reset := match.ResetT{
+			Term: match.TermT{Type: match.TermRaw, Value: machineToken(int(idx))},
+		}
+
+		if o := md.NegateOpts; o != nil {
+			reset.Window = o.Window.Nanoseconds()
+			reset.Slide = o.Slide.Nanoseconds()
+			reset.Anchor = uint8(o.Anchor)
+			reset.Absolute = o.Absolute
+		}
+
+		resets = append(resets, reset)
+		opts = append(opts, md.NegateOpts)
+	}
+
+	m.Terms = len(terms) + len(resets)
+	m.retention = retention(window, opts)
+	m.build = buildMatcher(func() (any, error) {
+		return newMachineObject(seq, window.Nanoseconds(), terms, resets)
+	})
+
+	// Validate the terms before the first assert
+	if _, err := m.build(); err != nil {
+		log.Error().Err(err).Msg("Failed to create state machine")
+		return nil, err
+	}
+
+	obj.Object = m
+	obj.Cb = runtime.NewCbAssert(AssertParamsT{
+		Address: node.Metadata.Address,
+	})
+
+	return obj, nil
+}
+
+func newMachineObject(seq bool, window int64, terms []match.TermT, resets []match.ResetT) (any, error) {
+
+	switch {
+	case len(resets) > 0 && seq:
+		return match.NewInverseSeq(window, terms, resets)
+	case len(resets) > 0:
+		return match.NewInverseSet(window, terms, resets)
+	case len(terms) == 1:
+		// Rules over a single log matcher fire on every match
+		return match.NewMatchSingle(terms[0])
+	case seq:
+		return match.NewMatchSeq(window, terms...)
+	}
+
+	return match.NewMatchSet(window, terms...)
+}
+
+// Assert delivers a child match and returns the machine matches it
+// completes. Asserts must be delivered in timestamp order.
+func (m *MachineMatcher) Assert(a AssertT) ([]MachineHitT, error) {
+
+	if int(a.TermIdx) >= m.Terms {
+		return nil, fmt.Errorf("%w: %d", ErrInvalidTermIdx, a.TermIdx)
+	}
+
+	group, n := joinKeys(m.Correlations, a.Keys)
+	if n != len(m.Correlations) {
+		return nil, fmt.Errorf("%w: %s", ErrMissingKey, strings.Join(m.Correlations, ", "))
+	}
+
+	var (
+		token  = machineToken(int(a.TermIdx))
+		shared string
+		bound  map[string]string
+		keys   []string
+	)
+
+	switch key, n := joinKeys(m.Bindings, a.Keys); {
+	case n == len(m.Bindings):
+		bound = map[string]string{key: token}
+		keys = []string{key}
+	case n == 0:
+		shared = token
+	default:
+		// Partially bound; cannot agree with any partition
+		log.Debug().Uint32("term_idx", a.TermIdx).Msg("Dropping partially bound assert")
+		return nil, nil
+	}
+
+	payload, err := json.Marshal(a)
+	if err != nil {
+		return nil, err
+	}
+
+	ps, ok := m.groups[group]
+	if !ok {
+		ps = newPartitions(m.build, m.retention)
+		m.groups[group] = ps
+	}
+
+	hits, err := ps.scan(match.LogEntry{Timestamp: a.Timestamp, Line: string(payload)}, shared, bound, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	return machineHits(hits)
+}
+
+// Eval returns the matches completed by the passage of time, e.g. when a
+// negate window closes.
+func (m *MachineMatcher) Eval(clock int64) ([]MachineHitT, error) {
+
+	var hits match.Hits
+
+	for _, key := range slices.Sorted(maps.Keys(m.groups)) {
+		h := m.groups[key].eval(clock)
+		hits.Cnt += h.Cnt
+		hits.Logs = append(hits.Logs, h.Logs...)
+	}
+
+	return machineHits(hits)
+}
+
+// GarbageCollect drops the state of keys that can no longer match.
+func (m *MachineMatcher) GarbageCollect(clock int64) {
+	for key, ps := range m.groups {
+		ps.gc(clock)
+		if ps.empty() {
+			delete(m.groups, key)
+		}
+	}
+}
+
+// joinKeys joins the values of names found in keys and returns the number
+// of names found.
+func joinKeys(names []string, keys map[string]string) (string, int) {
+
+	var values = make([]string, 0, len(names))
+
+	for _, name := range names {
+		if v, ok := keys[name]; ok {
+			values = append(values, v)
+		}
+	}
+
+	return strings.Join(values, bindKeySep), len(values)
+}
+
+func machineHits(hits match.Hits) ([]MachineHitT, error) {
+
+	var out = make([]MachineHitT, 0, hits.Cnt)
+
+	for i := range hits.Cnt {
+		var hit MachineHitT
+		for _, e := range hits.Index(i) {
+			var a AssertT
+			if err := json.Unmarshal([]byte(e.Line), &a); err != nil {
+				return nil, err
+			}
+			hit.Asserts = append(hit.Asserts, a)
+		}
+		out = append(out, hit)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,171 @@
+package compiler
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+)
+
+const (
+	// Marks the token prefix of an event delivered to its own partition
+	boundMark = "\x02"
+)
+
+// partitionsT runs one copy of a logmatch object per partition key. Bound
+// events go to the partition of their key; shared events go to every
+// partition and are replayed into partitions created later. Matches made
+// only of shared events are dropped.
+//
+// Events are passed to the objects as sentinel tokens followed by
+// excludeSep and the original line.
+type partitionsT struct {
+	build     func() (match.Matcher, error)
+	retention int64
+	parts     []*partitionT
+	keys      map[string]*partitionT
+	shared    []match.LogEntry
+}
+
+type partitionT struct {
+	key   string
+	inner match.Matcher
+	last  int64
+}
+
+func newPartitions(build func() (match.Matcher, error), retention int64) *partitionsT {
+	return &partitionsT{
+		build:     build,
+		retention: retention,
+		keys:      make(map[string]*partitionT),
+	}
+}
+
+// scan delivers an event with the shared tokens to every partition and the
+// bound tokens to the partition of each key, creating partitions in keys
+// order as needed. It fails when a partition cannot be created; the event
+// is then not delivered.
+func (ps *partitionsT) scan(e match.LogEntry, shared string, bound map[string]string, keys []string) (match.Hits, error) {
+
+	var hits match.Hits
+
+	for _, key := range keys {
+		if _, ok := ps.keys[key]; !ok {
+			if err := ps.add(key); err != nil {
+				return hits, err
+			}
+		}
+	}
+
+	for _, p := range ps.parts {
+		// Partitions without tokens still scan the event to see the clock advance
+		tokens, ok := bound[p.key]
+		if ok {
+			tokens = boundMark + tokens
+			p.last = e.Timestamp
+		}
+
+		pe := e
+		pe.Line = shared + tokens + excludeSep + e.Line
+		appendBound(&hits, p.inner.Scan(pe))
+	}
+
+	if shared != "" {
+		se := e
+		se.Line = shared + excludeSep + e.Line
+		ps.shared = append(ps.shared, se)
+	}
+
+	return stripTokens(hits), nil
+}
+
+func (ps *partitionsT) eval(clock int64) match.Hits {
+
+	var hits match.Hits
+
+	for _, p := range ps.parts {
+		appendBound(&hits, p.inner.Eval(clock))
+	}
+
+	return stripTokens(hits)
+}
+
+// gc drops the partitions and shared events that are too old to take part
+// in a match.
+func (ps *partitionsT) gc(clock int64) {
+
+	var deadline = clock - ps.retention
+
+	ps.parts = slices.DeleteFunc(ps.parts, func(p *partitionT) bool {
+		if p.last < deadline {
+			delete(ps.keys, p.key)
+			return true
+		}
+		p.inner.GarbageCollect(clock)
+		return false
+	})
+
+	var n int
+	for n < len(ps.shared) && ps.shared[n].Timestamp < deadline {
+		n++
+	}
+	ps.shared = slices.Delete(ps.shared, 0, n)
+}
+
+func (ps *partitionsT) empty() bool {
+	return len(ps.parts) == 0 && len(ps.shared) == 0
+}
+
+func (ps *partitionsT) add(key string) error {
+
+	inner, err := ps.build()
+	if err != nil {
+		return err
+	}
+
+	var p = &partitionT{
+		key:   key,
+		inner: inner,
+	}
+
+	// Shared events predate the partition; their matches lack the key
+	for _, e := range ps.shared {
+		p.inner.Scan(e)
+	}
+
+	ps.parts = append(ps.parts, p)
+	ps.keys[key] = p
+
+	return nil
+}
+
+// appendBound adds the matches that include at least one bound event.
+func appendBound(hits *match.Hits, h match.Hits) {
+	for i := range h.Cnt {
+		logs := h.Index(i)
+		if slices.ContainsFunc(logs, isBound) {
+			hits.Cnt++
+			hits.Logs = append(hits.Logs, logs...)
+		}
+	}
+}
+
+func isBound(e match.LogEntry) bool {
+	tokens, _, _ := strings.Cut(e.Line, excludeSep)
+	return strings.Contains(tokens, boundMark)
+}
+
+// buildMatcher adapts a logmatch object constructor for partitionsT.
+func buildMatcher(build func() (any, error)) func() (match.Matcher, error) {
+	return func() (match.Matcher, error) {
+		obj, err := build()
+		if err != nil {
+			return nil, err
+		}
+		m, ok := obj.(match.Matcher)
+		if !ok {
+			return nil, ErrExpectedLogMatcher
+		}
+		return m, nil
+	}
+}
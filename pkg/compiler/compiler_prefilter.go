@@ -0,0 +1,284 @@
+package compiler
+
+import (
+	"regexp/syntax"
+	"unicode/utf8"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+)
+
+// PrefilterT selects the log matchers worth scanning for an event. Each
+// source has one automaton over the literals that the terms of its matchers
+// require, so a line only goes to the matchers whose literals it contains.
+type PrefilterT struct {
+	Sources map[string]*SourceFilterT `json:"sources"`
+}
+
+// SourceFilterT is the prefilter of one event source. Matchers with a term
+// without a required literal, e.g. a jq or case-insensitive regex term, are
+// scanned for every line.
+type SourceFilterT struct {
+	Source   string   `json:"source"`
+	Literals []string `json:"literals"`
+	Matchers ObjsT    `json:"-"` // In compile order
+	always   []bool
+	deps     [][]int // Matchers of each literal
+	ac       *acT
+}
+
+// NewPrefilter builds the prefilter of the log matchers of objs compiled
+// from tree.
+func NewPrefilter(tree *ast.AstT, objs ObjsT) (*PrefilterT, error) {
+
+	var (
+		p = &PrefilterT{
+			Sources: make(map[string]*SourceFilterT),
+		}
+		nodes = make(map[*ast.AstNodeAddressT]*ast.AstNodeT)
+		ids   = make(map[string]map[string]int)
+	)
+
+	for _, node := range tree.Nodes {
+		indexNodes(node, nodes)
+	}
+
+	for _, obj := range objs {
+
+		node, ok := nodes[obj.Address]
+		if !ok || obj.ObjectType != ObjTypeMatcher {
+			continue
+		}
+
+		lm, ok := node.Object.(*ast.AstLogMatcherT)
+		if !ok {
+			continue
+		}
+
+		literals, err := requiredLiterals(lm)
+		if err != nil {
+			return nil, err
+		}
+
+		f, ok := p.Sources[obj.Event.Source]
+		if !ok {
+			f = &SourceFilterT{Source: obj.Event.Source}
+			p.Sources[obj.Event.Source] = f
+			ids[obj.Event.Source] = make(map[string]int)
+		}
+
+		var idx = len(f.Matchers)
+
+		f.Matchers = append(f.Matchers, obj)
+		f.always = append(f.always, literals == nil)
+
+		for _, lit := range literals {
+			id, ok := ids[obj.Event.Source][lit]
+			if !ok {
+				id = len(f.Literals)
+				ids[obj.Event.Source][lit] = id
+				f.Literals = append(f.Literals, lit)
+				f.deps = append(f.deps, nil)
+			}
+			f.deps[id] = append(f.deps[id], idx)
+		}
+	}
+
+	for _, f := range p.Sources {
+		f.ac = newAc(f.Literals)
+	}
+
+	return p, nil
+}
+
+// Candidates returns the matchers of source to scan for line, in compile
+// order.
+func (p *PrefilterT) Candidates(source, line string) ObjsT {
+
+	f, ok := p.Sources[source]
+	if !ok {
+		return nil
+	}
+
+	var hit = make([]bool, len(f.Matchers))
+
+	copy(hit, f.always)
+
+	f.ac.scan(line, func(id int) {
+		for _, i := range f.deps[id] {
+			hit[i] = true
+		}
+	})
+
+	var out ObjsT
+	for i, obj := range f.Matchers {
+		if hit[i] {
+			out = append(out, obj)
+		}
+	}
+
+	return out
+}
+
+func indexNodes(node *ast.AstNodeT, nodes map[*ast.AstNodeAddressT]*ast.AstNodeT) {
+	nodes[node.Metadata.Address] = node
+	for _, c := range node.Children {
+		indexNodes(c, nodes)
+	}
+}
+
+// requiredLiterals returns one literal per term of a log matcher, match and
+// negate terms alike, such that no term matches a line without its literal.
+// It returns nil when a term has no such literal.
+func requiredLiterals(lm *ast.AstLogMatcherT) ([]string, error) {
+
+	var (
+		fields   = append(append([]ast.AstFieldT{}, lm.Match...), lm.Negate...)
+		literals = make([]string, 0, len(fields))
+	)
+
+	for _, field := range fields {
+
+		term, err := fieldTerm(field)
+		if err != nil {
+			return nil, err
+		}
+
+		var lit string
+
+		switch term.Type {
+		case match.TermRaw:
+			lit = term.Value
+		case match.TermRegex:
+			re, err := syntax.Parse(term.Value, syntax.Perl)
+			if err != nil {
+				return nil, err
+			}
+			lit = regexLiteral(re.Simplify())
+		}
+
+		if lit == "" {
+			return nil, nil
+		}
+
+		literals = append(literals, lit)
+	}
+
+	return literals, nil
+}
+
+// regexLiteral returns the longest literal that every match of re contains,
+// or an empty string.
+func regexLiteral(re *syntax.Regexp) string {
+
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return ""
+		}
+		return string(re.Rune)
+
+	case syntax.OpCapture, syntax.OpPlus:
+		return regexLiteral(re.Sub[0])
+
+	case syntax.OpRepeat:
+		if re.Min > 0 {
+			return regexLiteral(re.Sub[0])
+		}
+
+	case syntax.OpConcat:
+		var longest string
+		for _, sub := range re.Sub {
+			if lit := regexLiteral(sub); utf8.RuneCountInString(lit) > utf8.RuneCountInString(longest) {
+				longest = lit
+			}
+		}
+		return longest
+	}
+
+	return ""
+}
+
+// acT is an Aho-Corasick automaton over bytes.
+type acT struct {
+	next []map[byte]int32
+	fail []int32
+	out  [][]int // Literals ending at each state, including by fail links
+}
+
+func newAc(literals []string) *acT {
+
+	var a = &acT{
+		next: []map[byte]int32{{}},
+		fail: []int32{0},
+		out:  [][]int{nil},
+	}
+
+	for id, lit := range literals {
+		var s int32
+		for i := 0; i < len(lit); i++ {
+			n, ok := a.next[s][lit[i]]
+			if !ok {
+				n = int32(len(a.next))
+				a.next = append(a.next, map[byte]int32{})
+				a.fail = append(a.fail, 0)
+				a.out = append(a.out, nil)
+				a.next[s][lit[i]] = n
+			}
+			s = n
+		}
+		a.out[s] = append(a.out[s], id)
+	}
+
+	// Breadth first, so the fail state of a state is complete before it
+	var queue []int32
+	for _, n := range a.next[0] {
+		queue = append(queue, n)
+	}
+
+	for len(queue) > 0 {
+		s := queue[0]
+		queue = queue[1:]
+
+		for b, n := range a.next[s] {
+			f := a.fail[s]
+			for {
+				if t, ok := a.next[f][b]; ok {
+					a.fail[n] = t
+					break
+				}
+				if f == 0 {
+					break
+				}
+				f = a.fail[f]
+			}
+			a.out[n] = append(a.out[n], a.out[a.fail[n]]...)
+			queue = append(queue, n)
+		}
+	}
+
+	return a
+}
+
+// scan calls fn with the id of each literal occurring in line, once per
+// occurrence.
+func (a *acT) scan(line string, fn func(id int)) {
+
+	var s int32
+
+	for i := 0; i < len(line); i++ {
+		for {
+			if n, ok := a.next[s][line[i]]; ok {
+				s = n
+				break
+			}
+			if s == 0 {
+				break
+			}
+			s = a.fail[s]
+		}
+		for _, id := range a.out[s] {
+			fn(id)
+		}
+	}
+}
@@ -0,0 +1,834 @@
+package compiler
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp/syntax"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/prequel-dev/prequel-compiler/pkg/testdata"
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+)
+
+func TestJqPath(t *testing.T) {
+
+	var tests = map[string]string{
+		"reason":                   `.reason`,
+		"involvedObject.kind":      `.involvedObject.kind`,
+		"metadata.labels.app-name": `.metadata.labels["app-name"]`,
+		"app.kubernetes.io/name":   `.app.kubernetes["io/name"]`,
+		"1st":                      `.["1st"]`,
+		`.labels["a.b"]`:           `.labels["a.b"]`,
+	}
+
+	for field, expected := range tests {
+		path, err := jqPath(field)
+		if err != nil {
+			t.Errorf("Field %s: unexpected error %v", field, err)
+			continue
+		}
+		if path != expected {
+			t.Errorf("Field %s: expected %s, got %s", field, expected, path)
+		}
+	}
+
+	if _, err := jqPath("a..b"); err == nil {
+		t.Errorf("Expected error on empty key")
+	}
+}
+
+func TestFieldScoped(t *testing.T) {
+
+	objs, err := Compile([]byte(testdata.TestFieldScoped), "node")
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	if len(objs) != 1 {
+		t.Fatalf("Expected 1 object, got %d", len(objs))
+	}
+
+	var fields = []ast.AstFieldT{
+		{Field: "reason", TermValue: match.TermT{Type: match.TermRaw, Value: "Killing"}},
+		{Field: "involvedObject.kind", TermValue: match.TermT{Type: match.TermRegex, Value: "^Pod$"}},
+		{Field: "metadata.labels.app-name", TermValue: match.TermT{Type: match.TermJqJson, Value: `. == "kafka"`}},
+		{Field: "metadata.uid"},
+	}
+
+	var lines = []struct {
+		line string
+		hits []bool
+	}{
+		// Killing and Pod appear, but not in the scoped fields
+		{line: `{"reason":"Started","message":"Killing Pod","involvedObject":{"kind":"PodDisruptionBudget"},"metadata":{"labels":{"app-name":"zookeeper"}}}`, hits: []bool{false, false, false, false}},
+		{line: `{"reason":"Killing","involvedObject":{"kind":"Pod"},"metadata":{"uid":"1234","labels":{"app-name":"kafka"}}}`, hits: []bool{true, true, true, true}},
+		{line: `Killing Pod kafka`, hits: []bool{false, false, false, false}},
+	}
+
+	for i, field := range fields {
+		term, err := fieldTerm(field)
+		if err != nil {
+			t.Fatalf("Field %s: unexpected error %v", field.Field, err)
+		}
+
+		m, err := term.NewMatcher()
+		if err != nil {
+			t.Fatalf("Field %s: error compiling term %s: %v", field.Field, term.Value, err)
+		}
+
+		for j, l := range lines {
+			if hit := m(l.line); hit != l.hits[i] {
+				t.Errorf("Field %s, line %d: expected hit=%v, got %v", field.Field, j, l.hits[i], hit)
+			}
+		}
+	}
+}
+
+func TestMultiField(t *testing.T) {
+
+	objs, err := Compile([]byte(testdata.TestSuccessMultiField), "node")
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	if len(objs) != 1 {
+		t.Fatalf("Expected 1 object, got %d", len(objs))
+	}
+
+	matcher, ok := objs[0].Object.(match.Matcher)
+	if !ok {
+		t.Fatalf("Expected matcher, got %T", objs[0].Object)
+	}
+
+	var lines = []struct {
+		line string
+		hit  bool
+	}{
+		{line: `{"reason":"Killing","involvedObject":{"namespace":"zookeeper","uid":"1234"}}`},
+		{line: `{"reason":"Started","involvedObject":{"namespace":"kafka","uid":"1234"}}`},
+		{line: `{"reason":"Killing","involvedObject":{"namespace":"kafka"}}`},
+		{line: `{"reason":"Killing","involvedObject":{"namespace":"kafka","uid":"1234"}}`, hit: true},
+	}
+
+	for i, l := range lines {
+		hits := matcher.Scan(match.LogEntry{Line: l.line, Timestamp: int64(i + 1)})
+		if (hits.Cnt > 0) != l.hit {
+			t.Errorf("Line %d: expected hit=%v, got %d hits", i, l.hit, hits.Cnt)
+		}
+	}
+
+	_, err = fieldTerm(ast.AstFieldT{Predicates: []ast.AstPredicateT{{Field: "a..b", Pos: pqerr.Pos{Line: 3, Col: 7}}}})
+	if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 3 {
+		t.Errorf("Expected error at predicate line 3, got %v", err)
+	}
+}
+
+func TestExclude(t *testing.T) {
+
+	objs, err := Compile([]byte(testdata.TestSuccessExclude), "node")
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	if len(objs) != 1 {
+		t.Fatalf("Expected 1 object, got %d", len(objs))
+	}
+
+	matcher, ok := objs[0].Object.(*ExcludeMatcher)
+	if !ok {
+		t.Fatalf("Expected exclude matcher, got %T", objs[0].Object)
+	}
+
+	var lines = []struct {
+		line string
+		hit  bool
+	}{
+		{line: "Connection refused from healthcheck"},
+		{line: "Connection refused by 127.0.0.1:9092"},
+		{line: "Broker 3 shutting down (controlled shutdown)"},
+		{line: "Broker 3 shutting down"},
+		{line: "Connection refused by 10.0.0.7:9092", hit: true},
+	}
+
+	for i, l := range lines {
+		hits := matcher.Scan(match.LogEntry{Line: l.line, Timestamp: int64(i + 1)})
+		if (hits.Cnt > 0) != l.hit {
+			t.Errorf("Line %d: expected hit=%v, got %d hits", i, l.hit, hits.Cnt)
+		}
+		for _, e := range hits.Logs {
+			if e.Line != lines[3].line && e.Line != lines[4].line {
+				t.Errorf("Line %d: unexpected hit log %q", i, e.Line)
+			}
+		}
+	}
+}
+
+func TestBind(t *testing.T) {
+
+	objs, err := Compile([]byte(testdata.TestSuccessBind), "node")
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	if len(objs) != 1 {
+		t.Fatalf("Expected 1 object, got %d", len(objs))
+	}
+
+	if len(objs[0].Bindings) != 1 || objs[0].Bindings[0] != "host" {
+		t.Fatalf("Expected bindings [host], got %v", objs[0].Bindings)
+	}
+
+	matcher, ok := objs[0].Object.(*BindMatcher)
+	if !ok {
+		t.Fatalf("Expected bind matcher, got %T", objs[0].Object)
+	}
+
+	var lines = []struct {
+		line string
+		hit  bool
+	}{
+		{line: "connection to host db-1 failed"},
+		{line: "connection to host db-2 failed"},
+		{line: "host db-3 removed from pool"},
+		{line: "host db-2 removed from pool", hit: true},
+	}
+
+	for i, l := range lines {
+		hits := matcher.Scan(match.LogEntry{Line: l.line, Timestamp: int64(i + 1)})
+		if (hits.Cnt > 0) != l.hit {
+			t.Fatalf("Line %d: expected hit=%v, got %d hits", i, l.hit, hits.Cnt)
+		}
+		if !l.hit {
+			continue
+		}
+
+		logs := hits.Index(0)
+		if len(logs) != 2 || logs[0].Line != lines[1].line || logs[1].Line != lines[3].line {
+			t.Errorf("Line %d: unexpected hit logs %v", i, logs)
+		}
+
+		vals, ok := matcher.Values(logs)
+		if !ok || vals["host"] != "db-2" {
+			t.Errorf("Line %d: expected host=db-2, got %v", i, vals)
+		}
+	}
+
+	matcher.GarbageCollect(int64(time.Minute))
+	if !matcher.parts.empty() {
+		t.Errorf("Expected partitions to be collected, got %d", len(matcher.parts.parts))
+	}
+}
+
+func TestBindPartitionError(t *testing.T) {
+
+	objs, err := Compile([]byte(testdata.TestSuccessBind), "node")
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	matcher, ok := objs[0].Object.(*BindMatcher)
+	if !ok {
+		t.Fatalf("Expected bind matcher, got %T", objs[0].Object)
+	}
+
+	var errBuild = errors.New("build failed")
+
+	matcher.parts.build = func() (match.Matcher, error) {
+		return nil, errBuild
+	}
+
+	hits := matcher.Scan(match.LogEntry{Line: "connection to host db-1 failed", Timestamp: 1})
+	if hits.Cnt != 0 || !errors.Is(matcher.Err(), errBuild) {
+		t.Errorf("Expected %v, got %d hits and %v", errBuild, hits.Cnt, matcher.Err())
+	}
+}
+
+func TestBindJq(t *testing.T) {
+
+	objs, err := Compile([]byte(testdata.TestSuccessBindJq), "node")
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	matcher, ok := objs[0].Object.(*BindMatcher)
+	if !ok {
+		t.Fatalf("Expected bind matcher, got %T", objs[0].Object)
+	}
+
+	var lines = []struct {
+		line string
+		hit  bool
+	}{
+		// Binds nothing; replayed into the partitions created later
+		{line: `{"reason":"NodeNotReady"}`},
+		{line: `{"reason":"Killing","involvedObject":{"name":"kafka-0"}}`},
+		{line: `{"reason":"BackOff","involvedObject":{"name":"kafka-1"}}`},
+		{line: `{"reason":"BackOff","involvedObject":{"name":"kafka-0"}}`, hit: true},
+	}
+
+	for i, l := range lines {
+		hits := matcher.Scan(match.LogEntry{Line: l.line, Timestamp: int64(i + 1)})
+		if (hits.Cnt > 0) != l.hit {
+			t.Fatalf("Line %d: expected hit=%v, got %d hits", i, l.hit, hits.Cnt)
+		}
+		if l.hit && len(hits.Logs) != 3 {
+			t.Errorf("Line %d: expected 3 hit logs, got %d", i, len(hits.Logs))
+		}
+	}
+}
+
+func TestCorrelationKeys(t *testing.T) {
+
+	objs, err := Compile([]byte(testdata.TestSuccessCorrelationKeys), "node")
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	var tests = map[string]struct {
+		line  string
+		value string
+	}{
+		"rabbitmq": {line: "Mnesia overloaded host=rabbit-1", value: "rabbit-1"},
+		"k8s":      {line: `{"reason":"NodeShutdown","involvedObject":{"nodeName":"node-1"}}`, value: "node-1"},
+	}
+
+	if len(objs) != len(tests) {
+		t.Fatalf("Expected %d objects, got %d", len(tests), len(objs))
+	}
+
+	for _, obj := range objs {
+		test, ok := tests[obj.Event.Source]
+		if !ok {
+			t.Fatalf("Unexpected source %s", obj.Event.Source)
+		}
+
+		if len(obj.Correlations) != 1 || obj.Correlations[0].Name != "hostname" {
+			t.Fatalf("Source %s: expected hostname key, got %v", obj.Event.Source, obj.Correlations)
+		}
+
+		value, ok := obj.Correlations[0].Extract(test.line)
+		if !ok || value != test.value {
+			t.Errorf("Source %s: expected %s, got %s (ok=%v)", obj.Event.Source, test.value, value, ok)
+		}
+
+		if _, ok := obj.Correlations[0].Extract("no key here"); ok {
+			t.Errorf("Source %s: expected no key", obj.Event.Source)
+		}
+	}
+}
+
+type recordRuntimeT struct {
+	NoopRuntime
+	asserts []AssertParamsT
+}
+
+func (r *recordRuntimeT) NewCbAssert(params AssertParamsT) CallbackT {
+	r.asserts = append(r.asserts, params)
+	return r.NoopRuntime.NewCbAssert(params)
+}
+
+func TestClusterExamples(t *testing.T) {
+
+	rules, err := filepath.Glob(filepath.Join("../testdata", "success_examples", "*.yaml"))
+	if err != nil {
+		t.Fatalf("Error finding CRE test files: %v", err)
+	}
+
+	for _, rule := range rules {
+
+		data, err := os.ReadFile(rule)
+		if err != nil {
+			t.Fatalf("Error reading test file %s: %v", rule, err)
+		}
+
+		var runtime = &recordRuntimeT{}
+
+		objs, err := Compile(data, schema.ScopeCluster, WithRuntime(runtime))
+		if err != nil {
+			t.Fatalf("Error compiling %s for cluster scope: %v", rule, err)
+		}
+
+		if len(objs) == 0 || len(runtime.asserts) != len(objs) {
+			t.Fatalf("Rule %s: expected one assert callback per object, got %d objects and %d callbacks", rule, len(objs), len(runtime.asserts))
+		}
+
+		for _, obj := range objs {
+			if obj.ObjectType != ObjTypeAssert {
+				t.Errorf("Rule %s: expected assert object, got %s", rule, obj.ObjectType)
+			}
+			if _, err := GetMachineMatcher(obj); err != nil {
+				t.Errorf("Rule %s: %v", rule, err)
+			}
+		}
+	}
+}
+
+func TestMachineCorrelations(t *testing.T) {
+
+	objs, err := Compile([]byte(testdata.TestSuccessCorrelationKeys), schema.ScopeCluster)
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	if len(objs) != 1 {
+		t.Fatalf("Expected 1 object, got %d", len(objs))
+	}
+
+	m, err := GetMachineMatcher(objs[0])
+	if err != nil {
+		t.Fatalf("Expected machine matcher: %v", err)
+	}
+
+	var asserts = []struct {
+		assert AssertT
+		hits   int
+	}{
+		{assert: AssertT{TermIdx: 0, Timestamp: 1, Keys: map[string]string{"hostname": "a", "container_id": "1"}}},
+		{assert: AssertT{TermIdx: 0, Timestamp: 2, Keys: map[string]string{"hostname": "b", "container_id": "1"}}},
+		{assert: AssertT{TermIdx: 1, Timestamp: 3, Keys: map[string]string{"hostname": "c", "container_id": "1"}}},
+		{assert: AssertT{TermIdx: 1, Timestamp: 4, Keys: map[string]string{"hostname": "b", "container_id": "1"}}, hits: 1},
+	}
+
+	for i, a := range asserts {
+		hits, err := m.Assert(a.assert)
+		if err != nil {
+			t.Fatalf("Assert %d: unexpected error %v", i, err)
+		}
+		if len(hits) != a.hits {
+			t.Fatalf("Assert %d: expected %d hits, got %d", i, a.hits, len(hits))
+		}
+		for _, hit := range hits {
+			if len(hit.Asserts) != 2 || hit.Asserts[0].Timestamp != 2 || hit.Asserts[1].Timestamp != 4 {
+				t.Errorf("Assert %d: unexpected hit %+v", i, hit)
+			}
+		}
+	}
+
+	if _, err := m.Assert(AssertT{TermIdx: 0, Timestamp: 5}); !errors.Is(err, ErrMissingKey) {
+		t.Errorf("Expected %v, got %v", ErrMissingKey, err)
+	}
+
+	if _, err := m.Assert(AssertT{TermIdx: 2, Timestamp: 5}); !errors.Is(err, ErrInvalidTermIdx) {
+		t.Errorf("Expected %v, got %v", ErrInvalidTermIdx, err)
+	}
+}
+
+func TestOrganization(t *testing.T) {
+
+	var runtime = &recordRuntimeT{}
+
+	objs, err := Compile([]byte(testdata.TestSuccessOrgSequence), schema.ScopeOrganization, WithRuntime(runtime))
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	var (
+		detections []*DetectionMatcher
+		machine    *MachineMatcher
+	)
+
+	for _, obj := range objs {
+		if obj.Scope != schema.ScopeOrganization {
+			t.Errorf("Expected %s scope, got %s", schema.ScopeOrganization, obj.Scope)
+		}
+		if m, err := GetDetectionMatcher(obj); err == nil {
+			detections = append(detections, m)
+			continue
+		}
+		if machine, err = GetMachineMatcher(obj); err != nil {
+			t.Fatalf("Unexpected object %T", obj.Object)
+		}
+	}
+
+	if len(detections) != 3 || machine == nil || len(runtime.asserts) != 1 {
+		t.Fatalf("Expected 3 detections and 1 machine, got %d objects and %d assert callbacks", len(objs), len(runtime.asserts))
+	}
+
+	var (
+		minute = int64(time.Minute)
+		orders = map[string]string{"topic": "orders"}
+		events = []DetectionT{
+			DetectionT{CreId: "KAFKA-BROKER-DOWN", Cluster: "kafka-b", Timestamp: 1 * minute, Keys: orders},
+			DetectionT{CreId: "KAFKA-BROKER-DOWN", Cluster: "kafka-a", Timestamp: 2 * minute, Keys: orders},
+			DetectionT{CreId: "KAFKA-BROKER-RECOVERED", Cluster: "kafka-a", Timestamp: 3 * minute, Keys: orders},
+			DetectionT{CreId: "KAFKA-CONSUMER-LAG", Cluster: "consumers-b", Timestamp: 4 * minute, Keys: orders},
+			DetectionT{CreId: "KAFKA-BROKER-DOWN", Cluster: "kafka-a", Timestamp: 5 * minute, Keys: orders},
+			DetectionT{CreId: "KAFKA-CONSUMER-LAG", Cluster: "consumers-a", Timestamp: 6 * minute, Keys: orders},
+			DetectionT{CreId: "KAFKA-CONSUMER-LAG", Cluster: "consumers-b", Timestamp: 7 * minute, Keys: orders},
+		}
+	)
+
+	for i, e := range events {
+		var hits []MachineHitT
+		for _, d := range detections {
+			a, ok := d.Detect(e)
+			if !ok {
+				continue
+			}
+			h, err := machine.Assert(a)
+			if err != nil {
+				t.Fatalf("Event %d: unexpected error %v", i, err)
+			}
+			hits = append(hits, h...)
+		}
+		if len(hits) != 0 {
+			t.Fatalf("Event %d: expected no hits, got %d", i, len(hits))
+		}
+	}
+
+	// The match fires once the negate window has passed without a recovery
+	hits, err := machine.Eval(8 * minute)
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if len(hits) != 1 {
+		t.Fatalf("Expected 1 hit, got %d", len(hits))
+	}
+
+	if a := hits[0].Asserts; len(a) != 2 || a[0].Timestamp != 5*minute || a[1].Clusters[0] != "consumers-b" {
+		t.Errorf("Unexpected hit %+v", hits[0])
+	}
+
+	// Organization rules are not compiled for clusters
+	if objs, err = Compile([]byte(testdata.TestSuccessOrgSequence), schema.ScopeCluster); err != nil || len(objs) != 0 {
+		t.Errorf("Expected no cluster objects, got %d (%v)", len(objs), err)
+	}
+}
+
+func TestDetectionClusters(t *testing.T) {
+
+	objs, err := Compile([]byte(testdata.TestSuccessOrgClusters), schema.ScopeOrganization)
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	if len(objs) != 2 {
+		t.Fatalf("Expected 2 objects, got %d", len(objs))
+	}
+
+	var d *DetectionMatcher
+	for _, obj := range objs {
+		if m, err := GetDetectionMatcher(obj); err == nil {
+			d = m
+		}
+	}
+
+	if d == nil {
+		t.Fatalf("Expected detection matcher")
+	}
+
+	var (
+		hour   = int64(time.Hour)
+		events = []struct {
+			detection DetectionT
+			clusters  []string
+		}{
+			{detection: DetectionT{CreId: "CRE-2025-0071", Cluster: "a", Timestamp: 0}},
+			{detection: DetectionT{CreId: "CRE-2025-0071", Cluster: "b", Timestamp: hour / 2}},
+			{detection: DetectionT{CreId: "CRE-2025-0071", Cluster: "b", Timestamp: hour}},
+			{detection: DetectionT{CreId: "CRE-2025-0072", Cluster: "c", Timestamp: hour}},
+			{detection: DetectionT{CreId: "CRE-2025-0071", Cluster: "c", Timestamp: hour + 1}}, // a is out of the window
+			{detection: DetectionT{CreId: "CRE-2025-0071", Cluster: "a", Timestamp: hour + 2}, clusters: []string{"a", "b", "c"}},
+			{detection: DetectionT{CreId: "CRE-2025-0071", Cluster: "d", Timestamp: hour + 3}},
+		}
+	)
+
+	for i, e := range events {
+		a, ok := d.Detect(e.detection)
+		if ok != (e.clusters != nil) {
+			t.Fatalf("Event %d: expected match %v, got %v", i, e.clusters != nil, ok)
+		}
+		if ok && !slices.Equal(a.Clusters, e.clusters) {
+			t.Errorf("Event %d: expected clusters %v, got %v", i, e.clusters, a.Clusters)
+		}
+	}
+
+	d.GarbageCollect(3 * hour)
+	if len(d.seen) != 0 {
+		t.Errorf("Expected no detections after garbage collection, got %d", len(d.seen))
+	}
+}
+
+func TestSourceIndex(t *testing.T) {
+
+	objs, idx, err := CompileIndex([]byte(testdata.TestSuccessComplexRule4), schema.ScopeNode, WithSources("k8s", "syslog", "log"))
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	if idx.Objects != len(objs) || idx.Matchers != len(objs) {
+		t.Errorf("Expected %d objects and matchers, got %d and %d", len(objs), idx.Objects, idx.Matchers)
+	}
+
+	if counts := idx.Counts(); !reflect.DeepEqual(counts, map[string]int{"k8s": 3, "nginx": 4, "rabbitmq": 1}) {
+		t.Errorf("Unexpected counts %v", counts)
+	}
+
+	if !reflect.DeepEqual(idx.Unused, []string{"log", "syslog"}) {
+		t.Errorf("Unexpected unused sources %v", idx.Unused)
+	}
+
+	if m := idx.Lookup("unknown"); m != nil {
+		t.Errorf("Expected no matchers, got %d", len(m))
+	}
+
+	for _, m := range idx.Lookup("nginx") {
+		if m.Obj.Event.Source != "nginx" || m.Obj.ObjectType != ObjTypeMatcher {
+			t.Errorf("Unexpected object %s for source nginx", m.Obj.Address)
+		}
+		if len(m.Parents) != 2 || m.Parents[0] != m.Obj.ParentAddress || m.Parents[1].GetDepth() != 0 {
+			t.Errorf("Unexpected parent chain %v for %s", m.Parents, m.Obj.Address)
+		}
+	}
+
+	// Cluster objects are machines, not matchers
+	objs, idx, err = CompileIndex([]byte(testdata.TestSuccessComplexRule4), schema.ScopeCluster)
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	if idx.Objects != len(objs) || idx.Matchers != 0 || len(idx.Sources) != 0 {
+		t.Errorf("Expected no indexed matchers, got %d", idx.Matchers)
+	}
+}
+
+type fanOutRuntimeT struct {
+	NoopRuntime
+	matched []string
+	err     error // Returned by every callback
+}
+
+func (r *fanOutRuntimeT) NewCbMatch(params MatchParamsT) CallbackT {
+	return func(ctx context.Context, param any) error {
+		r.matched = append(r.matched, params.Address.String())
+		return r.err
+	}
+}
+
+func TestSourceIndexDedupe(t *testing.T) {
+
+	_, idx, err := CompileIndex([]byte(testdata.TestSuccessSharedTerms), schema.ScopeNode, WithDedupe())
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	matchers := idx.Lookup("cre.k8s")
+	if len(matchers) != 2 {
+		t.Fatalf("Expected 2 matchers, got %d", len(matchers))
+	}
+
+	var (
+		shared = matchers[0]
+		deps   = shared.Dependents
+	)
+
+	if len(deps) != 1 {
+		t.Fatalf("Expected one dependent, got %d", len(deps))
+	}
+
+	// The dependent keeps the parent chain of its own rule
+	if len(deps[0].Parents) != 1 || deps[0].Parents[0] != deps[0].Obj.ParentAddress || deps[0].Parents[0].GetRuleHash() == shared.Obj.Address.GetRuleHash() {
+		t.Errorf("Unexpected dependent parents %v", deps[0].Parents)
+	}
+}
+
+func TestDedupe(t *testing.T) {
+
+	objs, err := Compile([]byte(testdata.TestSuccessSharedTerms), schema.ScopeNode)
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	if len(objs) != 3 {
+		t.Fatalf("Expected 3 objects without dedupe, got %d", len(objs))
+	}
+
+	var runtime = &fanOutRuntimeT{}
+
+	if objs, err = Compile([]byte(testdata.TestSuccessSharedTerms), schema.ScopeNode, WithDedupe(), WithRuntime(runtime)); err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	if len(objs) != 2 {
+		t.Fatalf("Expected 2 objects with dedupe, got %d", len(objs))
+	}
+
+	var shared = objs[0]
+
+	if len(shared.Dependents) != 1 || shared.Dependents[0].Object != nil || len(objs[1].Dependents) != 0 {
+		t.Fatalf("Expected one dependent of the first object")
+	}
+
+	if _, err = GetLogSingleMatcher(shared); err != nil {
+		t.Errorf("Expected the shared matcher: %v", err)
+	}
+
+	if err = shared.Cb(context.Background(), nil); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	var expected = []string{shared.Address.String(), shared.Dependents[0].Address.String()}
+
+	if !slices.Equal(runtime.matched, expected) || shared.Address.GetRuleHash() == shared.Dependents[0].Address.GetRuleHash() {
+		t.Errorf("Expected the match fanned out to %v, got %v", expected, runtime.matched)
+	}
+
+	// A failing callback does not stop delivery to the other rules
+	runtime.matched = nil
+	runtime.err = errors.New("callback failed")
+
+	if err = shared.Cb(context.Background(), nil); !errors.Is(err, runtime.err) {
+		t.Errorf("Expected %v, got %v", runtime.err, err)
+	}
+
+	if !slices.Equal(runtime.matched, expected) {
+		t.Errorf("Expected the match fanned out to %v after errors, got %v", expected, runtime.matched)
+	}
+}
+
+func TestDedupeSharedTerms(t *testing.T) {
+
+	objs, err := Compile([]byte(testdata.TestSuccessSharedTermsPartial), schema.ScopeNode, WithDedupe())
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	if len(objs) != 2 {
+		t.Fatalf("Expected 2 objects with dedupe, got %d", len(objs))
+	}
+
+	var (
+		matchers []*ExcludeMatcher
+		shared   []*sharedTermT
+	)
+
+	for i, obj := range objs {
+		m, ok := obj.Object.(*ExcludeMatcher)
+		if !ok {
+			t.Fatalf("Object %d: expected a gated matcher, got %T", i, obj.Object)
+		}
+		for _, g := range m.gates {
+			if g.shared != nil {
+				shared = append(shared, g.shared)
+			}
+		}
+		matchers = append(matchers, m)
+	}
+
+	// Only OOMKilled is shared, BackOff has its own gate
+	if len(shared) != 2 || shared[0] != shared[1] {
+		t.Fatalf("Expected the OOMKilled gate in both matchers, got %v", shared)
+	}
+
+	for i, line := range []string{"OOMKilled", "BackOff"} {
+		var hits int
+		for _, m := range matchers {
+			hits += m.Scan(match.LogEntry{Timestamp: int64(i + 1), Line: line}).Cnt
+		}
+		if shared[0].evals != i+1 {
+			t.Errorf("%s: expected the shared term evaluated once per event, got %d", line, shared[0].evals)
+		}
+		if hits != 1 {
+			t.Errorf("%s: expected one hit, got %d", line, hits)
+		}
+	}
+}
+
+func TestRegexLiteral(t *testing.T) {
+
+	var tests = map[string]string{
+		`connection to host (?P<host>\S+) failed`: "connection to host ",
+		`^ERROR: (disk|memory) full$`:             "ERROR: ",
+		`(?i)oomkilled`:                           "",
+		`(panic|fatal)`:                           "",
+		`(timeout)+ after \d+s`:                   "timeout",
+		`x*`:                                      "",
+		`\d+`:                                     "",
+	}
+
+	for expr, want := range tests {
+		t.Run(expr, func(t *testing.T) {
+			re, err := syntax.Parse(expr, syntax.Perl)
+			if err != nil {
+				t.Fatalf("Error parsing regex: %v", err)
+			}
+			if got := regexLiteral(re.Simplify()); got != want {
+				t.Errorf("Expected %q, got %q", want, got)
+			}
+		})
+	}
+}
+
+func TestAhoCorasick(t *testing.T) {
+
+	var (
+		a    = newAc([]string{"he", "she", "his", "hers"})
+		seen []int
+	)
+
+	a.scan("ushers", func(id int) {
+		seen = append(seen, id)
+	})
+
+	slices.Sort(seen)
+
+	if !slices.Equal(seen, []int{0, 1, 3}) {
+		t.Errorf("Expected he, she and hers, got %v", seen)
+	}
+}
+
+func TestPrefilter(t *testing.T) {
+
+	objs, p, err := CompilePrefilter([]byte(testdata.TestSuccessPrefilter), schema.ScopeNode)
+	if err != nil {
+		t.Fatalf("Error compiling rule: %v", err)
+	}
+
+	f, ok := p.Sources["cre.k8s"]
+	if !ok || len(f.Matchers) != len(objs) {
+		t.Fatalf("Expected a prefilter of every matcher")
+	}
+
+	if !slices.Equal(f.Literals, []string{"OOMKilled", "restarted "}) {
+		t.Errorf("Unexpected literals %v", f.Literals)
+	}
+
+	var tests = map[string]struct {
+		line string
+		want []string
+	}{
+		"Literal": {line: "pod web-1 OOMKilled", want: []string{"Prefilter1", "Prefilter3", "Prefilter4"}},
+		"Regex":   {line: "container restarted 3 times", want: []string{"Prefilter2", "Prefilter3", "Prefilter4"}},
+		"Both":    {line: "OOMKilled and restarted 1 times", want: []string{"Prefilter1", "Prefilter2", "Prefilter3", "Prefilter4"}},
+		"None":    {line: "pod web-1 OOMKill", want: []string{"Prefilter3", "Prefilter4"}},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+
+			var got []string
+			for _, obj := range p.Candidates("cre.k8s", test.line) {
+				got = append(got, obj.CreId)
+			}
+
+			slices.Sort(got)
+
+			if !slices.Equal(got, test.want) {
+				t.Errorf("Expected %v, got %v", test.want, got)
+			}
+		})
+	}
+
+	if objs := p.Candidates("unknown", "OOMKilled"); objs != nil {
+		t.Errorf("Expected no matchers, got %d", len(objs))
+	}
+}
@@ -38,3 +38,76 @@ func (p *NodePlugin) Compile(runtime RuntimeI, node *ast.AstNodeT) (ObjsT, error
 
 	return objs, nil
 }
+
+type ClusterPlugin struct{}
+
+func NewClusterPlugin() *ClusterPlugin {
+	return &ClusterPlugin{}
+}
+
+func (p *ClusterPlugin) Compile(runtime RuntimeI, node *ast.AstNodeT) (ObjsT, error) {
+
+	var (
+		objs = make(ObjsT, 0)
+		obj  *ObjT
+		err  error
+	)
+
+	switch node.Metadata.Type {
+	case schema.NodeTypeSeq, schema.NodeTypeSet:
+		if obj, err = ObjMachine(runtime, node); err != nil {
+			log.Error().Err(err).Str("scope", node.Metadata.Scope).Msg("Failed to compile state machine")
+			return nil, err
+		}
+	default:
+		log.Error().
+			Interface("node_type", node.Metadata.Type).
+			Interface("node", node).
+			Msg("Unsupported node type")
+		return nil, ErrUnsupportedNodeType
+	}
+
+	objs = append(objs, obj)
+
+	return objs, nil
+}
+
+// OrganizationPlugin compiles organization scope rules. Their inputs are
+// the detections reported by clusters rather than events.
+type OrganizationPlugin struct{}
+
+func NewOrganizationPlugin() *OrganizationPlugin {
+	return &OrganizationPlugin{}
+}
+
+func (p *OrganizationPlugin) Compile(runtime RuntimeI, node *ast.AstNodeT) (ObjsT, error) {
+
+	var (
+		objs = make(ObjsT, 0)
+		obj  *ObjT
+		err  error
+	)
+
+	switch node.Metadata.Type {
+	case schema.NodeTypeDetection:
+		if obj, err = ObjDetection(runtime, node); err != nil {
+			log.Error().Err(err).Str("scope", node.Metadata.Scope).Msg("Failed to compile detection")
+			return nil, err
+		}
+	case schema.NodeTypeSeq, schema.NodeTypeSet:
+		if obj, err = ObjMachine(runtime, node); err != nil {
+			log.Error().Err(err).Str("scope", node.Metadata.Scope).Msg("Failed to compile state machine")
+			return nil, err
+		}
+	default:
+		log.Error().
+			Interface("node_type", node.Metadata.Type).
+			Interface("node", node).
+			Msg("Unsupported node type")
+		return nil, ErrUnsupportedNodeType
+	}
+
+	objs = append(objs, obj)
+
+	return objs, nil
+}
@@ -0,0 +1,652 @@
+// Package evaluator is a reference in-memory runtime for compiled rules. It
+// is deterministic and single-process; it favors clarity over throughput
+// and serves as the semantic ground truth for rule tests.
+package evaluator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-compiler/pkg/compiler"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	ErrOutOfOrder     = errors.New("event out of order")
+	ErrUnknownAddress = errors.New("unknown address")
+)
+
+// Scopes compiled by the evaluator, innermost first
+var scopes = []string{
+	schema.ScopeNode,
+	schema.ScopeCluster,
+	schema.ScopeOrganization,
+}
+
+// EventT is an event from a source, e.g. a log line.
+type EventT struct {
+	Source    string            `json:"source"`
+	Timestamp int64             `json:"timestamp"`
+	Line      string            `json:"line"`
+	Keys      map[string]string `json:"keys,omitempty"` // Values of correlations named without sources, e.g. container_id
+}
+
+// MatchT is a match of a log matcher or detection term that took part in a
+// detection.
+type MatchT struct {
+	Address string   `json:"address"`
+	Origin  bool     `json:"origin,omitempty"`
+	Events  []EventT `json:"events,omitempty"`
+}
+
+// DetectionT is a match of a rule.
+type DetectionT struct {
+	RuleId    string            `json:"rule_id"`
+	RuleHash  string            `json:"rule_hash"`
+	CreId     string            `json:"cre_id"`
+	Timestamp int64             `json:"timestamp"`
+	Keys      map[string]string `json:"keys,omitempty"`     // Correlation key values and bound variables
+	Clusters  []string          `json:"clusters,omitempty"` // Clusters of an organization scope detection
+	Matches   []MatchT          `json:"matches"`            // In term order
+}
+
+// Evaluator feeds events to the objects compiled from an AST and routes the
+// match and assert callbacks by address into the parent machines. A match
+// of a rule root is reported as a detection.
+type Evaluator struct {
+	nodes     map[string]*nodeT
+	sources   map[string][]*nodeT
+	matchers  []*nodeT // Log matchers in compile order
+	machines  []*nodeT // Deepest first
+	detectors []*nodeT // Detection terms of organization scope rules
+	events    map[uint64]EventT
+	asserts   map[uint64]*assertRecT
+	nextId    uint64
+	horizon   int64
+	clock     int64
+	out       []DetectionT
+	trace     *TraceT
+	prefilter *compiler.PrefilterT
+}
+
+type OptT func(*optsT)
+
+// WithTrace records how every node of the rules progressed, see Trace.
+func WithTrace() OptT {
+	return func(o *optsT) {
+		o.trace = true
+	}
+}
+
+// WithDedupe evaluates identical log matchers of different rules once, and
+// the terms that different matchers have in common once per event, see
+// compiler.WithDedupe.
+func WithDedupe() OptT {
+	return func(o *optsT) {
+		o.dedupe = true
+	}
+}
+
+// WithPrefilter only scans the log matchers whose required literals appear
+// in an event, see compiler.PrefilterT.
+func WithPrefilter() OptT {
+	return func(o *optsT) {
+		o.prefilter = true
+	}
+}
+
+type optsT struct {
+	trace     bool
+	dedupe    bool
+	prefilter bool
+}
+
+func evalOpts(opts ...OptT) *optsT {
+	o := &optsT{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+type nodeT struct {
+	obj     *compiler.ObjT
+	matcher match.Matcher
+	machine *compiler.MachineMatcher
+	detect  *compiler.DetectionMatcher
+	last    int64 // Timestamp of the last assert
+}
+
+// assertRecT holds the matches behind an assert until the parent hits.
+type assertRecT struct {
+	timestamp int64
+	matches   []MatchT
+	clusters  []string
+}
+
+// hitT is the parameter of the match callbacks.
+type hitT struct {
+	timestamp int64
+	keys      map[string]string
+	clusters  []string
+	events    []EventT
+}
+
+// Build parses and compiles a rules document for evaluation.
+func Build(data []byte, opts ...OptT) (*Evaluator, error) {
+
+	tree, err := ast.Build(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return New(tree, opts...)
+}
+
+// New compiles every scope of an AST for evaluation.
+func New(tree *ast.AstT, opts ...OptT) (*Evaluator, error) {
+
+	var (
+		o = evalOpts(opts...)
+		e = &Evaluator{
+			nodes:   make(map[string]*nodeT),
+			sources: make(map[string][]*nodeT),
+			events:  make(map[uint64]EventT),
+			asserts: make(map[uint64]*assertRecT),
+		}
+		copts = []compiler.CompilerOptT{compiler.WithRuntime(e)}
+		all   compiler.ObjsT
+	)
+
+	if o.dedupe {
+		copts = append(copts, compiler.WithDedupe())
+	}
+
+	for _, scope := range scopes {
+		objs, err := compiler.CompileAst(tree, scope, copts...)
+		if err != nil {
+			return nil, err
+		}
+		for _, obj := range objs {
+			if err := e.add(obj); err != nil {
+				return nil, err
+			}
+		}
+		all = append(all, objs...)
+	}
+
+	if o.prefilter {
+		var err error
+		if e.prefilter, err = compiler.NewPrefilter(tree, all); err != nil {
+			return nil, err
+		}
+	}
+
+	slices.SortStableFunc(e.machines, func(a, b *nodeT) int {
+		return int(b.obj.Address.GetDepth()) - int(a.obj.Address.GetDepth())
+	})
+
+	for _, node := range tree.Nodes {
+		e.horizon = max(e.horizon, horizon(node))
+	}
+
+	if o.trace {
+		var err error
+		if e.trace, err = newTrace(tree); err != nil {
+			return nil, err
+		}
+	}
+
+	return e, nil
+}
+
+func (e *Evaluator) add(obj *compiler.ObjT) error {
+
+	var n = &nodeT{obj: obj}
+
+	switch o := obj.Object.(type) {
+	case *compiler.MachineMatcher:
+		n.machine = o
+		e.machines = append(e.machines, n)
+	case *compiler.DetectionMatcher:
+		n.detect = o
+		e.detectors = append(e.detectors, n)
+	case match.Matcher:
+		n.matcher = o
+		e.matchers = append(e.matchers, n)
+		e.sources[obj.Event.Source] = append(e.sources[obj.Event.Source], n)
+	default:
+		return fmt.Errorf("%w: %T", compiler.ErrUnsupportedMatcher, obj.Object)
+	}
+
+	e.nodes[obj.Address.String()] = n
+	for _, dep := range obj.Dependents {
+		e.nodes[dep.Address.String()] = n
+	}
+
+	return nil
+}
+
+// addresses returns the address of a node and of the dependents sharing
+// its matcher.
+func (n *nodeT) addresses() []*ast.AstNodeAddressT {
+	var out = []*ast.AstNodeAddressT{n.obj.Address}
+	for _, dep := range n.obj.Dependents {
+		out = append(out, dep.Address)
+	}
+	return out
+}
+
+// Scan delivers an event to the log matchers of its source and returns the
+// detections it completes, along with those completed by the passage of
+// time. Events must be delivered in timestamp order.
+func (e *Evaluator) Scan(ev EventT) ([]DetectionT, error) {
+
+	if ev.Timestamp < e.clock {
+		return nil, fmt.Errorf("%w: %d < %d", ErrOutOfOrder, ev.Timestamp, e.clock)
+	}
+	e.clock = ev.Timestamp
+
+	if nodes := e.scanNodes(ev); len(nodes) > 0 {
+
+		var id = e.newId()
+		e.events[id] = ev
+
+		// The stream carries the event id through the log matchers
+		entry := match.LogEntry{
+			Line:      ev.Line,
+			Timestamp: ev.Timestamp,
+			Stream:    strconv.FormatUint(id, 10),
+		}
+
+		for _, n := range nodes {
+			for _, addr := range n.addresses() {
+				e.trace.scan(addr, ev)
+			}
+			if err := e.matched(n, n.matcher.Scan(entry)); err != nil {
+				return nil, err
+			}
+			if bm, ok := n.matcher.(*compiler.BindMatcher); ok && bm.Err() != nil {
+				return nil, bm.Err()
+			}
+		}
+	}
+
+	return e.Eval(ev.Timestamp)
+}
+
+// scanNodes returns the log matchers to scan for an event.
+func (e *Evaluator) scanNodes(ev EventT) []*nodeT {
+
+	if e.prefilter == nil {
+		return e.sources[ev.Source]
+	}
+
+	var nodes []*nodeT
+	for _, obj := range e.prefilter.Candidates(ev.Source, ev.Line) {
+		nodes = append(nodes, e.nodes[obj.Address.String()])
+	}
+
+	return nodes
+}
+
+// Detect delivers a cluster-level detection to the organization scope rules
+// and returns the detections it completes.
+func (e *Evaluator) Detect(d compiler.DetectionT) ([]DetectionT, error) {
+
+	if d.Timestamp < e.clock {
+		return nil, fmt.Errorf("%w: %d < %d", ErrOutOfOrder, d.Timestamp, e.clock)
+	}
+	e.clock = d.Timestamp
+
+	for _, n := range e.detectors {
+		a, ok := n.detect.Detect(d)
+		if !ok {
+			continue
+		}
+
+		e.trace.assert(n.obj.Address, 0, a.Timestamp)
+		e.trace.matched(n.obj.Address)
+
+		hit := &hitT{
+			timestamp: a.Timestamp,
+			keys:      a.Keys,
+			clusters:  a.Clusters,
+		}
+
+		if err := n.obj.Cb(context.Background(), hit); err != nil {
+			return nil, err
+		}
+	}
+
+	return e.Eval(d.Timestamp)
+}
+
+// Eval advances the clock, e.g. past the end of a negate window, and returns
+// the detections that completes.
+func (e *Evaluator) Eval(clock int64) ([]DetectionT, error) {
+
+	e.clock = max(e.clock, clock)
+	e.trace.tick(e.clock)
+
+	for _, n := range e.matchers {
+		if err := e.matched(n, n.matcher.Eval(e.clock)); err != nil {
+			return nil, err
+		}
+	}
+
+	// Children are evaluated first so their hits reach the parents in time
+	for _, n := range e.machines {
+		hits, err := n.machine.Eval(e.clock)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.machineHits(n, hits); err != nil {
+			return nil, err
+		}
+	}
+
+	e.gc(e.clock)
+
+	out := e.out
+	e.out = nil
+
+	return out, nil
+}
+
+// Flush advances the clock past every window still open, e.g. at the end of
+// a replay, and returns the detections that completes.
+func (e *Evaluator) Flush() ([]DetectionT, error) {
+	return e.Eval(e.clock + e.horizon + 1)
+}
+
+// Trace returns the trace of the evaluation, or nil unless the evaluator
+// was created with WithTrace.
+func (e *Evaluator) Trace() *TraceT {
+	return e.trace
+}
+
+func (e *Evaluator) newId() uint64 {
+	e.nextId++
+	return e.nextId
+}
+
+// matched reports the hits of a log matcher through its match callback.
+func (e *Evaluator) matched(n *nodeT, hits match.Hits) error {
+
+	for i := range hits.Cnt {
+
+		var (
+			logs = hits.Index(i)
+			hit  = &hitT{keys: make(map[string]string)}
+		)
+
+		for _, l := range logs {
+			hit.timestamp = max(hit.timestamp, l.Timestamp)
+			if id, err := strconv.ParseUint(l.Stream, 10, 64); err == nil {
+				hit.events = append(hit.events, e.events[id])
+			}
+		}
+
+		if !e.matchKeys(n, logs, hit) {
+			log.Debug().
+				Str("address", n.obj.Address.String()).
+				Msg("Dropping match with conflicting bindings")
+			continue
+		}
+
+		for _, addr := range n.addresses() {
+			e.trace.matched(addr)
+		}
+
+		if err := n.obj.Cb(context.Background(), hit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// matchKeys sets the correlation keys and bound variables of a match. Keys
+// extracted from the events take precedence over the event metadata.
+func (e *Evaluator) matchKeys(n *nodeT, logs []match.LogEntry, hit *hitT) bool {
+
+	for _, ev := range hit.events {
+		for name, v := range ev.Keys {
+			if _, ok := hit.keys[name]; !ok {
+				hit.keys[name] = v
+			}
+		}
+	}
+
+	for _, key := range n.obj.Correlations {
+		for _, l := range logs {
+			if v, ok := key.Extract(l.Line); ok {
+				hit.keys[key.Name] = v
+				break
+			}
+		}
+	}
+
+	if bm, ok := n.matcher.(*compiler.BindMatcher); ok {
+		vals, ok := bm.Values(logs)
+		if !ok {
+			return false
+		}
+		maps.Copy(hit.keys, vals)
+	}
+
+	return true
+}
+
+// machineHits reports the hits of a machine through its assert callback.
+func (e *Evaluator) machineHits(n *nodeT, hits []compiler.MachineHitT) error {
+	for _, hit := range hits {
+		e.trace.matched(n.obj.Address)
+		if err := n.obj.Cb(context.Background(), hit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assert delivers a child match to the machine at address.
+func (e *Evaluator) assert(address *ast.AstNodeAddressT, a compiler.AssertT, rec *assertRecT) error {
+
+	if address == nil {
+		return fmt.Errorf("%w: missing parent", ErrUnknownAddress)
+	}
+
+	parent, ok := e.nodes[address.String()]
+	if !ok || parent.machine == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownAddress, address.String())
+	}
+
+	a.Id = e.newId()
+	e.asserts[a.Id] = rec
+	e.trace.assert(address, a.TermIdx, a.Timestamp)
+
+	// Matches delayed by negate windows may complete after later asserts
+	a.Timestamp = max(a.Timestamp, parent.last)
+	parent.last = a.Timestamp
+
+	hits, err := parent.machine.Assert(a)
+	switch {
+	case errors.Is(err, compiler.ErrMissingKey):
+		log.Debug().
+			Err(err).
+			Str("address", address.String()).
+			Msg("Dropping assert without correlation keys")
+		return nil
+	case err != nil:
+		return err
+	}
+
+	return e.machineHits(parent, hits)
+}
+
+// NewCbMatch routes the matches of a log matcher or detection term into its
+// parent machine.
+func (e *Evaluator) NewCbMatch(params compiler.MatchParamsT) compiler.CallbackT {
+	return func(ctx context.Context, param any) error {
+
+		hit, ok := param.(*hitT)
+		if !ok {
+			return compiler.ErrInvalidCbArgs
+		}
+
+		termIdx, err := params.Address.GetTermIdx()
+		if err != nil {
+			return err
+		}
+
+		rec := &assertRecT{
+			timestamp: hit.timestamp,
+			clusters:  hit.clusters,
+			matches: []MatchT{{
+				Address: params.Address.String(),
+				Origin:  params.Origin,
+				Events:  hit.events,
+			}},
+		}
+
+		return e.assert(params.ParentAddress, compiler.AssertT{
+			TermIdx:   termIdx,
+			Timestamp: hit.timestamp,
+			Keys:      hit.keys,
+			Clusters:  hit.clusters,
+		}, rec)
+	}
+}
+
+// NewCbAssert routes the matches of a machine into its parent machine, or
+// reports a detection for the root of a rule.
+func (e *Evaluator) NewCbAssert(params compiler.AssertParamsT) compiler.CallbackT {
+	return func(ctx context.Context, param any) error {
+
+		hit, ok := param.(compiler.MachineHitT)
+		if !ok {
+			return compiler.ErrInvalidCbArgs
+		}
+
+		n, ok := e.nodes[params.Address.String()]
+		if !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownAddress, params.Address.String())
+		}
+
+		var (
+			keys = make(map[string]string)
+			rec  = &assertRecT{}
+		)
+
+		for _, a := range hit.Asserts {
+			maps.Copy(keys, a.Keys)
+			if child, ok := e.asserts[a.Id]; ok {
+				rec.timestamp = max(rec.timestamp, child.timestamp)
+				rec.matches = append(rec.matches, child.matches...)
+				rec.clusters = append(rec.clusters, child.clusters...)
+			}
+		}
+
+		slices.Sort(rec.clusters)
+		rec.clusters = slices.Compact(rec.clusters)
+
+		if n.obj.ParentAddress == nil {
+			e.out = append(e.out, DetectionT{
+				RuleId:    n.obj.RuleId,
+				RuleHash:  params.Address.GetRuleHash(),
+				CreId:     n.obj.CreId,
+				Timestamp: rec.timestamp,
+				Keys:      keys,
+				Clusters:  rec.clusters,
+				Matches:   rec.matches,
+			})
+			return nil
+		}
+
+		termIdx, err := params.Address.GetTermIdx()
+		if err != nil {
+			return err
+		}
+
+		return e.assert(n.obj.ParentAddress, compiler.AssertT{
+			TermIdx:   termIdx,
+			Timestamp: rec.timestamp,
+			Keys:      keys,
+			Clusters:  rec.clusters,
+		}, rec)
+	}
+}
+
+// gc drops the state that can no longer take part in a detection.
+func (e *Evaluator) gc(clock int64) {
+
+	for _, n := range e.matchers {
+		n.matcher.GarbageCollect(clock)
+	}
+
+	for _, n := range e.machines {
+		n.machine.GarbageCollect(clock)
+	}
+
+	for _, n := range e.detectors {
+		n.detect.GarbageCollect(clock)
+	}
+
+	var deadline = clock - e.horizon
+
+	maps.DeleteFunc(e.events, func(_ uint64, ev EventT) bool {
+		return ev.Timestamp < deadline
+	})
+
+	maps.DeleteFunc(e.asserts, func(_ uint64, rec *assertRecT) bool {
+		return rec.timestamp < deadline
+	})
+}
+
+// horizon bounds how long a match below node can take part in a detection:
+// the windows and negate windows along the longest path to a leaf.
+func horizon(node *ast.AstNodeT) int64 {
+
+	var window, negate, child int64
+
+	switch o := node.Object.(type) {
+	case *ast.AstSeqMatcherT:
+		window = o.Window.Nanoseconds()
+	case *ast.AstSetMatcherT:
+		window = o.Window.Nanoseconds()
+	case *ast.AstDetectionT:
+		window = o.Window.Nanoseconds()
+	case *ast.AstLogMatcherT:
+		window = o.Window.Nanoseconds()
+		for _, field := range o.Negate {
+			negate = max(negate, negateSpan(field.NegateOpts))
+		}
+	}
+
+	for _, c := range node.Children {
+		child = max(child, horizon(c))
+		negate = max(negate, negateSpan(c.Metadata.NegateOpts))
+	}
+
+	return window + negate + child
+}
+
+func negateSpan(o *ast.AstNegateOptsT) int64 {
+	if o == nil {
+		return 0
+	}
+	slide := o.Slide.Nanoseconds()
+	if slide < 0 {
+		slide = -slide
+	}
+	return o.Window.Nanoseconds() + slide
+}
@@ -0,0 +1,504 @@
+package evaluator
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-compiler/pkg/compiler"
+	"github.com/prequel-dev/prequel-compiler/pkg/testdata"
+)
+
+var sec = int64(time.Second)
+
+type stepT struct {
+	event      EventT
+	clock      int64 // Eval instead of Scan when set
+	detections int
+}
+
+func run(t *testing.T, e *Evaluator, steps []stepT) []DetectionT {
+
+	var all []DetectionT
+
+	for i, step := range steps {
+		var (
+			out []DetectionT
+			err error
+		)
+
+		if step.clock > 0 {
+			out, err = e.Eval(step.clock)
+		} else {
+			out, err = e.Scan(step.event)
+		}
+
+		if err != nil {
+			t.Fatalf("Step %d: unexpected error %v", i, err)
+		}
+
+		if len(out) != step.detections {
+			t.Fatalf("Step %d: expected %d detections, got %d", i, step.detections, len(out))
+		}
+
+		all = append(all, out...)
+	}
+
+	return all
+}
+
+func TestCorrelations(t *testing.T) {
+
+	e, err := Build([]byte(testdata.TestSuccessCorrelationKeys))
+	if err != nil {
+		t.Fatalf("Error building evaluator: %v", err)
+	}
+
+	var (
+		pod1 = map[string]string{"container_id": "1"}
+		pod2 = map[string]string{"container_id": "2"}
+	)
+
+	detections := run(t, e, []stepT{
+		{event: EventT{Source: "rabbitmq", Timestamp: 1 * sec, Line: "Mnesia overloaded host=a", Keys: pod1}},
+		{event: EventT{Source: "rabbitmq", Timestamp: 2 * sec, Line: "Mnesia overloaded host=b", Keys: pod1}},
+		{event: EventT{Source: "k8s", Timestamp: 3 * sec, Line: `{"reason":"NodeShutdown","involvedObject":{"nodeName":"b"}}`, Keys: pod2}},
+		{event: EventT{Source: "k8s", Timestamp: 4 * sec, Line: `{"reason":"NodeShutdown","involvedObject":{"nodeName":"c"}}`, Keys: pod1}},
+		{event: EventT{Source: "k8s", Timestamp: 5 * sec, Line: `{"reason":"NodeShutdown","involvedObject":{"nodeName":"a"}}`, Keys: pod1}, detections: 1},
+	})
+
+	d := detections[0]
+
+	if d.CreId != "TestSuccessCorrelationKeys" || d.Timestamp != 5*sec {
+		t.Errorf("Unexpected detection %+v", d)
+	}
+
+	if d.Keys["hostname"] != "a" || d.Keys["container_id"] != "1" {
+		t.Errorf("Unexpected keys %v", d.Keys)
+	}
+
+	if len(d.Matches) != 2 || !d.Matches[0].Origin || d.Matches[0].Events[0].Timestamp != 1*sec || d.Matches[1].Events[0].Timestamp != 5*sec {
+		t.Errorf("Unexpected matches %+v", d.Matches)
+	}
+}
+
+func TestNegateWindow(t *testing.T) {
+
+	data, err := os.ReadFile("../testdata/success_examples/26-negate-window.yaml")
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	e, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building evaluator: %v", err)
+	}
+
+	const source = "cre.log.kafka"
+
+	run(t, e, []stepT{
+		{event: EventT{Source: source, Timestamp: 1 * sec, Line: "foo1bar"}},
+		{event: EventT{Source: "other", Timestamp: 2 * sec, Line: "FP1"}},
+		{clock: 6*sec + 1, detections: 1},
+		{event: EventT{Source: source, Timestamp: 10 * sec, Line: "foo2bar"}},
+		{event: EventT{Source: source, Timestamp: 12 * sec, Line: "FP1"}},
+		{clock: 20 * sec},
+	})
+}
+
+func TestBind(t *testing.T) {
+
+	e, err := Build([]byte(testdata.TestSuccessBind))
+	if err != nil {
+		t.Fatalf("Error building evaluator: %v", err)
+	}
+
+	const source = "cre.log.haproxy"
+
+	detections := run(t, e, []stepT{
+		{event: EventT{Source: source, Timestamp: 1 * sec, Line: "connection to host a failed"}},
+		{event: EventT{Source: source, Timestamp: 2 * sec, Line: "host b removed from pool"}},
+		{event: EventT{Source: source, Timestamp: 3 * sec, Line: "host a removed from pool"}, detections: 1},
+	})
+
+	if detections[0].Keys["host"] != "a" {
+		t.Errorf("Unexpected keys %v", detections[0].Keys)
+	}
+}
+
+func TestBindMixed(t *testing.T) {
+
+	e, err := Build([]byte(testdata.TestSuccessBindMixed))
+	if err != nil {
+		t.Fatalf("Error building evaluator: %v", err)
+	}
+
+	const source = "cre.log.auth"
+
+	// No variable is bound twice, so the terms match whatever their values
+	detections := run(t, e, []stepT{
+		{event: EventT{Source: source, Timestamp: 1 * sec, Line: "alice login"}},
+		{event: EventT{Source: source, Timestamp: 2 * sec, Line: "s1 closed"}, detections: 1},
+	})
+
+	if detections[0].Keys["user"] != "alice" || detections[0].Keys["session"] != "s1" {
+		t.Errorf("Unexpected keys %v", detections[0].Keys)
+	}
+}
+
+func TestBindOverlap(t *testing.T) {
+
+	e, err := Build([]byte(testdata.TestSuccessBindOverlap))
+	if err != nil {
+		t.Fatalf("Error building evaluator: %v", err)
+	}
+
+	const source = "cre.log.auth"
+
+	// Only session is bound by both terms and must agree
+	detections := run(t, e, []stepT{
+		{event: EventT{Source: source, Timestamp: 1 * sec, Line: "user alice opened session s1"}},
+		{event: EventT{Source: source, Timestamp: 2 * sec, Line: "session s2 closed"}},
+		{event: EventT{Source: source, Timestamp: 3 * sec, Line: "session s1 closed"}, detections: 1},
+	})
+
+	if detections[0].Keys["user"] != "alice" || detections[0].Keys["session"] != "s1" {
+		t.Errorf("Unexpected keys %v", detections[0].Keys)
+	}
+}
+
+func TestOrganization(t *testing.T) {
+
+	e, err := Build([]byte(testdata.TestSuccessOrgClusters))
+	if err != nil {
+		t.Fatalf("Error building evaluator: %v", err)
+	}
+
+	var (
+		cre    = "CRE-2025-0071"
+		outs   []DetectionT
+		inputs = []compiler.DetectionT{
+			{CreId: cre, Cluster: "a", Timestamp: 1 * sec},
+			{CreId: cre, Cluster: "b", Timestamp: 2 * sec},
+			{CreId: "CRE-2025-0072", Cluster: "c", Timestamp: 3 * sec},
+			{CreId: cre, Cluster: "c", Timestamp: 4 * sec},
+		}
+	)
+
+	for i, d := range inputs {
+		out, err := e.Detect(d)
+		if err != nil {
+			t.Fatalf("Detection %d: unexpected error %v", i, err)
+		}
+		outs = append(outs, out...)
+	}
+
+	if len(outs) != 1 {
+		t.Fatalf("Expected 1 detection, got %d", len(outs))
+	}
+
+	if !slices.Equal(outs[0].Clusters, []string{"a", "b", "c"}) || outs[0].Timestamp != 4*sec {
+		t.Errorf("Unexpected detection %+v", outs[0])
+	}
+}
+
+func TestOutOfOrder(t *testing.T) {
+
+	e, err := Build([]byte(testdata.TestSuccessBind))
+	if err != nil {
+		t.Fatalf("Error building evaluator: %v", err)
+	}
+
+	if _, err := e.Scan(EventT{Source: "cre.log.haproxy", Timestamp: 2 * sec}); err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if _, err := e.Scan(EventT{Source: "cre.log.haproxy", Timestamp: 1 * sec}); !errors.Is(err, ErrOutOfOrder) {
+		t.Errorf("Expected %v, got %v", ErrOutOfOrder, err)
+	}
+}
+
+func TestNested(t *testing.T) {
+
+	data, err := os.ReadFile("../testdata/success_examples/41-nested.yaml")
+	if err != nil {
+		t.Fatalf("Error reading rule: %v", err)
+	}
+
+	e, err := Build(data)
+	if err != nil {
+		t.Fatalf("Error building evaluator: %v", err)
+	}
+
+	var (
+		keys  = map[string]string{"hostname": "h1", "container_id": "c1"}
+		steps []stepT
+	)
+
+	for i := range 10 {
+		steps = append(steps, stepT{event: EventT{Source: "cre.log.rabbitmq", Timestamp: int64(i+1) * sec, Line: "Discarding message", Keys: keys}})
+	}
+
+	steps = append(steps,
+		stepT{event: EventT{Source: "cre.log.rabbitmq", Timestamp: 11 * sec, Line: "Mnesia overloaded", Keys: keys}},
+		stepT{event: EventT{Source: "cre.log.nginx", Timestamp: 12 * sec, Line: "error message", Keys: keys}},
+		stepT{event: EventT{Source: "cre.log.nginx", Timestamp: 12*sec + sec/2, Line: "shutdown", Keys: keys}},
+		stepT{event: EventT{Source: "cre.log.nginx", Timestamp: 13 * sec, Line: "memory at 90%", Keys: keys}},
+		stepT{event: EventT{Source: "cre.prequel.k8s", Timestamp: 14 * sec, Line: `{"reason":"Killing"}`, Keys: keys}},
+		stepT{clock: 60 * sec, detections: 1},
+	)
+
+	detections := run(t, e, steps)
+
+	// term1 and the three children of term3
+	matches := detections[0].Matches
+	if len(matches) != 4 {
+		t.Fatalf("Expected 4 log matcher matches, got %d", len(matches))
+	}
+
+	if !matches[0].Origin || len(matches[0].Events) != 11 {
+		t.Errorf("Expected the origin match with 11 events, got %+v", matches[0])
+	}
+}
+
+func TestTrace(t *testing.T) {
+
+	e, err := Build([]byte(testdata.TestSuccessBind), WithTrace())
+	if err != nil {
+		t.Fatalf("Error building evaluator: %v", err)
+	}
+
+	const source = "cre.log.haproxy"
+
+	run(t, e, []stepT{
+		{event: EventT{Source: source, Timestamp: 1 * sec, Line: "connection to host a failed"}},
+		{event: EventT{Source: source, Timestamp: 15 * sec, Line: "host a removed from pool"}},
+	})
+
+	trace := e.Trace()
+	if len(trace.Nodes) != 2 {
+		t.Fatalf("Expected 2 traced nodes, got %d", len(trace.Nodes))
+	}
+
+	n := trace.Nodes[1]
+	if n.Progress != 1 || n.Matches != 0 || len(n.Terms) != 2 {
+		t.Fatalf("Unexpected trace %+v", n)
+	}
+
+	if term := n.Terms[0]; len(term.Events) != 1 || term.Pos.Line != 15 || term.Pos.Col != 13 {
+		t.Errorf("Unexpected first term %+v", term)
+	}
+
+	if len(n.Expired) != 1 || n.Expired[0].Start != 1*sec || n.Expired[0].Timestamp != 11*sec || n.Expired[0].Progress != 1 {
+		t.Errorf("Unexpected expired windows %+v", n.Expired)
+	}
+
+	if report := trace.String(); !strings.Contains(report, "window opened at 1s expired at 11s after 1 of 2 terms") {
+		t.Errorf("Expected the expired window in the report:\n%s", report)
+	}
+}
+
+func TestTraceReset(t *testing.T) {
+
+	e, err := Build([]byte(testdata.TestSuccessRuleTests), WithTrace())
+	if err != nil {
+		t.Fatalf("Error building evaluator: %v", err)
+	}
+
+	const source = "cre.log.haproxy"
+
+	run(t, e, []stepT{
+		{event: EventT{Source: source, Timestamp: 1 * sec, Line: "connection to host a failed"}},
+		{event: EventT{Source: source, Timestamp: 3 * sec, Line: "host a removed from pool"}},
+		{event: EventT{Source: source, Timestamp: 5 * sec, Line: "pool drained"}},
+		{clock: 20 * sec},
+	})
+
+	n := e.Trace().Nodes[1]
+	if n.Progress != 2 || n.Matches != 0 {
+		t.Fatalf("Unexpected trace %+v", n)
+	}
+
+	if len(n.Resets) != 1 || n.Resets[0].TermIdx != 2 || n.Resets[0].Timestamp != 5*sec || n.Resets[0].Progress != 2 {
+		t.Errorf("Unexpected resets %+v", n.Resets)
+	}
+
+	plain, err := Build([]byte(testdata.TestSuccessBind))
+	if err != nil {
+		t.Fatalf("Error building evaluator: %v", err)
+	}
+
+	if plain.Trace() != nil {
+		t.Errorf("Expected no trace without WithTrace")
+	}
+}
+
+func TestDecodedAst(t *testing.T) {
+
+	tree, err := ast.Build([]byte(testdata.TestSuccessBind))
+	if err != nil {
+		t.Fatalf("Error building AST: %v", err)
+	}
+
+	data, err := json.Marshal(tree)
+	if err != nil {
+		t.Fatalf("Error encoding AST: %v", err)
+	}
+
+	var decoded ast.AstT
+	if err = json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Error decoding AST: %v", err)
+	}
+
+	e, err := New(&decoded)
+	if err != nil {
+		t.Fatalf("Error building evaluator: %v", err)
+	}
+
+	const source = "cre.log.haproxy"
+
+	run(t, e, []stepT{
+		{event: EventT{Source: source, Timestamp: 1 * sec, Line: "connection to host a failed"}},
+		{event: EventT{Source: source, Timestamp: 2 * sec, Line: "host a removed from pool"}, detections: 1},
+	})
+}
+
+func TestDedupe(t *testing.T) {
+
+	var steps = []stepT{
+		{event: EventT{Source: "cre.k8s", Timestamp: 1 * sec, Line: "OOMKilled"}, detections: 1},
+		{event: EventT{Source: "cre.k8s", Timestamp: 2 * sec, Line: "BackOff"}, detections: 1},
+	}
+
+	var (
+		results [][]DetectionT
+		cases   = []struct {
+			opts     []OptT
+			matchers int
+		}{
+			{matchers: 3},
+			{opts: []OptT{WithDedupe(), WithTrace()}, matchers: 2},
+		}
+	)
+
+	for _, c := range cases {
+
+		e, err := Build([]byte(testdata.TestSuccessSharedTerms), c.opts...)
+		if err != nil {
+			t.Fatalf("Error building evaluator: %v", err)
+		}
+
+		if len(e.sources["cre.k8s"]) != c.matchers {
+			t.Fatalf("Expected %d matchers, got %d", c.matchers, len(e.sources["cre.k8s"]))
+		}
+
+		results = append(results, run(t, e, steps))
+
+		if tr := e.Trace(); tr != nil && !strings.Contains(tr.String(), "9GJSdx4smGJeJCdiw6tiK5.d1.n1.t0") {
+			t.Errorf("Expected the dependent matcher in the trace:\n%s", tr.String())
+		}
+	}
+
+	if !reflect.DeepEqual(results[0], results[1]) {
+		t.Errorf("Detections differ with dedupe: %+v != %+v", results[0], results[1])
+	}
+
+	if d := results[1]; d[0].CreId != "TestSuccessSharedTerms1" || d[1].CreId != "TestSuccessSharedTerms2" || len(d[1].Matches) != 2 {
+		t.Errorf("Unexpected detections %+v", d)
+	}
+}
+
+func TestPrefilter(t *testing.T) {
+
+	var tests = map[string]struct {
+		rule   string
+		events []EventT
+		count  int
+	}{
+		"Regex": {
+			rule: testdata.TestSuccessRuleTests,
+			events: []EventT{
+				{Source: "cre.log.haproxy", Timestamp: 1 * sec, Line: "connection to host a failed"},
+				{Source: "cre.log.haproxy", Timestamp: 2 * sec, Line: "backend healthy"},
+				{Source: "cre.log.haproxy", Timestamp: 3 * sec, Line: "host a removed from pool"},
+				{Source: "cre.log.haproxy", Timestamp: 20 * sec, Line: "connection to host b failed"},
+				{Source: "cre.log.haproxy", Timestamp: 21 * sec, Line: "host b removed from pool"},
+				{Source: "cre.log.haproxy", Timestamp: 22 * sec, Line: "pool drained"},
+			},
+			count: 1,
+		},
+		"Shared": {
+			rule: testdata.TestSuccessSharedTerms,
+			events: []EventT{
+				{Source: "cre.k8s", Timestamp: 1 * sec, Line: "OOMKilled"},
+				{Source: "cre.k8s", Timestamp: 2 * sec, Line: "Started"},
+				{Source: "cre.k8s", Timestamp: 3 * sec, Line: "BackOff"},
+			},
+			count: 2,
+		},
+		"SharedPartial": {
+			rule: testdata.TestSuccessSharedTermsPartial,
+			events: []EventT{
+				{Source: "cre.k8s", Timestamp: 1 * sec, Line: "OOMKilled"},
+				{Source: "cre.k8s", Timestamp: 2 * sec, Line: "Started"},
+				{Source: "cre.k8s", Timestamp: 3 * sec, Line: "BackOff"},
+			},
+			count: 2,
+		},
+		"Correlations": {
+			rule: testdata.TestSuccessCorrelationKeys,
+			events: []EventT{
+				{Source: "rabbitmq", Timestamp: 1 * sec, Line: "Mnesia overloaded host=a", Keys: map[string]string{"container_id": "1"}},
+				{Source: "k8s", Timestamp: 2 * sec, Line: `{"reason":"NodeShutdown","involvedObject":{"nodeName":"a"}}`, Keys: map[string]string{"container_id": "1"}},
+			},
+			count: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+
+			var results [][]DetectionT
+
+			for _, opts := range [][]OptT{nil, {WithPrefilter()}, {WithPrefilter(), WithDedupe()}} {
+
+				e, err := Build([]byte(test.rule), opts...)
+				if err != nil {
+					t.Fatalf("Error building evaluator: %v", err)
+				}
+
+				var out []DetectionT
+				for i, ev := range test.events {
+					d, err := e.Scan(ev)
+					if err != nil {
+						t.Fatalf("Event %d: unexpected error %v", i, err)
+					}
+					out = append(out, d...)
+				}
+
+				d, err := e.Flush()
+				if err != nil {
+					t.Fatalf("Unexpected error %v", err)
+				}
+
+				results = append(results, append(out, d...))
+			}
+
+			if len(results[0]) != test.count {
+				t.Fatalf("Expected %d detections, got %d", test.count, len(results[0]))
+			}
+
+			for i := 1; i < len(results); i++ {
+				if !reflect.DeepEqual(results[0], results[i]) {
+					t.Errorf("Detections differ with the prefilter: %+v != %+v", results[0], results[i])
+				}
+			}
+		})
+	}
+}
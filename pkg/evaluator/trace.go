@@ -0,0 +1,375 @@
+package evaluator
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-compiler/pkg/compiler"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+	"github.com/prequel-dev/prequel-logmatch/pkg/match"
+)
+
+// Timestamps below this are reported as offsets, e.g. those of rule tests
+const traceEpoch = int64(365 * 24 * time.Hour)
+
+// TraceT explains why rules did or did not fire. For every node of the
+// rules it records the events each term matched, the negate terms that
+// reset a partial match, the windows that expired and the furthest progress
+// of a partial match.
+//
+// Progress follows a single partial match per node, the earliest one still
+// open, the way a reader walks a rule by hand. Term matches ignore counts
+// and bindings. It is a debugging aid, not a copy of the matcher state.
+type TraceT struct {
+	Nodes []*NodeTraceT `json:"nodes"` // Rules in tree order, nodes in pre-order
+	nodes map[string]*NodeTraceT
+}
+
+// NodeTraceT is the trace of a log matcher, machine or detection term.
+type NodeTraceT struct {
+	Address  string           `json:"address"`
+	Type     schema.NodeTypeT `json:"type"`
+	RuleId   string           `json:"rule_id"`
+	CreId    string           `json:"cre_id"`
+	Pos      pqerr.Pos        `json:"pos"`
+	Depth    uint32           `json:"depth"`
+	Window   int64            `json:"window,omitempty"`
+	Terms    []*TermTraceT    `json:"terms"`
+	Resets   []ResetTraceT    `json:"resets,omitempty"`
+	Expired  []ExpiryTraceT   `json:"expired,omitempty"`
+	Progress int              `json:"progress"` // Most positive terms matched by one partial match
+	Matches  int              `json:"matches"`  // Matches reported to the parent, or detections of a rule root
+
+	order    bool
+	positive int
+	negate   int64 // Longest negate window after a complete match
+	partial  *partialT
+	done     int64 // Timestamp of the last complete match
+}
+
+// TermTraceT is the trace of a term. Log terms record the events they
+// matched; the terms of machines record the matches of their children.
+type TermTraceT struct {
+	Idx     int       `json:"idx"`
+	Negate  bool      `json:"negate,omitempty"`
+	Pos     pqerr.Pos `json:"pos"`
+	Desc    string    `json:"desc"`
+	Events  []EventT  `json:"events,omitempty"`
+	Asserts []int64   `json:"asserts,omitempty"`
+	match   match.MatchFunc
+}
+
+// ResetTraceT is a negate term resetting a partial or complete match.
+type ResetTraceT struct {
+	TermIdx   int   `json:"term_idx"`
+	Timestamp int64 `json:"timestamp"`
+	Progress  int   `json:"progress"`
+}
+
+// ExpiryTraceT is a partial match whose window ran out.
+type ExpiryTraceT struct {
+	Start     int64 `json:"start"`
+	Timestamp int64 `json:"timestamp"`
+	Progress  int   `json:"progress"`
+}
+
+type partialT struct {
+	start int64
+	count int
+	seen  []bool
+}
+
+func newTrace(tree *ast.AstT) (*TraceT, error) {
+
+	var t = &TraceT{
+		nodes: make(map[string]*NodeTraceT),
+	}
+
+	for _, root := range tree.Nodes {
+		if err := t.add(root); err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+func (t *TraceT) add(node *ast.AstNodeT) error {
+
+	var n = &NodeTraceT{
+		Address: node.Metadata.Address.String(),
+		Type:    node.Metadata.Type,
+		RuleId:  node.Metadata.RuleId,
+		CreId:   node.Metadata.CreId,
+		Pos:     node.Metadata.Pos,
+		Depth:   node.Metadata.Address.GetDepth(),
+		done:    -1,
+	}
+
+	switch o := node.Object.(type) {
+	case *ast.AstLogMatcherT:
+		n.Window = o.Window.Nanoseconds()
+		n.order = node.Metadata.Type == schema.NodeTypeLogSeq
+		n.positive = len(o.Match)
+
+		for _, field := range o.Match {
+			if err := n.addField(field, false); err != nil {
+				return err
+			}
+		}
+		for _, field := range o.Negate {
+			if err := n.addField(field, true); err != nil {
+				return err
+			}
+			n.negate = max(n.negate, negateSpan(field.NegateOpts))
+		}
+
+	case *ast.AstSeqMatcherT:
+		n.Window = o.Window.Nanoseconds()
+		n.order = true
+		n.positive = len(o.Order)
+
+	case *ast.AstSetMatcherT:
+		n.Window = o.Window.Nanoseconds()
+		n.positive = len(o.Match)
+
+	case *ast.AstDetectionT:
+		n.positive = 1
+		n.Terms = append(n.Terms, &TermTraceT{
+			Pos:  node.Metadata.Pos,
+			Desc: o.String(),
+		})
+	}
+
+	for i, c := range node.Children {
+		n.Terms = append(n.Terms, &TermTraceT{
+			Idx:    i,
+			Negate: i >= n.positive,
+			Pos:    c.Metadata.Pos,
+			Desc:   fmt.Sprintf("%s %s", c.Metadata.Type, c.Metadata.Address.String()),
+		})
+		if i >= n.positive {
+			n.negate = max(n.negate, negateSpan(c.Metadata.NegateOpts))
+		}
+	}
+
+	t.Nodes = append(t.Nodes, n)
+	t.nodes[n.Address] = n
+
+	for _, c := range node.Children {
+		if err := t.add(c); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (n *NodeTraceT) addField(field ast.AstFieldT, negate bool) error {
+
+	m, err := compiler.TermMatcher(field)
+	if err != nil {
+		return err
+	}
+
+	n.Terms = append(n.Terms, &TermTraceT{
+		Idx:    len(n.Terms),
+		Negate: negate,
+		Pos:    field.Pos,
+		Desc:   field.String(),
+		match:  m,
+	})
+
+	return nil
+}
+
+// scan records the terms of a log matcher that match an event.
+func (t *TraceT) scan(address *ast.AstNodeAddressT, ev EventT) {
+
+	if t == nil {
+		return
+	}
+
+	n, ok := t.nodes[address.String()]
+	if !ok {
+		return
+	}
+
+	for _, term := range n.Terms {
+		if term.match == nil || !term.match(ev.Line) {
+			continue
+		}
+		term.Events = append(term.Events, ev)
+		n.step(term.Idx, ev.Timestamp)
+	}
+}
+
+// assert records the match of a child, or of a detection, by a machine term.
+func (t *TraceT) assert(address *ast.AstNodeAddressT, termIdx uint32, ts int64) {
+
+	if t == nil {
+		return
+	}
+
+	n, ok := t.nodes[address.String()]
+	if !ok || int(termIdx) >= len(n.Terms) {
+		return
+	}
+
+	n.Terms[termIdx].Asserts = append(n.Terms[termIdx].Asserts, ts)
+	n.step(int(termIdx), ts)
+}
+
+// matched counts a match reported by a node.
+func (t *TraceT) matched(address *ast.AstNodeAddressT) {
+
+	if t == nil {
+		return
+	}
+
+	if n, ok := t.nodes[address.String()]; ok {
+		n.Matches++
+	}
+}
+
+// tick expires the partial matches whose window ran out before clock.
+func (t *TraceT) tick(clock int64) {
+
+	if t == nil {
+		return
+	}
+
+	for _, n := range t.Nodes {
+		n.expire(clock)
+	}
+}
+
+func (n *NodeTraceT) step(idx int, ts int64) {
+
+	n.expire(ts)
+
+	if idx >= n.positive {
+		switch {
+		case n.partial != nil:
+			n.Resets = append(n.Resets, ResetTraceT{TermIdx: idx, Timestamp: ts, Progress: n.partial.count})
+			n.partial = nil
+		case n.done >= 0 && ts <= n.done+n.negate:
+			n.Resets = append(n.Resets, ResetTraceT{TermIdx: idx, Timestamp: ts, Progress: n.positive})
+			n.done = -1
+		}
+		return
+	}
+
+	var p = n.partial
+
+	if p == nil {
+		if n.order && idx != 0 {
+			return
+		}
+		p = &partialT{start: ts, seen: make([]bool, n.positive)}
+		n.partial = p
+	}
+
+	if p.seen[idx] || (n.order && idx != p.count) {
+		return
+	}
+
+	p.seen[idx] = true
+	p.count++
+	n.Progress = max(n.Progress, p.count)
+
+	if p.count == n.positive {
+		n.partial = nil
+		n.done = ts
+	}
+}
+
+func (n *NodeTraceT) expire(clock int64) {
+
+	var p = n.partial
+
+	if p == nil || n.Window == 0 || clock <= p.start+n.Window {
+		return
+	}
+
+	n.Expired = append(n.Expired, ExpiryTraceT{
+		Start:     p.start,
+		Timestamp: p.start + n.Window,
+		Progress:  p.count,
+	})
+	n.partial = nil
+}
+
+// Report writes the trace as indented text, one block per node, with the
+// positions of the nodes and terms in the rule document.
+func (t *TraceT) Report(w io.Writer) error {
+
+	var sb strings.Builder
+
+	for _, n := range t.Nodes {
+
+		var indent = strings.Repeat("  ", int(n.Depth))
+
+		if n.Depth == 0 {
+			fmt.Fprintf(&sb, "rule %s cre %s\n", n.RuleId, n.CreId)
+		}
+
+		fmt.Fprintf(&sb, "%s%s %s %s", indent, n.Type, posString(n.Pos), n.Address)
+		if n.Window > 0 {
+			fmt.Fprintf(&sb, " window %s", time.Duration(n.Window))
+		}
+		fmt.Fprintf(&sb, ": %d matches, furthest progress %d of %d terms\n", n.Matches, n.Progress, n.positive)
+
+		for _, term := range n.Terms {
+			var kind = "term"
+			if term.Negate {
+				kind = "negate"
+			}
+			fmt.Fprintf(&sb, "%s  %s %d %s %s: ", indent, kind, term.Idx, posString(term.Pos), term.Desc)
+			if term.match != nil {
+				fmt.Fprintf(&sb, "%d events\n", len(term.Events))
+			} else {
+				fmt.Fprintf(&sb, "%d matches\n", len(term.Asserts))
+			}
+			for _, ev := range term.Events {
+				fmt.Fprintf(&sb, "%s    %s %s %q\n", indent, timeString(ev.Timestamp), ev.Source, ev.Line)
+			}
+			for _, ts := range term.Asserts {
+				fmt.Fprintf(&sb, "%s    %s\n", indent, timeString(ts))
+			}
+		}
+
+		for _, r := range n.Resets {
+			fmt.Fprintf(&sb, "%s  negate %d reset at %s after %d of %d terms\n", indent, r.TermIdx, timeString(r.Timestamp), r.Progress, n.positive)
+		}
+
+		for _, x := range n.Expired {
+			fmt.Fprintf(&sb, "%s  window opened at %s expired at %s after %d of %d terms\n", indent, timeString(x.Start), timeString(x.Timestamp), x.Progress, n.positive)
+		}
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// String returns the text report of the trace.
+func (t *TraceT) String() string {
+	var sb strings.Builder
+	_ = t.Report(&sb)
+	return sb.String()
+}
+
+func posString(pos pqerr.Pos) string {
+	return fmt.Sprintf("line %d:%d", pos.Line, pos.Col)
+}
+
+func timeString(ts int64) string {
+	if ts < traceEpoch {
+		return time.Duration(ts).String()
+	}
+	return time.Unix(0, ts).UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,287 @@
+package format
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	indent = 2
+)
+
+// Key orders that differ from the struct field order. Everything else
+// follows the order of the fields in the parser structs.
+var keyOrder = map[reflect.Type][]string{
+	reflect.TypeOf(parser.ParseRuleT{}): {"cre", "metadata", "rule"},
+}
+
+// Keys holding durations that are rewritten in canonical form
+var durationKeys = map[string]struct{}{
+	"window": {},
+	"slide":  {},
+}
+
+// Format validates a rules document with parser.Read and returns it in
+// canonical style: block collections, minimal quoting, stable key order,
+// normalized durations and sorted terms. Comments are preserved.
+func Format(data []byte) ([]byte, error) {
+
+	var (
+		buf     bytes.Buffer
+		decoder = yaml.NewDecoder(bytes.NewReader(data))
+		encoder = yaml.NewEncoder(&buf)
+	)
+
+	// Duplicate ids are left for the rule pack checks
+	if _, err := parser.Read(bytes.NewReader(data), parser.WithStructureOnly()); err != nil {
+		return nil, err
+	}
+
+	encoder.SetIndent(indent)
+
+	for {
+		var doc yaml.Node
+		if err := decoder.Decode(&doc); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, err
+		}
+
+		if len(doc.Content) == 0 {
+			continue
+		}
+
+		canonical(doc.Content[0], reflect.TypeOf(parser.RulesT{}))
+
+		if err := encoder.Encode(&doc); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+
+	return separateSections(buf.Bytes()), nil
+}
+
+// separateSections puts a blank line after each multi-line top level section
+// of a document (e.g. before 'terms'), keeping head comments attached to the
+// key that follows.
+func separateSections(data []byte) []byte {
+
+	var (
+		lines = strings.SplitAfter(string(data), "\n")
+		out   = make([]string, 0, len(lines))
+		block bool // previous top level key has nested lines
+	)
+
+	for _, line := range lines {
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "---"):
+			block = false
+		case line[0] == ' ' || line[0] == '-':
+			block = true
+		case line[0] == '#' || line[0] == '\n':
+		default:
+			if block {
+				// Insert before any comment lines attached to this key
+				at := len(out)
+				for at > 0 && strings.HasPrefix(out[at-1], "#") {
+					at--
+				}
+				out = slices.Insert(out, at, "\n")
+			}
+			block = false
+		}
+		out = append(out, line)
+	}
+
+	return []byte(strings.Join(out, ""))
+}
+
+// Check reports whether data is already in canonical form.
+func Check(data []byte) (bool, error) {
+	formatted, err := Format(data)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(formatted, data), nil
+}
+
+// FormatReader formats the document read from rdr and writes it to wr.
+func FormatReader(rdr io.Reader, wr io.Writer) error {
+	data, err := io.ReadAll(rdr)
+	if err != nil {
+		return err
+	}
+
+	formatted, err := Format(data)
+	if err != nil {
+		return err
+	}
+
+	_, err = wr.Write(formatted)
+	return err
+}
+
+// canonical rewrites n in place against the parser type it decodes into.
+func canonical(n *yaml.Node, typ reflect.Type) {
+
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+
+	switch n.Kind {
+	case yaml.ScalarNode:
+		canonicalScalar(n)
+		return
+	case yaml.MappingNode, yaml.SequenceNode:
+		// Flow style collections are written as blocks
+		n.Style = 0
+	default:
+		return
+	}
+
+	switch typ.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		fields := structFields(typ)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			canonicalScalar(k)
+			if ft, ok := fields[k.Value]; ok {
+				canonical(v, ft)
+			}
+			if _, ok := durationKeys[k.Value]; ok && v.Kind == yaml.ScalarNode {
+				v.Value = canonicalDuration(v.Value)
+			}
+		}
+		sortPairs(n, fieldOrder(typ))
+
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, item := range n.Content {
+			canonical(item, typ.Elem())
+		}
+
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			canonicalScalar(n.Content[i])
+			canonical(n.Content[i+1], typ.Elem())
+		}
+		// Maps (e.g. terms) are sorted by key
+		sortPairs(n, nil)
+	}
+}
+
+// canonicalScalar drops explicit quoting; the encoder re-quotes values that
+// would otherwise change type. Multi-line strings keep block style.
+func canonicalScalar(n *yaml.Node) {
+	if n.Kind != yaml.ScalarNode {
+		return
+	}
+	if n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 && strings.Contains(n.Value, "\n") {
+		n.Style = yaml.LiteralStyle
+		return
+	}
+	n.Style = 0
+}
+
+// canonicalDuration rewrites durations in their shortest Go form, e.g.
+// 10000ms as 10s and 1h0m0s as 1h. Invalid durations are left for the parser to report.
+func canonicalDuration(v string) string {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return v
+	}
+
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+
+	return s
+}
+
+// sortPairs stably reorders the key/value pairs of a mapping. Keys listed in
+// order come first in that order; the rest follow sorted by key when order
+// is nil, or in their original order otherwise.
+func sortPairs(n *yaml.Node, order []string) {
+
+	type pairT struct {
+		k, v *yaml.Node
+	}
+
+	var pairs = make([]pairT, 0, len(n.Content)/2)
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		pairs = append(pairs, pairT{k: n.Content[i], v: n.Content[i+1]})
+	}
+
+	rank := func(key string) int {
+		if idx := slices.Index(order, key); idx >= 0 {
+			return idx
+		}
+		return len(order)
+	}
+
+	sort.SliceStable(pairs, func(i, j int) bool {
+		ri, rj := rank(pairs[i].k.Value), rank(pairs[j].k.Value)
+		if ri != rj {
+			return ri < rj
+		}
+		if order == nil {
+			return pairs[i].k.Value < pairs[j].k.Value
+		}
+		return false
+	})
+
+	n.Content = n.Content[:0]
+	for _, p := range pairs {
+		n.Content = append(n.Content, p.k, p.v)
+	}
+}
+
+// structFields maps yaml keys to field types, flattening inline fields.
+func structFields(typ reflect.Type) map[string]reflect.Type {
+	var fields = make(map[string]reflect.Type)
+	for _, f := range parser.YamlFields(typ) {
+		fields[f.Name] = f.Type
+	}
+	return fields
+}
+
+// fieldOrder returns the canonical key order for a struct type.
+func fieldOrder(typ reflect.Type) []string {
+	if order, ok := keyOrder[typ]; ok {
+		return order
+	}
+
+	var order []string
+	for _, f := range parser.YamlFields(typ) {
+		order = append(order, f.Name)
+	}
+
+	return order
+}
@@ -0,0 +1,121 @@
+package format
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/testdata"
+)
+
+func TestFormat(t *testing.T) {
+
+	out, err := Format([]byte(testdata.TestFormatUnformatted))
+	if err != nil {
+		t.Fatalf("Error formatting rule: %v", err)
+	}
+
+	if string(out) != testdata.TestFormatFormatted {
+		t.Errorf("formatted =\n%s\nwant\n%s", out, testdata.TestFormatFormatted)
+	}
+
+	ok, err := Check([]byte(testdata.TestFormatUnformatted))
+	if err != nil || ok {
+		t.Errorf("Expected unformatted document to fail check, got ok=%v err=%v", ok, err)
+	}
+
+	ok, err = Check([]byte(testdata.TestFormatFormatted))
+	if err != nil || !ok {
+		t.Errorf("Expected formatted document to pass check, got ok=%v err=%v", ok, err)
+	}
+}
+
+func TestFormatSuccessExamples(t *testing.T) {
+
+	rules, err := filepath.Glob(filepath.Join("../testdata", "success_examples", "*.yaml"))
+	if err != nil {
+		t.Fatalf("Error finding CRE test files: %v", err)
+	}
+
+	for _, rule := range rules {
+
+		testData, err := os.ReadFile(rule)
+		if err != nil {
+			t.Fatalf("Error reading test file %s: %v", rule, err)
+		}
+
+		once, err := Format(testData)
+		if err != nil {
+			t.Fatalf("Error formatting rule %s: %v", rule, err)
+		}
+
+		twice, err := Format(once)
+		if err != nil {
+			t.Fatalf("Error formatting rule %s: %v", rule, err)
+		}
+
+		if string(once) != string(twice) {
+			t.Errorf("Formatting %s is not idempotent:\n%s\n---\n%s", rule, once, twice)
+		}
+
+		// Formatting must not change what the rule means
+		if _, err = parser.Parse(once, parser.WithGenIds()); err != nil {
+			t.Errorf("Error parsing formatted rule %s: %v", rule, err)
+		}
+
+		checkSemantics(t, testData, once)
+	}
+}
+
+func TestFormatQuotedScalars(t *testing.T) {
+
+	var data = []byte(testdata.TestFormatQuotedScalars)
+
+	out, err := Format(data)
+	if err != nil {
+		t.Fatalf("Error formatting rule: %v", err)
+	}
+
+	checkSemantics(t, data, out)
+}
+
+// checkSemantics fails unless every rule of formatted has the semantic hash
+// of the same rule in data.
+func checkSemantics(t *testing.T, data, formatted []byte) {
+
+	t.Helper()
+
+	var (
+		want = semanticHashes(t, data)
+		got  = semanticHashes(t, formatted)
+	)
+
+	if !slices.Equal(want, got) {
+		t.Errorf("Formatting changed the rules:\n%s", formatted)
+	}
+}
+
+func semanticHashes(t *testing.T, data []byte) []string {
+
+	t.Helper()
+
+	rules, err := parser.Read(bytes.NewReader(data), parser.WithStructureOnly())
+	if err != nil {
+		t.Fatalf("Error reading rules: %v", err)
+	}
+
+	var hashes = make([]string, 0, len(rules.Rules))
+
+	for _, rule := range rules.Rules {
+		hash, err := parser.HashRuleSemantic(rule, rules.TermsT)
+		if err != nil {
+			t.Fatalf("Error hashing rule %s: %v", rule.Cre.Id, err)
+		}
+		hashes = append(hashes, hash)
+	}
+
+	return hashes
+}
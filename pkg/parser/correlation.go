@@ -0,0 +1,119 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+)
+
+var (
+	ErrCorrelationName  = errors.New("invalid correlation name")
+	ErrCorrelationKey   = errors.New("correlation key must set exactly one of 'field', 'jq' or 'regex'")
+	ErrCorrelationRegex = errors.New("correlation key 'regex' must compile and have a capture group")
+)
+
+// CorrelationT defines how the value of a correlation key is extracted from
+// the events of each source.
+type CorrelationT struct {
+	Name    string                     `json:"name"`
+	Sources map[string]CorrelationKeyT `json:"sources"`
+}
+
+type CorrelationKeyT struct {
+	Field string `json:"field,omitempty"`
+	Jq    string `json:"jq,omitempty"`
+	Regex string `json:"regex,omitempty"` // Captures the group named after the correlation, or the first group
+}
+
+// correlationDefs returns the correlations of a set or sequence. Names only
+// in names, e.g. from structs built without the YAML decoder, are
+// correlations without sources.
+func correlationDefs(names []string, keys []ParseCorrelationT) []ParseCorrelationT {
+
+	var defs = slices.Clone(keys)
+
+	for _, name := range names {
+		if !slices.ContainsFunc(keys, func(k ParseCorrelationT) bool { return k.Name == name }) {
+			defs = append(defs, ParseCorrelationT{Name: name})
+		}
+	}
+
+	return defs
+}
+
+// correlations validates the correlations of a set or sequence and returns
+// their names along with the keys of those that define sources.
+func correlations(node *NodeT, corrs []ParseCorrelationT) ([]string, []CorrelationT, error) {
+
+	var (
+		names = make([]string, 0, len(corrs))
+		keys  []CorrelationT
+		seen  = make(map[string]struct{}, len(corrs))
+	)
+
+	wrap := func(pos pqerr.Pos, err error) error {
+		return pqerr.Wrap(pos, node.Metadata.RuleId, node.Metadata.RuleHash, node.Metadata.CreId, err)
+	}
+
+	for _, corr := range corrs {
+
+		if corr.Name == "" {
+			return nil, nil, wrap(corr.Pos, ErrCorrelationName)
+		}
+
+		if _, ok := seen[corr.Name]; ok {
+			return nil, nil, wrap(corr.Pos, fmt.Errorf("%w: duplicate %q", ErrCorrelationName, corr.Name))
+		}
+		seen[corr.Name] = struct{}{}
+
+		names = append(names, corr.Name)
+
+		if len(corr.Sources) == 0 {
+			continue
+		}
+
+		var c = CorrelationT{
+			Name:    corr.Name,
+			Sources: make(map[string]CorrelationKeyT, len(corr.Sources)),
+		}
+
+		for source, key := range corr.Sources {
+			if err := checkCorrelationKey(key); err != nil {
+				return nil, nil, wrap(corr.Pos, fmt.Errorf("%w: source %s", err, source))
+			}
+			c.Sources[source] = CorrelationKeyT(key)
+		}
+
+		keys = append(keys, c)
+	}
+
+	return names, keys, nil
+}
+
+func checkCorrelationKey(key ParseCorrelationKeyT) error {
+
+	var count int
+	for _, v := range []string{key.Field, key.Jq, key.Regex} {
+		if v != "" {
+			count++
+		}
+	}
+
+	if count != 1 {
+		return ErrCorrelationKey
+	}
+
+	if key.Regex == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(key.Regex)
+	if err != nil || re.NumSubexp() == 0 {
+		return ErrCorrelationRegex
+	}
+
+	return nil
+}
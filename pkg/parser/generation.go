@@ -0,0 +1,115 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+)
+
+var (
+	ErrGenerationNotBumped = errors.New("rule changed without generation bump")
+	ErrGenerationDecreased = errors.New("rule generation decreased")
+	ErrRuleIdReused        = errors.New("rule id reused for a different cre")
+)
+
+// CheckGenerations compares the rules in next against prev by metadata.id.
+// It reports rules whose logic or hash changed without a generation increase,
+// rules whose generation went down and ids reused for a different CRE. Rules
+// only present on one side are ignored. The result is a pqerr.List, or nil
+// when next is a valid successor of prev.
+func CheckGenerations(prev, next *RulesT) error {
+
+	var (
+		errs    pqerr.List
+		prevIds = make(map[string]ParseRuleT, len(prev.Rules))
+	)
+
+	for _, rule := range prev.Rules {
+		prevIds[genRuleId(rule)] = rule
+	}
+
+	for i, rule := range next.Rules {
+
+		var (
+			id      = genRuleId(rule)
+			old, ok = prevIds[id]
+		)
+
+		if !ok {
+			continue
+		}
+
+		wrap := func(err error, msg string) {
+			errs.Add(pqerr.Wrap(rulePos(next, i), id, rule.Metadata.Hash, rule.Cre.Id, err, msg))
+		}
+
+		if old.Cre.Id != rule.Cre.Id {
+			wrap(ErrRuleIdReused, fmt.Sprintf("rule id %s was cre %s", id, old.Cre.Id))
+			continue
+		}
+
+		if rule.Metadata.Gen < old.Metadata.Gen {
+			wrap(ErrGenerationDecreased, fmt.Sprintf("generation %d is lower than %d", rule.Metadata.Gen, old.Metadata.Gen))
+			continue
+		}
+
+		if rule.Metadata.Gen > old.Metadata.Gen {
+			continue
+		}
+
+		changed, err := ruleChanged(old, prev.TermsT, rule, next.TermsT)
+		if err != nil {
+			wrap(err, "")
+			continue
+		}
+
+		if changed {
+			wrap(ErrGenerationNotBumped, fmt.Sprintf("generation %d unchanged", rule.Metadata.Gen))
+		}
+	}
+
+	return errs.Err()
+}
+
+// genRuleId mirrors WithGenIds, which derives missing ids from the CRE id.
+func genRuleId(rule ParseRuleT) string {
+	if rule.Metadata.Id == "" {
+		return Hash(rule.Cre.Id)
+	}
+	return rule.Metadata.Id
+}
+
+// ruleChanged reports whether the explicit hash or the semantic hash of a
+// rule differs between the two rule sets.
+func ruleChanged(old ParseRuleT, oldTerms map[string]ParseTermT, rule ParseRuleT, terms map[string]ParseTermT) (bool, error) {
+
+	if old.Metadata.Hash != "" && rule.Metadata.Hash != "" && old.Metadata.Hash != rule.Metadata.Hash {
+		return true, nil
+	}
+
+	oldHash, err := HashRuleSemantic(old, oldTerms)
+	if err != nil {
+		return false, err
+	}
+
+	hash, err := HashRuleSemantic(rule, terms)
+	if err != nil {
+		return false, err
+	}
+
+	return oldHash != hash, nil
+}
+
+// rulePos returns the position of the idx'th rule recorded by Read or
+// Unmarshal, or an empty position for rules built by hand.
+func rulePos(rules *RulesT, idx int) pqerr.Pos {
+
+	if len(rules.RuleNodes) != len(rules.Rules) {
+		return pqerr.Pos{}
+	}
+
+	n := rules.RuleNodes[idx]
+
+	return pqerr.Pos{Line: n.Line, Col: n.Column}
+}
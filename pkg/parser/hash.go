@@ -0,0 +1,325 @@
+package parser
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/btcsuite/btcutil/base58"
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+)
+
+// The semantic form of a rule: terms expanded, durations in nanoseconds and
+// fields that do not change detection behavior dropped. Field order is fixed
+// by these structs so the JSON encoding is deterministic.
+
+type semTermT struct {
+	Field     string            `json:"field,omitempty"`
+	Value     string            `json:"value,omitempty"`
+	Jq        string            `json:"jq,omitempty"`
+	Regex     string            `json:"regex,omitempty"`
+	Count     int               `json:"count,omitempty"`
+	Fields    []semFieldT       `json:"fields,omitempty"`
+	Exclude   []semTermT        `json:"exclude,omitempty"`
+	Bind      map[string]string `json:"bind,omitempty"`
+	Detection *semDetectionT    `json:"detection,omitempty"`
+	Set       *semGroupT        `json:"set,omitempty"`
+	Sequence  *semGroupT        `json:"sequence,omitempty"`
+	Negate    *semNegateT       `json:"negate_opts,omitempty"`
+}
+
+type semFieldT struct {
+	Field string `json:"field"`
+	Value string `json:"value,omitempty"`
+	Jq    string `json:"jq,omitempty"`
+	Regex string `json:"regex,omitempty"`
+}
+
+type semGroupT struct {
+	Window       string            `json:"window"`
+	Scope        string            `json:"scope,omitempty"`
+	Correlations []semCorrelationT `json:"correlations,omitempty"`
+	Event        *ParseEventT      `json:"event,omitempty"`
+	Origin       bool              `json:"origin,omitempty"`
+	Match        []semTermT        `json:"match"`
+	Negate       []semTermT        `json:"negate,omitempty"`
+}
+
+type semDetectionT struct {
+	Cre      string `json:"cre"`
+	Cluster  string `json:"cluster,omitempty"`
+	Clusters int    `json:"clusters,omitempty"`
+}
+
+type semCorrelationT struct {
+	Name    string               `json:"name"`
+	Sources map[string]semFieldT `json:"sources,omitempty"`
+}
+
+type semNegateT struct {
+	Window   string `json:"window,omitempty"`
+	Slide    string `json:"slide,omitempty"`
+	Anchor   uint32 `json:"anchor,omitempty"`
+	Absolute bool   `json:"absolute,omitempty"`
+}
+
+type semRuleT struct {
+	Set      *semGroupT `json:"set,omitempty"`
+	Sequence *semGroupT `json:"sequence,omitempty"`
+}
+
+// HashRuleSemantic hashes the detection logic of a rule. Formatting, metadata,
+// CRE fields, duration spelling (10s vs 10000ms) and whether a term is inlined
+// or referenced by name do not change the result.
+func HashRuleSemantic(r ParseRuleT, termsT map[string]ParseTermT) (string, error) {
+
+	var (
+		sem  semRuleT
+		res  = &semResolverT{termsT: termsT, stack: make(map[string]bool)}
+		data []byte
+		err  error
+	)
+
+	if r.Rule.Set != nil {
+		if sem.Set, err = res.set(r.Rule.Set); err != nil {
+			return "", err
+		}
+	}
+
+	if r.Rule.Sequence != nil {
+		if sem.Sequence, err = res.sequence(r.Rule.Sequence); err != nil {
+			return "", err
+		}
+	}
+
+	if data, err = json.Marshal(sem); err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(data)
+
+	return base58.Encode(hash[:]), nil
+}
+
+type semResolverT struct {
+	termsT map[string]ParseTermT
+	stack  map[string]bool
+}
+
+// semDuration returns a duration in nanoseconds. Invalid durations are kept
+// as written; buildTree reports them with their position.
+func semDuration(v string) string {
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return v
+	}
+	return strconv.FormatInt(d.Nanoseconds(), 10)
+}
+
+// semScope drops the default cluster scope.
+func semScope(scope string) string {
+	if scope == schema.ScopeCluster {
+		return ""
+	}
+	return scope
+}
+
+func semCorrelations(c []ParseCorrelationT) []semCorrelationT {
+	if len(c) == 0 {
+		return nil
+	}
+
+	var corrs = make([]semCorrelationT, 0, len(c))
+
+	for _, corr := range c {
+		sc := semCorrelationT{Name: corr.Name}
+		for source, key := range corr.Sources {
+			if sc.Sources == nil {
+				sc.Sources = make(map[string]semFieldT, len(corr.Sources))
+			}
+			sc.Sources[source] = semFieldT{Field: key.Field, Jq: key.Jq, Regex: key.Regex}
+		}
+		corrs = append(corrs, sc)
+	}
+
+	// Correlation keys are matched as a set
+	slices.SortFunc(corrs, func(a, b semCorrelationT) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return slices.CompactFunc(corrs, func(a, b semCorrelationT) bool {
+		return a.Name == b.Name && maps.Equal(a.Sources, b.Sources)
+	})
+}
+
+func (res *semResolverT) set(set *ParseSetT) (*semGroupT, error) {
+
+	var (
+		g = &semGroupT{
+			Window:       semDuration(set.Window),
+			Scope:        semScope(set.Scope),
+			Event:        set.Event,
+			Correlations: semCorrelations(correlationDefs(set.Correlations, set.CorrelationKeys)),
+		}
+		err error
+	)
+
+	if g.Match, err = res.terms(set.Match); err != nil {
+		return nil, err
+	}
+
+	if g.Negate, err = res.terms(set.Negate); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+func (res *semResolverT) sequence(seq *ParseSequenceT) (*semGroupT, error) {
+
+	var (
+		g = &semGroupT{
+			Window:       semDuration(seq.Window),
+			Scope:        semScope(seq.Scope),
+			Event:        seq.Event,
+			Origin:       seq.Origin,
+			Correlations: semCorrelations(correlationDefs(seq.Correlations, seq.CorrelationKeys)),
+		}
+		err error
+	)
+
+	if g.Match, err = res.terms(seq.Order); err != nil {
+		return nil, err
+	}
+
+	if g.Negate, err = res.terms(seq.Negate); err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+func (res *semResolverT) terms(terms []ParseTermT) ([]semTermT, error) {
+
+	if len(terms) == 0 {
+		return nil, nil
+	}
+
+	var out = make([]semTermT, 0, len(terms))
+
+	for _, term := range terms {
+		t, err := res.term(term)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, t)
+	}
+
+	return out, nil
+}
+
+// term expands named terms the same way buildChildren does, including
+// negate options on the reference overriding those of the definition.
+func (res *semResolverT) term(term ParseTermT) (semTermT, error) {
+
+	var (
+		t   = term
+		sem semTermT
+		err error
+	)
+
+	if name := term.StrValue; name != "" {
+		if resolved, ok := res.termsT[name]; ok {
+			if res.stack[name] {
+				return semTermT{}, fmt.Errorf("%w: %s", ErrTermCycle, name)
+			}
+			res.stack[name] = true
+			defer delete(res.stack, name)
+
+			t = resolved
+			if term.NegateOpts != nil {
+				t.NegateOpts = term.NegateOpts
+			}
+		}
+	}
+
+	sem = semTermT{
+		Field: t.Field,
+		Value: t.StrValue,
+		Jq:    t.JqValue,
+		Regex: t.RegexValue,
+		Bind:  t.Bind,
+	}
+
+	for _, f := range t.Fields {
+		sem.Fields = append(sem.Fields, semFieldT{
+			Field: f.Field,
+			Value: f.StrValue,
+			Jq:    f.JqValue,
+			Regex: f.RegexValue,
+		})
+	}
+
+	if d := t.Detection; d != nil {
+		sem.Detection = &semDetectionT{Cre: d.Cre, Cluster: d.Cluster}
+		// As with count, zero or one cluster both mean any cluster
+		if d.Clusters > 1 {
+			sem.Detection.Clusters = d.Clusters
+		}
+	}
+
+	if sem.Exclude, err = res.terms(t.Exclude); err != nil {
+		return semTermT{}, err
+	}
+
+	// A count of zero or one both mean a single match
+	if t.Count > 1 {
+		sem.Count = t.Count
+	}
+
+	if t.Set != nil {
+		if sem.Set, err = res.set(t.Set); err != nil {
+			return semTermT{}, err
+		}
+	}
+
+	if t.Sequence != nil {
+		if sem.Sequence, err = res.sequence(t.Sequence); err != nil {
+			return semTermT{}, err
+		}
+	}
+
+	if t.NegateOpts != nil {
+		sem.Negate = semNegateOpts(t.NegateOpts)
+	}
+
+	return sem, nil
+}
+
+func semNegateOpts(opts *ParseNegateOptsT) *semNegateT {
+
+	var n = &semNegateT{
+		Anchor:   opts.Anchor,
+		Absolute: opts.Absolute,
+	}
+
+	if d := semDuration(opts.Window); d != "0" {
+		n.Window = d
+	}
+
+	if d := semDuration(opts.Slide); d != "0" {
+		n.Slide = d
+	}
+
+	// Zero options behave the same as no options
+	if *n == (semNegateT{}) {
+		return nil
+	}
+
+	return n
+}
@@ -0,0 +1,478 @@
+package parser
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	JSONSchemaDraft = "https://json-schema.org/draft/2020-12/schema"
+	JSONSchemaTitle = "CRE rules document"
+	defsPrefix      = "#/$defs/"
+)
+
+var (
+	ErrSchemaViolation = errors.New("schema violation")
+)
+
+// Scopes that may be declared on a rule
+const scopePattern = `^(cluster|organization)$`
+
+// Go duration strings as accepted by time.ParseDuration, e.g. 10s, 1m30s or -8s
+const durationPattern = `^[-+]?(0|([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+)$`
+
+// JSONSchemaT is the subset of JSON Schema (draft 2020-12) used to describe
+// the rule document format.
+type JSONSchemaT struct {
+	Schema               string                  `json:"$schema,omitempty"`
+	Title                string                  `json:"title,omitempty"`
+	Description          string                  `json:"description,omitempty"`
+	Ref                  string                  `json:"$ref,omitempty"`
+	Type                 string                  `json:"type,omitempty"`
+	Const                any                     `json:"const,omitempty"`
+	Pattern              string                  `json:"pattern,omitempty"`
+	Minimum              *int64                  `json:"minimum,omitempty"`
+	Maximum              *int64                  `json:"maximum,omitempty"`
+	MinProperties        *int                    `json:"minProperties,omitempty"`
+	MaxProperties        *int                    `json:"maxProperties,omitempty"`
+	Required             []string                `json:"required,omitempty"`
+	Properties           map[string]*JSONSchemaT `json:"properties,omitempty"`
+	AdditionalProperties any                     `json:"additionalProperties,omitempty"` // bool or *JSONSchemaT
+	Items                *JSONSchemaT            `json:"items,omitempty"`
+	OneOf                []*JSONSchemaT          `json:"oneOf,omitempty"`
+	If                   *JSONSchemaT            `json:"if,omitempty"`
+	Then                 *JSONSchemaT            `json:"then,omitempty"`
+	Else                 *JSONSchemaT            `json:"else,omitempty"`
+	Defs                 map[string]*JSONSchemaT `json:"$defs,omitempty"`
+	pattern              *regexp.Regexp          // Compiled Pattern, see patternRegexp
+}
+
+// Constraints that cannot be derived from the struct definitions, keyed by
+// definition name and yaml key.
+var schemaHints = map[string]map[string]JSONSchemaT{
+	"Rule": {
+		"": {Required: []string{"cre", "rule"}},
+	},
+	"RuleMetadata": {
+		"id":   {Pattern: validBase58IdRegex.String(), Description: "Stable base58 rule identifier"},
+		"hash": {Pattern: validBase58IdRegex.String(), Description: "Base58 hash of the rule logic"},
+	},
+	"Cre": {
+		"":         {Required: []string{"id"}},
+		"id":       {Pattern: validCreIdRegex.String()},
+		"severity": {Maximum: ptr(int64(SeverityInfo)), Description: "0=critical, 1=high, 2=medium, 3=low, 4=info"},
+	},
+	"RuleData": {
+		"": {MinProperties: ptr(1), MaxProperties: ptr(1), Description: "Exactly one of 'set' or 'sequence'"},
+	},
+	"Sequence": {
+		"":       {Required: []string{"window", "order"}},
+		"window": {Pattern: durationPattern},
+		"scope":  {Pattern: scopePattern},
+	},
+	"Set": {
+		"":       {Required: []string{"match"}},
+		"window": {Pattern: durationPattern},
+		"scope":  {Pattern: scopePattern},
+	},
+	"Term": {
+		"window": {Pattern: durationPattern, Description: "Negate window"},
+		"slide":  {Pattern: durationPattern, Description: "Negate slide relative to the anchor"},
+	},
+	"Event": {
+		"": {Required: []string{"source"}},
+	},
+	"Detection": {
+		"":         {Required: []string{"cre"}},
+		"cre":      {Pattern: validCreIdRegex.String()},
+		"clusters": {Minimum: ptr(int64(0)), Description: "Distinct clusters required within the window"},
+	},
+	"Predicate": {
+		"": {Required: []string{"field"}, MaxProperties: ptr(2), Description: "A field and at most one of 'value', 'jq' or 'regex'"},
+	},
+	"Correlation": {
+		"":        {Required: []string{"name"}},
+		"sources": {Description: "Key extraction per event source"},
+	},
+	"CorrelationKey": {
+		"": {MinProperties: ptr(1), MaxProperties: ptr(1), Description: "Exactly one of 'field', 'jq' or 'regex'"},
+	},
+	"Test": {
+		"":       {Required: []string{"events"}},
+		"events": {Description: "Sample events per event source"},
+		"expect": {Description: "CRE ids the events must detect"},
+	},
+	"Counterexample": {
+		"":       {Required: []string{"events"}},
+		"events": {Description: "Sample events per event source that must not detect the expected CREs"},
+	},
+	"TestEvent": {
+		"":          {Required: []string{"timestamp", "line"}},
+		"timestamp": {Description: "RFC 3339 time or a duration offset, e.g. 1m30s"},
+	},
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
+
+type schemaGenT struct {
+	defs map[string]*JSONSchemaT
+}
+
+// Types whose custom unmarshaller also accepts a bare string
+var stringShorthand = map[reflect.Type]struct{}{
+	reflect.TypeOf(ParseTermT{}):        {},
+	reflect.TypeOf(ParseCorrelationT{}): {},
+}
+
+// defName maps ParseRuleT to Rule, RulesT to Rules, etc.
+func defName(typ reflect.Type) string {
+	return strings.TrimSuffix(strings.TrimPrefix(typ.Name(), "Parse"), "T")
+}
+
+func (g *schemaGenT) typeSchema(typ reflect.Type) *JSONSchemaT {
+
+	typ = derefType(typ)
+
+	switch typ.Kind() {
+	case reflect.String:
+		return &JSONSchemaT{Type: "string"}
+	case reflect.Bool:
+		return &JSONSchemaT{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &JSONSchemaT{Type: "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &JSONSchemaT{Type: "integer", Minimum: ptr(int64(0))}
+	case reflect.Slice:
+		return &JSONSchemaT{Type: "array", Items: g.typeSchema(typ.Elem())}
+	case reflect.Map:
+		return &JSONSchemaT{Type: "object", AdditionalProperties: g.typeSchema(typ.Elem())}
+	case reflect.Struct:
+		ref := &JSONSchemaT{Ref: defsPrefix + g.structDef(typ)}
+		// Terms and correlations accept the bare string shorthand
+		if _, ok := stringShorthand[typ]; ok {
+			return &JSONSchemaT{OneOf: []*JSONSchemaT{{Type: "string"}, ref}}
+		}
+		return ref
+	}
+
+	return &JSONSchemaT{}
+}
+
+func (g *schemaGenT) structDef(typ reflect.Type) string {
+
+	name := defName(typ)
+	if _, ok := g.defs[name]; ok {
+		return name
+	}
+
+	def := &JSONSchemaT{
+		Type:                 "object",
+		Properties:           make(map[string]*JSONSchemaT),
+		AdditionalProperties: false,
+	}
+
+	// Register before recursing so self-referencing types terminate
+	g.defs[name] = def
+
+	for key, ft := range yamlFields(typ) {
+		prop := g.typeSchema(ft)
+		if hint, ok := schemaHints[name][key]; ok {
+			prop.Pattern = hint.Pattern
+			prop.Description = hint.Description
+			if hint.Maximum != nil {
+				prop.Maximum = hint.Maximum
+			}
+			if hint.Minimum != nil {
+				prop.Minimum = hint.Minimum
+			}
+		}
+		def.Properties[key] = prop
+	}
+
+	if hint, ok := schemaHints[name][""]; ok {
+		def.Required = hint.Required
+		def.MinProperties = hint.MinProperties
+		def.MaxProperties = hint.MaxProperties
+		def.Description = hint.Description
+	}
+
+	return name
+}
+
+// NewJSONSchema builds the JSON Schema for a rule document from the parser
+// structs. A document is either a rules document or a 'section: version' footer.
+func NewJSONSchema() *JSONSchemaT {
+
+	var (
+		g = &schemaGenT{
+			defs: make(map[string]*JSONSchemaT),
+		}
+		rules = g.structDef(reflect.TypeOf(RulesT{}))
+	)
+
+	g.defs[rules].Required = []string{docRules}
+
+	g.defs["VersionFooter"] = &JSONSchemaT{
+		Type:     "object",
+		Required: []string{docSection},
+		Properties: map[string]*JSONSchemaT{
+			docSection: {Const: docVersion},
+		},
+		Description: "Version footer document; ignored by the parser",
+	}
+
+	return &JSONSchemaT{
+		Schema: JSONSchemaDraft,
+		Title:  JSONSchemaTitle,
+		If:     &JSONSchemaT{Required: []string{docSection}},
+		Then:   &JSONSchemaT{Ref: defsPrefix + "VersionFooter"},
+		Else:   &JSONSchemaT{Ref: defsPrefix + rules},
+		Defs:   g.defs,
+	}
+}
+
+// JSONSchema returns the indented JSON encoding of NewJSONSchema.
+func JSONSchema() ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := json.NewEncoder(&buf)
+	enc.SetIndent("", "  ")
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(NewJSONSchema()); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// ValidateSchema validates every document in rdr against NewJSONSchema and
+// returns a pqerr.List with the position of each violation.
+func ValidateSchema(rdr io.Reader) error {
+
+	var (
+		schema  = NewJSONSchema()
+		decoder = yaml.NewDecoder(rdr)
+		errs    pqerr.List
+	)
+
+	for {
+		var doc yaml.Node
+		if err := decoder.Decode(&doc); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return err
+		}
+
+		if len(doc.Content) == 0 {
+			continue
+		}
+
+		errs = append(errs, schema.validate(schema, doc.Content[0], "document")...)
+	}
+
+	return errs.Err()
+}
+
+func (s *JSONSchemaT) resolve(root *JSONSchemaT) *JSONSchemaT {
+	for s.Ref != "" {
+		s = root.Defs[strings.TrimPrefix(s.Ref, defsPrefix)]
+	}
+	return s
+}
+
+// patternRegexp compiles Pattern on first use; a schema node is then
+// validated against any number of scalars without recompiling it.
+func (s *JSONSchemaT) patternRegexp() *regexp.Regexp {
+	if s.pattern == nil {
+		s.pattern = regexp.MustCompile(s.Pattern)
+	}
+	return s.pattern
+}
+
+func schemaError(n *yaml.Node, format string, args ...any) *pqerr.Error {
+	return &pqerr.Error{
+		Pos: pqerr.Pos{Line: n.Line, Col: n.Column},
+		Msg: fmt.Sprintf(format, args...),
+		Err: ErrSchemaViolation,
+	}
+}
+
+func nodeMatchesType(n *yaml.Node, typ string) bool {
+	switch typ {
+	case "":
+		return true
+	case "object":
+		return n.Kind == yaml.MappingNode
+	case "array":
+		return n.Kind == yaml.SequenceNode
+	case "string":
+		// Like the decoder, accept any non-null scalar for strings
+		return n.Kind == yaml.ScalarNode && n.Tag != "!!null"
+	case "integer":
+		return n.Kind == yaml.ScalarNode && n.Tag == "!!int"
+	case "boolean":
+		return n.Kind == yaml.ScalarNode && n.Tag == "!!bool"
+	}
+	return false
+}
+
+// validate checks n against s, resolving references against root.
+func (root *JSONSchemaT) validate(s *JSONSchemaT, n *yaml.Node, where string) pqerr.List {
+
+	var errs pqerr.List
+
+	for n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+
+	s = s.resolve(root)
+
+	if len(s.OneOf) > 0 {
+		return root.validateOneOf(s, n, where)
+	}
+
+	if s.If != nil {
+		if len(root.validate(s.If, n, where)) == 0 {
+			return root.validate(s.Then, n, where)
+		}
+		return root.validate(s.Else, n, where)
+	}
+
+	if !nodeMatchesType(n, s.Type) {
+		return append(errs, schemaError(n, "'%s' must be of type %s", where, s.Type))
+	}
+
+	if s.Const != nil && n.Value != fmt.Sprint(s.Const) {
+		errs = append(errs, schemaError(n, "'%s' must be %q", where, s.Const))
+	}
+
+	if s.Pattern != "" && n.Kind == yaml.ScalarNode && !s.patternRegexp().MatchString(n.Value) {
+		errs = append(errs, schemaError(n, "'%s' value %q does not match pattern %s", where, n.Value, s.Pattern))
+	}
+
+	if n.Tag == "!!int" {
+		var v int64
+		if err := n.Decode(&v); err == nil {
+			if s.Minimum != nil && v < *s.Minimum {
+				errs = append(errs, schemaError(n, "'%s' must be >= %d", where, *s.Minimum))
+			}
+			if s.Maximum != nil && v > *s.Maximum {
+				errs = append(errs, schemaError(n, "'%s' must be <= %d", where, *s.Maximum))
+			}
+		}
+	}
+
+	switch n.Kind {
+	case yaml.SequenceNode:
+		if s.Items != nil {
+			for _, item := range n.Content {
+				errs = append(errs, root.validate(s.Items, item, where)...)
+			}
+		}
+	case yaml.MappingNode:
+		errs = append(errs, root.validateObject(s, n, where)...)
+	}
+
+	return errs
+}
+
+func (root *JSONSchemaT) validateObject(s *JSONSchemaT, n *yaml.Node, where string) pqerr.List {
+
+	var (
+		errs pqerr.List
+		keys = make([]string, 0, len(n.Content)/2)
+	)
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		k, v := n.Content[i], n.Content[i+1]
+		keys = append(keys, k.Value)
+
+		if prop, ok := s.Properties[k.Value]; ok {
+			errs = append(errs, root.validate(prop, v, k.Value)...)
+			continue
+		}
+
+		switch additional := s.AdditionalProperties.(type) {
+		case bool:
+			if !additional {
+				errs = append(errs, schemaError(k, "unknown key %q in '%s'", k.Value, where))
+			}
+		case *JSONSchemaT:
+			errs = append(errs, root.validate(additional, v, k.Value)...)
+		}
+	}
+
+	for _, req := range s.Required {
+		if !slices.Contains(keys, req) {
+			errs = append(errs, schemaError(n, "'%s' missing required key %q", where, req))
+		}
+	}
+
+	if s.MinProperties != nil && len(keys) < *s.MinProperties {
+		errs = append(errs, schemaError(n, "'%s' requires at least %d keys", where, *s.MinProperties))
+	}
+
+	if s.MaxProperties != nil && len(keys) > *s.MaxProperties {
+		errs = append(errs, schemaError(n, "'%s' allows at most %d keys, got %s", where, *s.MaxProperties, strings.Join(keys, ", ")))
+	}
+
+	return errs
+}
+
+// validateOneOf accepts n if exactly one alternative matches. Otherwise the
+// errors of the closest alternative are reported, preferring alternatives
+// whose type matches the node (e.g. the object form of a term).
+func (root *JSONSchemaT) validateOneOf(s *JSONSchemaT, n *yaml.Node, where string) pqerr.List {
+
+	type resultT struct {
+		errs      pqerr.List
+		typeMatch bool
+	}
+
+	var (
+		results = make([]resultT, 0, len(s.OneOf))
+		valid   int
+	)
+
+	for _, alt := range s.OneOf {
+		errs := root.validate(alt, n, where)
+		if len(errs) == 0 {
+			valid++
+		}
+		results = append(results, resultT{
+			errs:      errs,
+			typeMatch: nodeMatchesType(n, alt.resolve(root).Type),
+		})
+	}
+
+	switch {
+	case valid == 1:
+		return nil
+	case valid > 1:
+		return pqerr.List{schemaError(n, "'%s' matches more than one allowed form", where)}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].typeMatch != results[j].typeMatch {
+			return results[i].typeMatch
+		}
+		return len(results[i].errs) < len(results[j].errs)
+	})
+
+	return results[0].errs
+}
@@ -1,6 +1,7 @@
 package parser
 
 import (
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
 	"gopkg.in/yaml.v3"
 )
 
@@ -15,7 +16,9 @@ const (
 	docWindow  = "window"
 	docMatch   = "match"
 	docNegate  = "negate"
+	docExclude = "exclude"
 	docTerms   = "terms"
+	docTests   = "tests"
 	docSection = "section"
 	docVersion = "version"
 )
@@ -77,12 +80,14 @@ type ParseCreT struct {
 }
 
 type ParseSequenceT struct {
-	Window       string       `yaml:"window"`
-	Correlations []string     `yaml:"correlations,omitempty"`
-	Event        *ParseEventT `yaml:"event,omitempty"`
-	Origin       bool         `yaml:"origin,omitempty"`
-	Order        []ParseTermT `yaml:"order,omitempty"`
-	Negate       []ParseTermT `yaml:"negate,omitempty"`
+	Window          string              `yaml:"window"`
+	Scope           string              `yaml:"scope,omitempty" json:"scope,omitempty"`
+	Correlations    []string            `yaml:"-"`                               // Names of CorrelationKeys
+	CorrelationKeys []ParseCorrelationT `yaml:"correlations,omitempty" json:"-"` // Out of the legacy hash, like earlier versions
+	Event           *ParseEventT        `yaml:"event,omitempty"`
+	Origin          bool                `yaml:"origin,omitempty"`
+	Order           []ParseTermT        `yaml:"order,omitempty"`
+	Negate          []ParseTermT        `yaml:"negate,omitempty"`
 }
 
 type ParseNegateOptsT struct {
@@ -98,17 +103,137 @@ type ParseTermT struct {
 	JqValue    string            `yaml:"jq,omitempty"`
 	RegexValue string            `yaml:"regex,omitempty"`
 	Count      int               `yaml:"count,omitempty"`
+	Fields     []ParsePredicateT `yaml:"fields,omitempty" json:"fields,omitempty"`
+	Exclude    []ParseTermT      `yaml:"exclude,omitempty" json:"exclude,omitempty"`
+	Bind       map[string]string `yaml:"bind,omitempty" json:"bind,omitempty"`
+	Detection  *ParseDetectionT  `yaml:"detection,omitempty" json:"detection,omitempty"`
 	Set        *ParseSetT        `yaml:"set,omitempty"`
 	Sequence   *ParseSequenceT   `yaml:"sequence,omitempty"`
 	NegateOpts *ParseNegateOptsT `yaml:",inline,omitempty"`
 }
 
+// ParseDetectionT matches the cluster-level detections of a CRE in an
+// organization scope rule. Cluster limits the term to the detections of one
+// cluster; Clusters requires detections from that many distinct clusters
+// within the window.
+type ParseDetectionT struct {
+	Cre      string `yaml:"cre"`
+	Cluster  string `yaml:"cluster,omitempty"`
+	Clusters int    `yaml:"clusters,omitempty"`
+}
+
+// ParsePredicateT is one entry of a term's 'fields' list. Every predicate
+// must hold on the same event for the term to match.
+type ParsePredicateT struct {
+	Field      string    `yaml:"field"`
+	StrValue   string    `yaml:"value,omitempty"`
+	JqValue    string    `yaml:"jq,omitempty"`
+	RegexValue string    `yaml:"regex,omitempty"`
+	Pos        pqerr.Pos `yaml:"-" json:"-"`
+}
+
+// UnmarshalYAML records the position of the predicate for error reporting.
+func (o *ParsePredicateT) UnmarshalYAML(n *yaml.Node) error {
+	type plain ParsePredicateT
+	var p plain
+	if err := n.Decode(&p); err != nil {
+		return err
+	}
+	*o = ParsePredicateT(p)
+	o.Pos = pqerr.Pos{Line: n.Line, Col: n.Column}
+	return nil
+}
+
+// ParseCorrelationT names a correlation key and how to extract it from the
+// events of each source, e.g. rabbitmq's host field and k8s's nodeName both
+// correlating as hostname. A bare string names the key without extraction.
+type ParseCorrelationT struct {
+	Name    string                          `yaml:"name"`
+	Sources map[string]ParseCorrelationKeyT `yaml:"sources,omitempty"`
+	Pos     pqerr.Pos                       `yaml:"-" json:"-"`
+}
+
+// ParseCorrelationKeyT extracts a correlation key with exactly one of a field
+// name, a jq expression or a regex capture group.
+type ParseCorrelationKeyT struct {
+	Field string `yaml:"field,omitempty"`
+	Jq    string `yaml:"jq,omitempty"`
+	Regex string `yaml:"regex,omitempty"`
+}
+
+// UnmarshalYAML accepts a bare correlation name and records the position of
+// the correlation for error reporting.
+func (o *ParseCorrelationT) UnmarshalYAML(n *yaml.Node) error {
+	if n.Kind == yaml.ScalarNode {
+		*o = ParseCorrelationT{}
+		if err := n.Decode(&o.Name); err != nil {
+			return err
+		}
+	} else {
+		type plain ParseCorrelationT
+		var p plain
+		if err := n.Decode(&p); err != nil {
+			return err
+		}
+		*o = ParseCorrelationT(p)
+	}
+	o.Pos = pqerr.Pos{Line: n.Line, Col: n.Column}
+	return nil
+}
+
+// MarshalYAML encodes a correlation without sources as its bare name.
+func (o ParseCorrelationT) MarshalYAML() (any, error) {
+	if len(o.Sources) == 0 {
+		return o.Name, nil
+	}
+	type plain ParseCorrelationT
+	return plain(o), nil
+}
+
+// correlationNames returns the names of the correlations, or nil when no
+// correlations were given.
+func correlationNames(corrs []ParseCorrelationT) []string {
+
+	if corrs == nil {
+		return nil
+	}
+
+	var names = make([]string, 0, len(corrs))
+	for _, c := range corrs {
+		names = append(names, c.Name)
+	}
+
+	return names
+}
+
+// UnmarshalYAML fills Correlations with the names of the correlations.
+func (o *ParseSequenceT) UnmarshalYAML(n *yaml.Node) error {
+	type plain ParseSequenceT
+	if err := n.Decode((*plain)(o)); err != nil {
+		return err
+	}
+	o.Correlations = correlationNames(o.CorrelationKeys)
+	return nil
+}
+
+// UnmarshalYAML fills Correlations with the names of the correlations.
+func (o *ParseSetT) UnmarshalYAML(n *yaml.Node) error {
+	type plain ParseSetT
+	if err := n.Decode((*plain)(o)); err != nil {
+		return err
+	}
+	o.Correlations = correlationNames(o.CorrelationKeys)
+	return nil
+}
+
 type ParseSetT struct {
-	Window       string       `yaml:"window,omitempty"`
-	Correlations []string     `yaml:"correlations,omitempty"`
-	Event        *ParseEventT `yaml:"event,omitempty"`
-	Match        []ParseTermT `yaml:"match,omitempty"`
-	Negate       []ParseTermT `yaml:"negate,omitempty"`
+	Window          string              `yaml:"window,omitempty"`
+	Scope           string              `yaml:"scope,omitempty" json:"scope,omitempty"`
+	Correlations    []string            `yaml:"-"`                               // Names of CorrelationKeys
+	CorrelationKeys []ParseCorrelationT `yaml:"correlations,omitempty" json:"-"` // Out of the legacy hash, like earlier versions
+	Event           *ParseEventT        `yaml:"event,omitempty"`
+	Match           []ParseTermT        `yaml:"match,omitempty"`
+	Negate          []ParseTermT        `yaml:"negate,omitempty"`
 }
 
 func (o *ParseTermT) UnmarshalYAML(unmarshal func(any) error) error {
@@ -123,6 +248,10 @@ func (o *ParseTermT) UnmarshalYAML(unmarshal func(any) error) error {
 		JqValue    string            `yaml:"jq,omitempty"`
 		RegexValue string            `yaml:"regex,omitempty"`
 		Count      int               `yaml:"count,omitempty"`
+		Fields     []ParsePredicateT `yaml:"fields,omitempty"`
+		Exclude    []ParseTermT      `yaml:"exclude,omitempty"`
+		Bind       map[string]string `yaml:"bind,omitempty"`
+		Detection  *ParseDetectionT  `yaml:"detection,omitempty"`
 		Set        *ParseSetT        `yaml:"set,omitempty"`
 		Sequence   *ParseSequenceT   `yaml:"sequence,omitempty"`
 		NegateOpts *ParseNegateOptsT `yaml:",inline,omitempty"`
@@ -135,6 +264,10 @@ func (o *ParseTermT) UnmarshalYAML(unmarshal func(any) error) error {
 	o.JqValue = temp.JqValue
 	o.RegexValue = temp.RegexValue
 	o.Count = temp.Count
+	o.Fields = temp.Fields
+	o.Exclude = temp.Exclude
+	o.Bind = temp.Bind
+	o.Detection = temp.Detection
 	o.Set = temp.Set
 	o.Sequence = temp.Sequence
 	o.NegateOpts = temp.NegateOpts
@@ -147,10 +280,76 @@ type ParseEventT struct {
 }
 
 type RulesT struct {
-	Rules  []ParseRuleT          `yaml:"rules"`
-	Root   *yaml.Node            `yaml:"-"`
-	TermsT map[string]ParseTermT `yaml:"terms,omitempty"`
-	TermsY map[string]*yaml.Node `yaml:"-"`
+	Rules     []ParseRuleT          `yaml:"rules"`
+	Root      *yaml.Node            `yaml:"-"` // Rules node of the last document
+	RuleNodes []*yaml.Node          `yaml:"-"` // Node of each rule, in Rules order
+	TermsT    map[string]ParseTermT `yaml:"terms,omitempty"`
+	TermsY    map[string]*yaml.Node `yaml:"-"`
+	Tests     []ParseTestT          `yaml:"tests,omitempty"`
+}
+
+// ParseTestT is a rule test case: sample events per source, the CREs they
+// must detect and counterexamples that must not detect them.
+type ParseTestT struct {
+	Name            string                       `yaml:"name,omitempty"`
+	Events          map[string][]ParseTestEventT `yaml:"events"`
+	Expect          []string                     `yaml:"expect,omitempty"`
+	Counterexamples []ParseCounterexampleT       `yaml:"counterexamples,omitempty"`
+	Pos             pqerr.Pos                    `yaml:"-"`
+}
+
+// ParseCounterexampleT holds sample events that must not detect the CREs
+// expected by its test case.
+type ParseCounterexampleT struct {
+	Name   string                       `yaml:"name,omitempty"`
+	Events map[string][]ParseTestEventT `yaml:"events"`
+	Pos    pqerr.Pos                    `yaml:"-"`
+}
+
+// ParseTestEventT is a sample event. The timestamp is either RFC 3339 or a
+// duration offset such as 1m30s.
+type ParseTestEventT struct {
+	Timestamp string            `yaml:"timestamp"`
+	Line      string            `yaml:"line"`
+	Keys      map[string]string `yaml:"keys,omitempty"`
+	Pos       pqerr.Pos         `yaml:"-"`
+}
+
+// UnmarshalYAML records the position of the test case for error reporting.
+func (o *ParseTestT) UnmarshalYAML(n *yaml.Node) error {
+	type plain ParseTestT
+	var p plain
+	if err := n.Decode(&p); err != nil {
+		return err
+	}
+	*o = ParseTestT(p)
+	o.Pos = pqerr.Pos{Line: n.Line, Col: n.Column}
+	return nil
+}
+
+// UnmarshalYAML records the position of the counterexample for error
+// reporting.
+func (o *ParseCounterexampleT) UnmarshalYAML(n *yaml.Node) error {
+	type plain ParseCounterexampleT
+	var p plain
+	if err := n.Decode(&p); err != nil {
+		return err
+	}
+	*o = ParseCounterexampleT(p)
+	o.Pos = pqerr.Pos{Line: n.Line, Col: n.Column}
+	return nil
+}
+
+// UnmarshalYAML records the position of the event for error reporting.
+func (o *ParseTestEventT) UnmarshalYAML(n *yaml.Node) error {
+	type plain ParseTestEventT
+	var p plain
+	if err := n.Decode(&p); err != nil {
+		return err
+	}
+	*o = ParseTestEventT(p)
+	o.Pos = pqerr.Pos{Line: n.Line, Col: n.Column}
+	return nil
 }
 
 func RootNode(data []byte) (*yaml.Node, error) {
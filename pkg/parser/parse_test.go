@@ -1,11 +1,14 @@
 package parser
 
 import (
+	"bytes"
 	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
@@ -60,6 +63,41 @@ func TestParseSuccess(t *testing.T) {
 			expectedNodeTypes:  []string{"machine_seq", "log_seq", "log_set", "machine_seq", "log_seq", "log_set", "log_set"},
 			expectedNegIndexes: []int{-1, 2, 2, -1, -1, -1, -1},
 		},
+		"Success_MultiField": {
+			rule:               testdata.TestSuccessMultiField,
+			expectedNodeTypes:  []string{"log_set"},
+			expectedNegIndexes: []int{-1},
+		},
+		"Success_Exclude": {
+			rule:               testdata.TestSuccessExclude,
+			expectedNodeTypes:  []string{"log_set"},
+			expectedNegIndexes: []int{-1},
+		},
+		"Success_Bind": {
+			rule:               testdata.TestSuccessBind,
+			expectedNodeTypes:  []string{"log_seq"},
+			expectedNegIndexes: []int{-1},
+		},
+		"Success_BindJq": {
+			rule:               testdata.TestSuccessBindJq,
+			expectedNodeTypes:  []string{"log_set"},
+			expectedNegIndexes: []int{-1},
+		},
+		"Success_CorrelationKeys": {
+			rule:               testdata.TestSuccessCorrelationKeys,
+			expectedNodeTypes:  []string{"machine_seq", "log_set", "log_set"},
+			expectedNegIndexes: []int{-1, -1, -1},
+		},
+		"Success_OrgClusters": {
+			rule:               testdata.TestSuccessOrgClusters,
+			expectedNodeTypes:  []string{"machine_set"},
+			expectedNegIndexes: []int{-1},
+		},
+		"Success_OrgSequence": {
+			rule:               testdata.TestSuccessOrgSequence,
+			expectedNodeTypes:  []string{"machine_seq"},
+			expectedNegIndexes: []int{2},
+		},
 		"Success_MissingRuleId": {
                         rule: testdata.TestFailMissingRuleIdRule,
 			expectedNodeTypes:  []string{"log_set"},
@@ -206,6 +244,60 @@ func TestParseFail(t *testing.T) {
 			col:  7,
 			err:  ErrInvalidCreId,
 		},
+		"Fail_TermsCycle": {
+			rule: testdata.TestFailTermsCycle,
+			line: 18,
+			col:  5,
+			err:  ErrTermCycle,
+		},
+		"Fail_TermsSelfCycle": {
+			rule: testdata.TestFailTermsSelfCycle,
+			line: 16,
+			col:  5,
+			err:  ErrTermCycle,
+		},
+		"Fail_MultiFieldValue": {
+			rule: testdata.TestFailMultiFieldValue,
+			line: 17,
+			col:  17,
+			err:  ErrPredicateValue,
+		},
+		"Fail_ExcludeScope": {
+			rule: testdata.TestFailExcludeScope,
+			line: 11,
+			col:  9,
+			err:  ErrExcludeScope,
+		},
+		"Fail_BindName": {
+			rule: testdata.TestFailBindName,
+			line: 11,
+			col:  9,
+			err:  ErrBindName,
+		},
+		"Fail_CorrelationKey": {
+			rule: testdata.TestFailCorrelationKey,
+			line: 13,
+			col:  13,
+			err:  ErrCorrelationKey,
+		},
+		"Fail_DetectionScope": {
+			rule: testdata.TestFailDetectionScope,
+			line: 11,
+			col:  9,
+			err:  ErrDetectionScope,
+		},
+		"Fail_OrgScopeTerm": {
+			rule: testdata.TestFailOrgScopeTerm,
+			line: 14,
+			col:  11,
+			err:  ErrOrgScopeTerm,
+		},
+		"Fail_MultiFieldMissing": {
+			rule: testdata.TestFailMultiFieldMissing,
+			line: 20,
+			col:  9,
+			err:  ErrPredicateField,
+		},
 		"Fail_BadRuleHash": {
 			rule: testdata.TestFailBadRuleHashRule,
 			line: 11,
@@ -249,3 +341,535 @@ func DumpErrorChain(err error) {
 		err = errors.Unwrap(err)
 	}
 }
+
+func TestParseDiagnostics(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestDiagnosticsParseRules), WithDiagnostics(), WithFile("diagnostics.yaml"))
+	if err == nil {
+		t.Fatalf("Expected diagnostics error")
+	}
+
+	if tree == nil || len(tree.Nodes) != 1 {
+		t.Fatalf("Expected partial tree with 1 valid rule, got %v", tree)
+	}
+
+	if tree.Nodes[0].Metadata.CreId != "TestDiagnosticsGood" {
+		t.Errorf("Expected valid rule TestDiagnosticsGood, got %s", tree.Nodes[0].Metadata.CreId)
+	}
+
+	var expected = []struct {
+		err   error
+		line  int
+		col   int
+		creId string
+	}{
+		{err: ErrInvalidWindow, line: 25, col: 17, creId: "TestDiagnosticsBadWindow"},
+		{err: ErrMissingCreId, line: 37, col: 7, creId: ""},
+	}
+
+	diags := pqerr.ListOf(err)
+	if len(diags) != len(expected) {
+		t.Fatalf("Expected %d diagnostics, got %d: %v", len(expected), len(diags), err)
+	}
+
+	for i, exp := range expected {
+		if !errors.Is(diags[i], exp.err) {
+			t.Errorf("Diagnostic %d: expected error %v, got %v", i, exp.err, diags[i])
+		}
+		if diags[i].Pos.Line != exp.line || diags[i].Pos.Col != exp.col {
+			t.Errorf("Diagnostic %d: expected line=%d col=%d, got line=%d col=%d", i, exp.line, exp.col, diags[i].Pos.Line, diags[i].Pos.Col)
+		}
+		if diags[i].CreId != exp.creId {
+			t.Errorf("Diagnostic %d: expected cre id %q, got %q", i, exp.creId, diags[i].CreId)
+		}
+		if diags[i].File != "diagnostics.yaml" {
+			t.Errorf("Diagnostic %d: expected file diagnostics.yaml, got %q", i, diags[i].File)
+		}
+	}
+
+	if !errors.Is(err, ErrInvalidWindow) || !errors.Is(err, ErrMissingCreId) {
+		t.Errorf("Expected diagnostics to unwrap to every error, got %v", err)
+	}
+}
+
+func TestParseTermsCycleChain(t *testing.T) {
+
+	var tests = map[string]struct {
+		rule  string
+		chain []string
+		lines []int
+	}{
+		"Cycle": {
+			rule:  testdata.TestFailTermsCycle,
+			chain: []string{"term1", "term3", "term1"},
+			lines: []int{18, 30, 18},
+		},
+		"SelfCycle": {
+			rule:  testdata.TestFailTermsSelfCycle,
+			chain: []string{"term1", "term1"},
+			lines: []int{16, 16},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Parse([]byte(test.rule))
+
+			var cycle *TermCycleError
+			if !errors.As(err, &cycle) {
+				t.Fatalf("Expected TermCycleError, got %v", err)
+			}
+
+			if !reflect.DeepEqual(cycle.Chain, test.chain) {
+				t.Errorf("chain = %v, want %v", cycle.Chain, test.chain)
+			}
+
+			for i, line := range test.lines {
+				if cycle.Pos[i].Line != line {
+					t.Errorf("chain[%d] line = %d, want %d", i, cycle.Pos[i].Line, line)
+				}
+			}
+		})
+	}
+}
+
+func TestParseTermsCycleDiagnostics(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestFailTermsCycle), WithDiagnostics())
+	if !errors.Is(err, ErrTermCycle) {
+		t.Fatalf("Expected error %v, got %v", ErrTermCycle, err)
+	}
+
+	// One error for the cycle and one for the rule that references it
+	if diags := pqerr.ListOf(err); len(diags) != 2 {
+		t.Errorf("Expected 2 diagnostics, got %d: %v", len(diags), err)
+	}
+
+	if tree == nil || len(tree.Nodes) != 0 {
+		t.Errorf("Expected empty partial tree, got %v", tree)
+	}
+}
+
+func TestParseTermRefs(t *testing.T) {
+
+	tree, err := Parse([]byte(testdata.TestTermsMisspelled))
+	if err != nil {
+		t.Fatalf("Expected warnings only in default mode, got %v", err)
+	}
+
+	var expected = []struct {
+		line int
+		col  int
+		msg  string
+	}{
+		{line: 28, col: 11, msg: `"kafka_broker_down" is not a defined term and will match as a literal string; use 'value:' for literals`},
+		{line: 15, col: 13, msg: `"term_2" is not a defined term and will match as a literal string; did you mean "term2" or "term1"?`},
+	}
+
+	if len(tree.Warnings) != len(expected) {
+		t.Fatalf("Expected %d warnings, got %d", len(expected), len(tree.Warnings))
+	}
+
+	for i, exp := range expected {
+		w := tree.Warnings[i]
+		if w.Pos.Line != exp.line || w.Pos.Col != exp.col {
+			t.Errorf("Warning %d: expected line=%d col=%d, got line=%d col=%d", i, exp.line, exp.col, w.Pos.Line, w.Pos.Col)
+		}
+		if w.Msg != exp.msg {
+			t.Errorf("Warning %d: expected msg %q, got %q", i, exp.msg, w.Msg)
+		}
+	}
+
+	_, err = Parse([]byte(testdata.TestTermsMisspelled), WithStrictRefs())
+	if !errors.Is(err, ErrUnknownTerm) {
+		t.Fatalf("Expected error %v in strict mode, got %v", ErrUnknownTerm, err)
+	}
+
+	if pos, ok := pqerr.PosOf(err); !ok || pos.Line != 28 {
+		t.Errorf("Expected first error at line 28, got %v", err)
+	}
+}
+
+func TestParseTermRefsLiterals(t *testing.T) {
+
+	// Words with digits are literals, not misspelled term names
+	tree, err := Parse([]byte(testdata.TestTermsLiteralWords), WithStrictRefs())
+	if err != nil {
+		t.Fatalf("Error parsing rule: %v", err)
+	}
+
+	if len(tree.Warnings) != 0 {
+		t.Errorf("Expected no warnings, got %v", tree.Warnings)
+	}
+}
+
+func TestParseStrict(t *testing.T) {
+
+	var expected = []struct {
+		line int
+		col  int
+	}{
+		{line: 12, col: 9},
+		{line: 17, col: 9},
+		{line: 32, col: 11},
+		{line: 33, col: 1},
+	}
+
+	if _, err := Parse([]byte(testdata.TestStrictUnknownKeys)); err != nil {
+		t.Fatalf("Expected unknown keys to be ignored without strict mode, got %v", err)
+	}
+
+	check := func(t *testing.T, err error) {
+		if !errors.Is(err, ErrUnknownKey) {
+			t.Fatalf("Expected error %v, got %v", ErrUnknownKey, err)
+		}
+
+		diags := pqerr.ListOf(err)
+		if len(diags) != len(expected) {
+			t.Fatalf("Expected %d unknown keys, got %d: %v", len(expected), len(diags), err)
+		}
+
+		for i, exp := range expected {
+			if diags[i].Pos.Line != exp.line || diags[i].Pos.Col != exp.col {
+				t.Errorf("Unknown key %d: expected line=%d col=%d, got line=%d col=%d", i, exp.line, exp.col, diags[i].Pos.Line, diags[i].Pos.Col)
+			}
+		}
+	}
+
+	t.Run("Parse", func(t *testing.T) {
+		_, err := Parse([]byte(testdata.TestStrictUnknownKeys), WithStrict())
+		check(t, err)
+	})
+
+	t.Run("Read", func(t *testing.T) {
+		_, err := Read(strings.NewReader(testdata.TestStrictUnknownKeys), WithStrict())
+		check(t, err)
+	})
+
+	t.Run("Valid", func(t *testing.T) {
+		data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", "29-negate-slide-anchor-1-window.yaml"))
+		if err != nil {
+			t.Fatalf("Error reading test file: %v", err)
+		}
+		if _, err = Parse(data, WithStrict(), WithGenIds()); err != nil {
+			t.Errorf("Expected inline negate options to be accepted, got %v", err)
+		}
+	})
+}
+
+func TestReadStructureOnly(t *testing.T) {
+
+	var data = []byte(testdata.TestSuccessBind + "---" + testdata.TestSuccessBind)
+
+	if _, err := Read(bytes.NewReader(data)); err == nil {
+		t.Errorf("Expected duplicate rule ids to fail")
+	}
+
+	rules, err := Read(bytes.NewReader(data), WithStructureOnly())
+	if err != nil {
+		t.Fatalf("Error reading rules: %v", err)
+	}
+
+	if len(rules.Rules) != 2 {
+		t.Errorf("Expected 2 rules, got %d", len(rules.Rules))
+	}
+}
+
+func TestParseTests(t *testing.T) {
+
+	rules, err := Read(strings.NewReader(testdata.TestSuccessRuleTests), WithStrict())
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if len(rules.Tests) != 1 {
+		t.Fatalf("Expected 1 test, got %d", len(rules.Tests))
+	}
+
+	var test = rules.Tests[0]
+
+	if test.Pos.Line != 21 || test.Pos.Col != 5 || len(test.Events["cre.log.haproxy"]) != 2 {
+		t.Errorf("Unexpected test %+v", test)
+	}
+
+	if len(test.Counterexamples) != 2 || test.Counterexamples[1].Events["cre.log.haproxy"][2].Line != "pool drained" {
+		t.Errorf("Unexpected counterexamples %+v", test.Counterexamples)
+	}
+
+	if err = ValidateSchema(strings.NewReader(testdata.TestSuccessRuleTests)); err != nil {
+		t.Errorf("Expected the tests section to match the schema, got %v", err)
+	}
+}
+
+var updateSchema = flag.Bool("update-schema", false, "regenerate cre.schema.json")
+
+func TestJSONSchemaUpToDate(t *testing.T) {
+
+	const path = "cre.schema.json"
+
+	generated, err := JSONSchema()
+	if err != nil {
+		t.Fatalf("Error generating schema: %v", err)
+	}
+
+	if *updateSchema {
+		if err = os.WriteFile(path, generated, 0644); err != nil {
+			t.Fatalf("Error writing schema: %v", err)
+		}
+	}
+
+	published, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Error reading schema: %v", err)
+	}
+
+	if !bytes.Equal(generated, published) {
+		t.Errorf("%s is out of date; run go test -run TestJSONSchemaUpToDate -update-schema", path)
+	}
+}
+
+func TestValidateSchema(t *testing.T) {
+
+	rules, err := filepath.Glob(filepath.Join("../testdata", "success_examples", "*.yaml"))
+	if err != nil {
+		t.Fatalf("Error finding CRE test files: %v", err)
+	}
+
+	for _, rule := range rules {
+		f, err := os.Open(rule)
+		if err != nil {
+			t.Fatalf("Error reading test file %s: %v", rule, err)
+		}
+
+		if err = ValidateSchema(f); err != nil {
+			t.Errorf("Error validating rule %s: %v", rule, err)
+		}
+		f.Close()
+	}
+
+	var expected = []struct {
+		line int
+		col  int
+	}{
+		{line: 12, col: 9},
+		{line: 17, col: 9},
+		{line: 32, col: 11},
+		{line: 33, col: 1},
+	}
+
+	err = ValidateSchema(strings.NewReader(testdata.TestStrictUnknownKeys))
+	if !errors.Is(err, ErrSchemaViolation) {
+		t.Fatalf("Expected error %v, got %v", ErrSchemaViolation, err)
+	}
+
+	diags := pqerr.ListOf(err)
+	if len(diags) != len(expected) {
+		t.Fatalf("Expected %d violations, got %d: %v", len(expected), len(diags), err)
+	}
+
+	for i, exp := range expected {
+		if diags[i].Pos.Line != exp.line || diags[i].Pos.Col != exp.col {
+			t.Errorf("Violation %d: expected line=%d col=%d, got line=%d col=%d", i, exp.line, exp.col, diags[i].Pos.Line, diags[i].Pos.Col)
+		}
+	}
+}
+
+func TestHashRuleSemantic(t *testing.T) {
+
+	hash := func(rules string, opts ...ParseOptT) string {
+		tree, err := Parse([]byte(rules), append(opts, WithGenIds())...)
+		if err != nil {
+			t.Fatalf("Error parsing rules: %v", err)
+		}
+		return tree.Nodes[0].Metadata.RuleHash
+	}
+
+	var (
+		inline  = hash(testdata.TestHashSemanticInline)
+		terms   = hash(testdata.TestHashSemanticTerms)
+		changed = hash(testdata.TestHashSemanticChanged)
+	)
+
+	if inline != terms {
+		t.Errorf("Expected same hash for inline and referenced terms, got %s and %s", inline, terms)
+	}
+
+	if inline == changed {
+		t.Errorf("Expected different hash after negate window change, got %s", inline)
+	}
+
+	if legacy := hash(testdata.TestHashSemanticInline, WithLegacyHash()); legacy == inline {
+		t.Errorf("Expected legacy hash to differ from semantic hash, got %s", legacy)
+	}
+
+	if legacy := hash(testdata.TestHashSemanticTerms, WithLegacyHash()); legacy == hash(testdata.TestHashSemanticInline, WithLegacyHash()) {
+		t.Errorf("Expected legacy hash to depend on term indirection, got %s", legacy)
+	}
+}
+
+// TestHashRuleLegacy pins the legacy hashes of the success examples to the
+// values of earlier versions; new rule fields must not change them.
+func TestHashRuleLegacy(t *testing.T) {
+
+	var tests = []struct {
+		file string
+		idx  int
+		hash string
+	}{
+		{"00-rules-document-example.yaml", 0, "29kaUEBxaunH3wUtm7nR3giHTMHkS1URxRPyX3YUiYa2"},
+		{"00-rules-document-example.yaml", 1, "AXECddPkbxF7MZWz513LRDB7M4wF3M7EE55yYBKVk9Ze"},
+		{"01-set-single-example.yaml", 0, "uxQo2LM3u9wMKZ3VFnh9CDfUyUDpEThFqwG5NucUNp6"},
+		{"02-set-multiple-example-bad-window.yaml", 0, "BxjLu85vNYF4vVVkx7RE7yizB1ds9XXD7FA9NFmRPzEB"},
+		{"02-set-multiple-example-good-window.yaml", 0, "EvLvPjd4nNjoDG2amtTWyV5ZUXoMxdzQzE7LfwQQASPe"},
+		{"03-set-negative-example.yaml", 0, "E9H11qHqwsXGQkMD5jjRPdZYrQgHFacm1NZ3iWNGiUjy"},
+		{"04-set-1x1-example.yaml", 0, "DNQr1fhtCNh6wXhR97kT7zD6T3Bom22vw4MtromGSxom"},
+		{"08-sequence-example-bad-window.yaml", 0, "4ZMP33LuSx4TdGCVdCTyHD1x3qK6tAx14ZQm9rLDVRH1"},
+		{"08-sequence-example-good-window.yaml", 0, "J66xv31gJehZ53aFKyEamNnqeCdSNF8AocuXa7zKut1Q"},
+		{"09-sequence-negate-example.yaml", 0, "BcGiHmWPtfYcBnTxZAdpXhy43JxSG5N46Dv4z9tmmin6"},
+		{"13-string-example.yaml", 0, "BPiHZj1YxZbv5YoGYaHuioxGXx6oHrdpoy6aMTRpW2Sf"},
+		{"14-string-example.yaml", 0, "C7Kt2sD5CT5uym3DtymdsoDCkWRqh6dxcSdHFwczpAwL"},
+		{"15-regex-example.yaml", 0, "CkwLqvM6rDtCzYWRpAV5CbBxxfEtbw6UUYpYTgHdPjAo"},
+		{"16-regex-example.yaml", 0, "37ZqyWyGfhN1aHPxqzX8i18oydFk9x9bc7MTcTkXCTV4"},
+		{"17-jq-example.yaml", 0, "goA6B9JaRNVipgWrEnEEsNtYJ5qRumHyWBuyfeVJ7Fp"},
+		{"18-jq-example.yaml", 0, "FGrWM6G2uGqg1wJBVGvx1G2czqn6Trraa2nLPwc8Y1nk"},
+		{"19-bad-literal-block-example.yaml", 0, "FSx7hxDPkJYVKnYPYjYm68GWG4qHsWL4nQPTas8dsktx"},
+		{"20-bad-regex-example.yaml", 0, "HqYXS1WhcKXGyN9gdwegkgm2ChWTt2Ba2437kwp3j8W5"},
+		{"21-negative-example.yaml", 0, "8B2ZRfEebqY4ZKx573EnLJ5hjHipNuQm71wWUY38sbMK"},
+		{"24-multiple-negatives.yaml", 0, "FproJFGUZH23UYXejcXYpowLbDCgGK1Gn2XYChpiANRp"},
+		{"25-negate-options-1x1.yaml", 0, "9EBRuDRtYgaBqpSFigitgUcjxRXPnK4uDo2WaNoNW6Pt"},
+		{"26-negate-window.yaml", 0, "JC1WiLQgDNAGVdTiX4tmmmAeBsm8F1K3M1arMzQ4Zp9Z"},
+		{"27-negate-window-shorter.yaml", 0, "GZPdBw5Gq5bWuPzt7RYpwvX4HV8Mq99ZzF1XSu4n9cUJ"},
+		{"27-negate-window.yaml", 0, "CUFtc1d4fCXntoRg6hgPYyRkQxEKmCGxsFrwHLxAKfyc"},
+		{"28-negate-anchor-shorter.yaml", 0, "94WMZa8ECDLL5drpS8GtaatpRcNvyKFjsd4xgEHe95Ty"},
+		{"28-negate-anchor.yaml", 0, "9YYbG87YaGYsziFdGvme3K4v7WGTjvnXUsabEXSQdAb4"},
+		{"29-negate-slide-anchor-1-window.yaml", 0, "GSu9873wJrr1oB3BuYG4hZkTwjsv1x8oA1dfk18FiVbd"},
+		{"29-negate-slide-anchor-1.yaml", 0, "Cmpr1G7eX8mRF3F6BXngipmwCBnRwVafqGJNXYcF6M5M"},
+		{"29-negate-slide.yaml", 0, "GqVT27NMSqBLtj6pcLuw3dGq4XJnwpcWujJ7T7UCAjeK"},
+		{"30-negate-absolute.yaml", 0, "7pHgRbCpvea9RWGmvjHjQThncEiZz42j33K2LPSXSF1J"},
+		{"41-nested.yaml", 0, "2wqZxNDUCcRQUoLRckkyz7ofWEc769BarGBvBS6tbBZS"},
+	}
+
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%s/%d", tc.file, tc.idx), func(t *testing.T) {
+
+			data, err := os.ReadFile(filepath.Join("../testdata", "success_examples", tc.file))
+			if err != nil {
+				t.Fatalf("Error reading test file: %v", err)
+			}
+
+			rules, err := Unmarshal(data)
+			if err != nil {
+				t.Fatalf("Error unmarshaling rules: %v", err)
+			}
+
+			hash, err := HashRule(rules.Rules[tc.idx])
+			if err != nil {
+				t.Fatalf("Error hashing rule: %v", err)
+			}
+
+			if hash != tc.hash {
+				t.Errorf("Expected legacy hash %s, got %s", tc.hash, hash)
+			}
+		})
+	}
+}
+
+func TestCorrelationNames(t *testing.T) {
+
+	rules, err := Unmarshal([]byte(testdata.TestSuccessCorrelationKeys))
+	if err != nil {
+		t.Fatalf("Error unmarshaling rules: %v", err)
+	}
+
+	var seq = rules.Rules[0].Rule.Sequence
+
+	if !reflect.DeepEqual(seq.Correlations, []string{"hostname", "container_id"}) {
+		t.Errorf("Expected correlation names, got %v", seq.Correlations)
+	}
+
+	if len(seq.CorrelationKeys) != 2 || len(seq.CorrelationKeys[0].Sources) != 2 {
+		t.Errorf("Expected the hostname sources, got %+v", seq.CorrelationKeys)
+	}
+
+	// Names set without the decoder are correlations without sources
+	var (
+		named = &ParseSetT{Window: "10s", Correlations: []string{"hostname"}, Match: []ParseTermT{{StrValue: "a"}}}
+		keyed = &ParseSetT{Window: "10s", CorrelationKeys: []ParseCorrelationT{{Name: "hostname"}}, Match: []ParseTermT{{StrValue: "a"}}}
+	)
+
+	hash := func(set *ParseSetT) string {
+		h, err := HashRuleSemantic(ParseRuleT{Rule: ParseRuleDataT{Set: set}}, nil)
+		if err != nil {
+			t.Fatalf("Error hashing rule: %v", err)
+		}
+		return h
+	}
+
+	if hash(named) != hash(keyed) {
+		t.Errorf("Expected the same hash for named and keyed correlations")
+	}
+}
+
+func TestCheckGenerations(t *testing.T) {
+
+	read := func(data string) *RulesT {
+		rules, err := Read(strings.NewReader(data))
+		if err != nil {
+			t.Fatalf("Error reading rules: %v", err)
+		}
+		return rules
+	}
+
+	var (
+		prev = read(testdata.TestGenerationsPrev)
+		next = read(testdata.TestGenerationsNext)
+	)
+
+	if err := CheckGenerations(prev, prev); err != nil {
+		t.Fatalf("Expected no errors against itself, got %v", err)
+	}
+
+	var expected = []genErrorT{
+		{err: ErrGenerationNotBumped, creId: "TestGenerationsChanged", line: 3},
+		{err: ErrGenerationDecreased, creId: "TestGenerationsDecreased", line: 28},
+		{err: ErrRuleIdReused, creId: "TestGenerationsOther", line: 40},
+	}
+
+	checkGenerations(t, CheckGenerations(prev, next), expected)
+
+	// Rules split over two documents keep the positions of their document
+	var split = read(strings.Replace(testdata.TestGenerationsNext, "  - cre:\n      id: TestGenerationsDecreased", "---\nrules:\n  - cre:\n      id: TestGenerationsDecreased", 1))
+
+	expected[1].line += 2
+	expected[2].line += 2
+
+	checkGenerations(t, CheckGenerations(prev, split), expected)
+}
+
+type genErrorT struct {
+	err   error
+	creId string
+	line  int
+}
+
+func checkGenerations(t *testing.T, err error, expected []genErrorT) {
+
+	t.Helper()
+
+	errs := pqerr.ListOf(err)
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(expected), len(errs), err)
+	}
+
+	for i, exp := range expected {
+		if !errors.Is(errs[i], exp.err) {
+			t.Errorf("Error %d: expected %v, got %v", i, exp.err, errs[i])
+		}
+		if errs[i].CreId != exp.creId {
+			t.Errorf("Error %d: expected cre %s, got %s", i, exp.creId, errs[i].CreId)
+		}
+		if errs[i].Pos.Line != exp.line {
+			t.Errorf("Error %d: expected line %d, got %d", i, exp.line, errs[i].Pos.Line)
+		}
+	}
+}
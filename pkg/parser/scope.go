@@ -0,0 +1,104 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/schema"
+)
+
+var (
+	ErrInvalidScope     = errors.New("'scope' must be cluster or organization")
+	ErrScopeConflict    = errors.New("organization scope machines may only nest organization scope machines")
+	ErrDetectionScope   = errors.New("'detection' terms only apply to organization scope machines")
+	ErrDetectionTerm    = errors.New("'detection' cannot be combined with other term options")
+	ErrDetectionCre     = errors.New("'detection' has an invalid 'cre' id")
+	ErrDetectionCluster = errors.New("'detection' may not set 'cluster' with 'clusters' above one")
+	ErrOrgScopeTerm     = errors.New("organization scope machines only match 'detection' terms and nested machines")
+	ErrOrgScopeEvent    = errors.New("organization scope machines cannot have an 'event'")
+)
+
+// DetectionT is a term of an organization scope machine. It matches the
+// detections of a CRE reported by the clusters of the organization.
+type DetectionT struct {
+	CreId      string       `json:"cre_id"`
+	Cluster    string       `json:"cluster,omitempty"`  // Only detections from this cluster
+	Clusters   int          `json:"clusters,omitempty"` // Distinct clusters required within the window
+	NegateOpts *NegateOptsT `json:"negate"`
+}
+
+// nodeScope sets the scope of a machine node. Nodes inherit the scope of
+// their parent; only the root may declare it, or a nested machine may
+// repeat the scope of its parent.
+func nodeScope(node, parent *NodeT, scope string) error {
+
+	switch scope {
+	case "", schema.ScopeCluster, schema.ScopeOrganization:
+	default:
+		return node.WrapError(fmt.Errorf("%w: %q", ErrInvalidScope, scope))
+	}
+
+	if parent == nil {
+		if scope == schema.ScopeOrganization {
+			node.Metadata.Scope = scope
+		}
+		return nil
+	}
+
+	node.Metadata.Scope = parent.Metadata.Scope
+
+	if scope == "" {
+		return nil
+	}
+
+	if isOrgScope(parent) != (scope == schema.ScopeOrganization) {
+		return node.WrapError(ErrScopeConflict)
+	}
+
+	return nil
+}
+
+func isOrgScope(node *NodeT) bool {
+	return node.Metadata.Scope == schema.ScopeOrganization
+}
+
+// detectionFromTerm validates a 'detection' term of an organization scope
+// machine.
+func detectionFromTerm(parent *NodeT, term ParseTermT) (*DetectionT, error) {
+
+	var (
+		d   = term.Detection
+		det = &DetectionT{
+			CreId:    d.Cre,
+			Cluster:  d.Cluster,
+			Clusters: d.Clusters,
+		}
+		err error
+	)
+
+	if !isOrgScope(parent) {
+		return nil, parent.WrapError(ErrDetectionScope)
+	}
+
+	if term.Field != "" || term.StrValue != "" || term.JqValue != "" || term.RegexValue != "" ||
+		term.Count > 0 || len(term.Fields) > 0 || len(term.Exclude) > 0 || len(term.Bind) > 0 ||
+		term.Set != nil || term.Sequence != nil {
+		return nil, parent.WrapError(ErrDetectionTerm)
+	}
+
+	if !isValidCreId(d.Cre) {
+		return nil, parent.WrapError(fmt.Errorf("%w: %q", ErrDetectionCre, d.Cre))
+	}
+
+	if d.Clusters < 0 || (d.Clusters > 1 && d.Cluster != "") {
+		return nil, parent.WrapError(ErrDetectionCluster)
+	}
+
+	if term.NegateOpts != nil {
+		if det.NegateOpts, err = negateOpts(term); err != nil {
+			return nil, err
+		}
+	}
+
+	return det, nil
+}
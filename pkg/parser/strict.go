@@ -0,0 +1,152 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown key")
+)
+
+// YamlFieldT is a yaml key accepted by a struct and the type of its field.
+type YamlFieldT struct {
+	Name string
+	Type reflect.Type
+}
+
+// YamlFields returns the yaml keys accepted by a struct in field order.
+// Fields tagged ",inline" (e.g. ParseNegateOptsT on ParseTermT) are flattened
+// into the parent, matching the yaml.v3 decoder.
+func YamlFields(typ reflect.Type) []YamlFieldT {
+
+	var fields []YamlFieldT
+
+	for i := range typ.NumField() {
+		var (
+			f         = typ.Field(i)
+			tag       = f.Tag.Get("yaml")
+			name, opt = splitTag(tag)
+		)
+
+		if !f.IsExported() || name == "-" {
+			continue
+		}
+
+		if slices.Contains(opt, "inline") {
+			fields = append(fields, YamlFields(derefType(f.Type))...)
+			continue
+		}
+
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+
+		fields = append(fields, YamlFieldT{Name: name, Type: f.Type})
+	}
+
+	return fields
+}
+
+// yamlFields maps the yaml keys accepted by a struct to their field types.
+func yamlFields(typ reflect.Type) map[string]reflect.Type {
+
+	var fields = make(map[string]reflect.Type)
+
+	for _, f := range YamlFields(typ) {
+		fields[f.Name] = f.Type
+	}
+
+	return fields
+}
+
+func splitTag(tag string) (string, []string) {
+	parts := strings.Split(tag, ",")
+	return parts[0], parts[1:]
+}
+
+func derefType(typ reflect.Type) reflect.Type {
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	return typ
+}
+
+// checkKeys walks n against typ and reports every mapping key that does not
+// correspond to a field. where names the enclosing key for the message.
+func checkKeys(n *yaml.Node, typ reflect.Type, where string, errs *pqerr.List) {
+
+	for n != nil && n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+
+	if n == nil {
+		return
+	}
+
+	switch typ = derefType(typ); typ.Kind() {
+	case reflect.Struct:
+		// Scalars are allowed where the type unmarshals them (e.g. a bare term string)
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+
+		fields := yamlFields(typ)
+
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+
+			ft, ok := fields[k.Value]
+			if !ok {
+				errs.Add(pqerr.Wrap(
+					pqerr.Pos{Line: k.Line, Col: k.Column},
+					"", "", "",
+					ErrUnknownKey,
+					fmt.Sprintf("unknown key %q in '%s'", k.Value, where),
+				))
+				continue
+			}
+
+			checkKeys(v, ft, k.Value, errs)
+		}
+
+	case reflect.Slice:
+		if n.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, item := range n.Content {
+			checkKeys(item, typ.Elem(), where, errs)
+		}
+
+	case reflect.Map:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			checkKeys(n.Content[i+1], typ.Elem(), n.Content[i].Value, errs)
+		}
+	}
+}
+
+// checkDocument reports every unknown key in a rules document.
+func checkDocument(doc *yaml.Node) pqerr.List {
+
+	var errs pqerr.List
+
+	if doc != nil && doc.Kind == yaml.DocumentNode {
+		if len(doc.Content) == 0 {
+			return nil
+		}
+		doc = doc.Content[0]
+	}
+
+	checkKeys(doc, reflect.TypeOf(RulesT{}), "document", &errs)
+
+	return errs
+}
@@ -0,0 +1,351 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	ErrTermCycle = errors.New("term reference cycle")
+)
+
+// TermCycleError reports a chain of terms that refer back to themselves,
+// e.g. term1 -> term3 -> term1. Pos holds the position of each term in Chain.
+type TermCycleError struct {
+	Chain []string
+	Pos   []pqerr.Pos
+}
+
+func (e *TermCycleError) Error() string {
+	var links = make([]string, 0, len(e.Chain))
+	for i, name := range e.Chain {
+		links = append(links, fmt.Sprintf("%s (line=%d, col=%d)", name, e.Pos[i].Line, e.Pos[i].Col))
+	}
+	return fmt.Sprintf("%s: %s", ErrTermCycle.Error(), strings.Join(links, " -> "))
+}
+
+func (e *TermCycleError) Unwrap() error {
+	return ErrTermCycle
+}
+
+// childTerms returns the positive and negative children of a set or sequence
+// term, along with its exclusions.
+func childTerms(t ParseTermT) []ParseTermT {
+	var children = append([]ParseTermT{}, t.Exclude...)
+	if t.Set != nil {
+		children = append(children, t.Set.Match...)
+		children = append(children, t.Set.Negate...)
+	}
+	if t.Sequence != nil {
+		children = append(children, t.Sequence.Order...)
+		children = append(children, t.Sequence.Negate...)
+	}
+	return children
+}
+
+// ruleTerms returns the top level children of a rule.
+func ruleTerms(r ParseRuleT) []ParseTermT {
+	return childTerms(ParseTermT{Set: r.Rule.Set, Sequence: r.Rule.Sequence})
+}
+
+// termRefs returns the named terms referenced by children, descending through
+// inline sets and sequences the same way buildChildren resolves them.
+func termRefs(termsT map[string]ParseTermT, children []ParseTermT) []string {
+	var refs []string
+
+	for _, child := range children {
+		if child.StrValue != "" {
+			if _, ok := termsT[child.StrValue]; ok {
+				refs = append(refs, child.StrValue)
+				continue
+			}
+		}
+		refs = append(refs, termRefs(termsT, childTerms(child))...)
+	}
+
+	return refs
+}
+
+func termPos(termsY map[string]*yaml.Node, name string) pqerr.Pos {
+	if n, ok := termsY[name]; ok && n != nil {
+		return pqerr.Pos{Line: n.Line, Col: n.Column}
+	}
+	return pqerr.Pos{}
+}
+
+// checkTermCycles walks the terms graph and returns the names of terms that
+// are part of a reference cycle along with one error per cycle found.
+func checkTermCycles(termsT map[string]ParseTermT, termsY map[string]*yaml.Node) (map[string]struct{}, pqerr.List) {
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	var (
+		state  = make(map[string]int, len(termsT))
+		cyclic = make(map[string]struct{})
+		stack  []string
+		errs   pqerr.List
+		names  = make([]string, 0, len(termsT))
+		visit  func(name string)
+	)
+
+	for name := range termsT {
+		names = append(names, name)
+	}
+
+	// Sort for deterministic error reporting
+	sort.Strings(names)
+
+	visit = func(name string) {
+		state[name] = visiting
+		stack = append(stack, name)
+
+		for _, ref := range termRefs(termsT, childTerms(termsT[name])) {
+			switch state[ref] {
+			case unvisited:
+				visit(ref)
+			case visiting:
+				// Back edge; the chain runs from ref on the stack back to ref
+				var start int
+				for start = len(stack) - 1; stack[start] != ref; start-- {
+				}
+
+				var (
+					cycle = &TermCycleError{}
+					chain = append(append([]string{}, stack[start:]...), ref)
+				)
+				for _, n := range chain {
+					cycle.Chain = append(cycle.Chain, n)
+					cycle.Pos = append(cycle.Pos, termPos(termsY, n))
+					cyclic[n] = struct{}{}
+				}
+
+				errs.Add(pqerr.Wrap(cycle.Pos[0], "", "", "", cycle))
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+	}
+
+	for _, name := range names {
+		if state[name] == unvisited {
+			visit(name)
+		}
+	}
+
+	return cyclic, errs
+}
+
+// reachesTerm reports the first term in targets reachable from children.
+func reachesTerm(termsT map[string]ParseTermT, children []ParseTermT, targets map[string]struct{}) (string, bool) {
+
+	var (
+		seen = make(map[string]struct{})
+		todo = termRefs(termsT, children)
+	)
+
+	for len(todo) > 0 {
+		name := todo[0]
+		todo = todo[1:]
+
+		if _, ok := targets[name]; ok {
+			return name, true
+		}
+
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+
+		todo = append(todo, termRefs(termsT, childTerms(termsT[name]))...)
+	}
+
+	return "", false
+}
+
+// RuleTermRefs returns the sorted names of every term a rule depends on,
+// directly or through other terms.
+func RuleTermRefs(r ParseRuleT, termsT map[string]ParseTermT) []string {
+
+	var (
+		seen  = make(map[string]struct{})
+		todo  = termRefs(termsT, ruleTerms(r))
+		names []string
+	)
+
+	for len(todo) > 0 {
+		name := todo[0]
+		todo = todo[1:]
+
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		names = append(names, name)
+
+		todo = append(todo, termRefs(termsT, childTerms(termsT[name]))...)
+	}
+
+	sort.Strings(names)
+
+	return names
+}
+
+const (
+	maxTermSuggestions = 3
+	maxTermDistance    = 2
+)
+
+var (
+	ErrUnknownTerm = errors.New("unknown term")
+)
+
+var (
+	// Bare strings that read like term names rather than log text, e.g.
+	// term_1 or kafka_broker_down. Words with digits such as ipv4 or http2
+	// are common literals and are not matched.
+	termLikeRegex = regexp.MustCompile(`^[a-z][a-z0-9]*(_[a-z0-9]+)+$`)
+)
+
+// warnTermLikeValues inspects every bare string child of a set or sequence body.
+// Strings that are not defined terms but look like identifiers, or are close
+// to a defined term name, are reported through emit with suggestions.
+func warnTermLikeValues(termsT map[string]ParseTermT, body *yaml.Node, emit func(n *yaml.Node, msg string)) {
+
+	if body == nil || body.Kind != yaml.MappingNode {
+		return
+	}
+
+	for _, key := range []string{docMatch, docOrder, docNegate} {
+		if items, ok := findChild(body, key); ok {
+			warnTermLikeItems(termsT, items, emit)
+		}
+	}
+}
+
+func warnTermLikeItems(termsT map[string]ParseTermT, items *yaml.Node, emit func(n *yaml.Node, msg string)) {
+
+	if items.Kind != yaml.SequenceNode {
+		return
+	}
+
+	for _, item := range items.Content {
+		switch item.Kind {
+		case yaml.ScalarNode:
+			if msg, ok := unknownTermMsg(termsT, item.Value); ok {
+				emit(item, msg)
+			}
+		case yaml.MappingNode:
+			warnNestedTermLikeValues(termsT, item, emit)
+		}
+	}
+}
+
+func warnNestedTermLikeValues(termsT map[string]ParseTermT, term *yaml.Node, emit func(n *yaml.Node, msg string)) {
+	for _, key := range []string{docSet, docSeq} {
+		if body, ok := findChild(term, key); ok {
+			warnTermLikeValues(termsT, body, emit)
+		}
+	}
+
+	if items, ok := findChild(term, docExclude); ok {
+		warnTermLikeItems(termsT, items, emit)
+	}
+}
+
+func unknownTermMsg(termsT map[string]ParseTermT, value string) (string, bool) {
+
+	if _, ok := termsT[value]; ok {
+		return "", false
+	}
+
+	suggestions := suggestTerms(termsT, value)
+
+	switch {
+	case len(suggestions) > 0:
+		return fmt.Sprintf("%q is not a defined term and will match as a literal string; did you mean %s?", value, quoteJoin(suggestions)), true
+	case termLikeRegex.MatchString(value):
+		return fmt.Sprintf("%q is not a defined term and will match as a literal string; use 'value:' for literals", value), true
+	}
+
+	return "", false
+}
+
+// suggestTerms returns the defined term names closest to value by edit distance.
+func suggestTerms(termsT map[string]ParseTermT, value string) []string {
+
+	type candidateT struct {
+		name string
+		dist int
+	}
+
+	var candidates []candidateT
+
+	for name := range termsT {
+		dist := editDistance(value, name)
+		if dist <= maxTermDistance && dist*2 < len(name) {
+			candidates = append(candidates, candidateT{name: name, dist: dist})
+		}
+	}
+
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].dist != candidates[j].dist {
+			return candidates[i].dist < candidates[j].dist
+		}
+		return candidates[i].name < candidates[j].name
+	})
+
+	var suggestions []string
+	for i := 0; i < len(candidates) && i < maxTermSuggestions; i++ {
+		suggestions = append(suggestions, candidates[i].name)
+	}
+
+	return suggestions
+}
+
+func quoteJoin(names []string) string {
+	quoted := make([]string, 0, len(names))
+	for _, name := range names {
+		quoted = append(quoted, fmt.Sprintf("%q", name))
+	}
+	return strings.Join(quoted, " or ")
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+
+	var (
+		ra   = []rune(a)
+		rb   = []rune(b)
+		prev = make([]int, len(rb)+1)
+		curr = make([]int, len(rb)+1)
+	)
+
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		curr[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+
+	return prev[len(rb)]
+}
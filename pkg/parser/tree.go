@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"regexp"
+	"sort"
 	"time"
 
 	"github.com/btcsuite/btcutil/base58"
@@ -33,15 +34,25 @@ var (
 	ErrInvalidCreId     = errors.New("invalid cre id")
 	ErrInvalidRuleId    = errors.New("invalid rule id (must be base58)")
 	ErrInvalidRuleHash  = errors.New("invalid rule hash (must be base58)")
+	ErrPredicateField   = errors.New("'fields' entry missing 'field'")
+	ErrPredicateValue   = errors.New("'fields' entry may set only one of 'value', 'jq' or 'regex'")
+	ErrPredicateMix     = errors.New("'fields' cannot be combined with 'field', 'value', 'jq' or 'regex'")
+	ErrExcludeScope     = errors.New("'exclude' only applies to value, jq, regex or fields terms")
+	ErrExcludeTerm      = errors.New("'exclude' entries must be value, jq, regex or fields terms without options")
+	ErrBindScope        = errors.New("'bind' and regex captures only apply to value, jq, regex or fields terms")
+	ErrBindName         = errors.New("invalid binding name")
+	ErrBindRegex        = errors.New("invalid 'regex'")
 )
 
 var (
 	validCreIdRegex    = regexp.MustCompile(`^[A-Za-z0-9-]{4,}$`)
 	validBase58IdRegex = regexp.MustCompile(`^[1-9A-Za-z]{12,}$`)
+	validBindNameRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
 )
 
 type TreeT struct {
-	Nodes []*NodeT `json:"nodes"`
+	Nodes    []*NodeT       `json:"nodes"`
+	Warnings []*pqerr.Error `json:"-"` // Non-fatal diagnostics, e.g. suspicious term references
 }
 
 type EventT struct {
@@ -50,15 +61,17 @@ type EventT struct {
 }
 
 type NodeMetadataT struct {
-	RuleHash     string           `json:"rule_hash"`
-	RuleId       string           `json:"rule_id"`
-	CreId        string           `json:"cre_id"`
-	Window       time.Duration    `json:"window"`
-	Event        *EventT          `json:"event"`
-	Type         schema.NodeTypeT `json:"type"`
-	Correlations []string         `json:"correlations"`
-	NegateOpts   *NegateOptsT     `json:"negate_opts"`
-	Pos          pqerr.Pos        `json:"pos"`
+	RuleHash        string           `json:"rule_hash"`
+	RuleId          string           `json:"rule_id"`
+	CreId           string           `json:"cre_id"`
+	Window          time.Duration    `json:"window"`
+	Event           *EventT          `json:"event"`
+	Type            schema.NodeTypeT `json:"type"`
+	Scope           string           `json:"scope,omitempty"` // Set for organization scope machines
+	Correlations    []string         `json:"correlations"`
+	CorrelationKeys []CorrelationT   `json:"correlation_keys,omitempty"`
+	NegateOpts      *NegateOptsT     `json:"negate_opts"`
+	Pos             pqerr.Pos        `json:"pos"`
 }
 
 type NodeT struct {
@@ -75,12 +88,26 @@ type NegateOptsT struct {
 }
 
 type FieldT struct {
-	Field      string       `json:"field"`
-	StrValue   string       `json:"value"`
-	JqValue    string       `json:"jq_value"`
-	RegexValue string       `json:"regex_value"`
-	Count      int          `json:"count"`
-	NegateOpts *NegateOptsT `json:"negate"`
+	Field      string            `json:"field"`
+	StrValue   string            `json:"value"`
+	JqValue    string            `json:"jq_value"`
+	RegexValue string            `json:"regex_value"`
+	Count      int               `json:"count"`
+	Fields     []PredicateT      `json:"fields,omitempty"`
+	Exclude    []FieldT          `json:"exclude,omitempty"`
+	Bind       map[string]string `json:"bind,omitempty"`
+	NegateOpts *NegateOptsT      `json:"negate"`
+	Pos        pqerr.Pos         `json:"pos"`
+}
+
+// PredicateT is a field condition of a multi-field term; all predicates of
+// a term must hold on the same event.
+type PredicateT struct {
+	Field      string    `json:"field"`
+	StrValue   string    `json:"value"`
+	JqValue    string    `json:"jq_value"`
+	RegexValue string    `json:"regex_value"`
+	Pos        pqerr.Pos `json:"pos"`
 }
 
 type TermsT struct {
@@ -155,6 +182,9 @@ func seqNodeProps(node *NodeT, seq *ParseSequenceT, order bool, yn *yaml.Node) e
 	}
 
 	if seq.Event != nil {
+		if isOrgScope(node) {
+			return node.WrapError(ErrOrgScopeEvent)
+		}
 		node.Metadata.Type = schema.NodeTypeLogSeq
 		node.Metadata.Event = newEvent(seq.Event)
 	}
@@ -171,8 +201,11 @@ func seqNodeProps(node *NodeT, seq *ParseSequenceT, order bool, yn *yaml.Node) e
 		}
 	}
 
-	if seq.Correlations != nil {
-		node.Metadata.Correlations = seq.Correlations
+	if seq.Correlations != nil || seq.CorrelationKeys != nil {
+		var err error
+		if node.Metadata.Correlations, node.Metadata.CorrelationKeys, err = correlations(node, correlationDefs(seq.Correlations, seq.CorrelationKeys)); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -187,6 +220,9 @@ func setNodeProps(node *NodeT, set *ParseSetT, match bool, yn *yaml.Node) error
 	}
 
 	if set.Event != nil {
+		if isOrgScope(node) {
+			return node.WrapError(ErrOrgScopeEvent)
+		}
 		node.Metadata.Type = schema.NodeTypeLogSet
 		node.Metadata.Event = newEvent(set.Event)
 	}
@@ -203,8 +239,11 @@ func setNodeProps(node *NodeT, set *ParseSetT, match bool, yn *yaml.Node) error
 		}
 	}
 
-	if set.Correlations != nil {
-		node.Metadata.Correlations = set.Correlations
+	if set.Correlations != nil || set.CorrelationKeys != nil {
+		var err error
+		if node.Metadata.Correlations, node.Metadata.CorrelationKeys, err = correlations(node, correlationDefs(set.Correlations, set.CorrelationKeys)); err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -292,6 +331,11 @@ func buildSequenceTree(root *NodeT, termsT map[string]ParseTermT, r ParseRuleT,
 	// Negate is optional
 	negateYn, _ = findChild(ruleNode, docNegate)
 
+	// Children are validated against the scope of the rule
+	if err := nodeScope(root, nil, seq.Scope); err != nil {
+		return nil, err
+	}
+
 	// Build positive children from seq.Order (non-negated)
 	// Build negative children from seq.Negate (negated)
 	pos, neg, err := buildChildrenGroups(root, termsT, seq.Order, seq.Negate, orderYn, negateYn, termsY)
@@ -338,6 +382,11 @@ func buildSetTree(root *NodeT, termsT map[string]ParseTermT, r ParseRuleT, ruleN
 	// Negate is optional
 	negateYn, _ = findChild(ruleNode, docNegate)
 
+	// Children are validated against the scope of the rule
+	if err := nodeScope(root, nil, set.Scope); err != nil {
+		return nil, err
+	}
+
 	pos, neg, err := buildChildrenGroups(root, termsT, set.Match, set.Negate, matchYn, negateYn, termsY)
 	if err != nil {
 		return nil, err
@@ -368,7 +417,7 @@ func buildChildrenGroups(root *NodeT, termsT map[string]ParseTermT, matches, neg
 
 	if len(matches) > 0 {
 
-		cPos, err := buildChildren(root, termsT, matches, false, orderYn, termsY)
+		cPos, err := buildChildren(root, termsT, matches, false, orderYn, orderYn, termsY)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -376,7 +425,7 @@ func buildChildrenGroups(root *NodeT, termsT map[string]ParseTermT, matches, neg
 	}
 
 	if len(negates) > 0 {
-		cNeg, err := buildChildren(root, termsT, negates, true, negateYn, termsY)
+		cNeg, err := buildChildren(root, termsT, negates, true, negateYn, negateYn, termsY)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -387,21 +436,28 @@ func buildChildrenGroups(root *NodeT, termsT map[string]ParseTermT, matches, neg
 	return pos, neg, nil
 }
 
-func buildChildren(parent *NodeT, tm map[string]ParseTermT, terms []ParseTermT, parentNegate bool, yn *yaml.Node, termsY map[string]*yaml.Node) ([]any, error) {
+// buildChildren builds the nodes of a list of terms. Errors are reported at
+// yn; listYn is the term list itself, used to record term positions.
+func buildChildren(parent *NodeT, tm map[string]ParseTermT, terms []ParseTermT, parentNegate bool, yn, listYn *yaml.Node, termsY map[string]*yaml.Node) ([]any, error) {
 	var (
 		children = make([]any, 0)
 	)
 
-	for _, term := range terms {
+	for i, term := range terms {
 		var (
 			node         any
 			resolvedTerm ParseTermT
 			t            = term
 			n            = yn
+			pos          = yn
 			ok           bool
 			err          error
 		)
 
+		if item, ok := seqItem(listYn, i); ok {
+			pos = item
+		}
+
 		if term.StrValue != "" {
 			// If the term is not found in the terms map, then use as str value
 			if resolvedTerm, ok = tm[term.StrValue]; ok {
@@ -409,6 +465,7 @@ func buildChildren(parent *NodeT, tm map[string]ParseTermT, terms []ParseTermT,
 				if n, ok = termsY[term.StrValue]; !ok {
 					return nil, parent.WrapError(ErrTermNotFound)
 				}
+				pos = n
 
 				if term.NegateOpts != nil {
 					t.NegateOpts = term.NegateOpts
@@ -416,10 +473,15 @@ func buildChildren(parent *NodeT, tm map[string]ParseTermT, terms []ParseTermT,
 			}
 		}
 
-		if node, err = nodeFromTerm(parent, tm, t, parentNegate, n, termsY); err != nil {
+		if node, err = nodeFromTerm(parent, tm, t, parentNegate, n, pos, termsY); err != nil {
 			return nil, err
 		}
 
+		// Scalar terms keep the position of their declaration for traces
+		if m, ok := node.(*MatcherT); ok && pos != nil {
+			m.setPos(pqerr.Pos{Line: pos.Line, Col: pos.Column})
+		}
+
 		children = append(children, node)
 
 	}
@@ -427,24 +489,41 @@ func buildChildren(parent *NodeT, tm map[string]ParseTermT, terms []ParseTermT,
 	return children, nil
 }
 
-func nodeFromTerm(parent *NodeT, termsT map[string]ParseTermT, term ParseTermT, parentNegate bool, yn *yaml.Node, termsY map[string]*yaml.Node) (any, error) {
+// nodeFromTerm builds the node of a term. Errors are reported at yn; posYn
+// is the term itself, used to record the positions of nested terms.
+func nodeFromTerm(parent *NodeT, termsT map[string]ParseTermT, term ParseTermT, parentNegate bool, yn, posYn *yaml.Node, termsY map[string]*yaml.Node) (any, error) {
 
 	var (
 		node *NodeT
 		opts *NegateOptsT
 		n    *yaml.Node
+		p    *yaml.Node
 		err  error
 		ok   bool
 	)
 
+	if len(term.Exclude) > 0 && (term.Sequence != nil || term.Set != nil) {
+		return nil, parent.WrapError(ErrExcludeScope)
+	}
+
+	if len(term.Bind) > 0 && (term.Sequence != nil || term.Set != nil) {
+		return nil, parent.WrapError(ErrBindScope)
+	}
+
 	switch {
+	case term.Detection != nil:
+		return detectionFromTerm(parent, term)
+
 	case term.Sequence != nil:
 
 		if n, ok = findChild(yn, docSeq); !ok {
 			n = yn
 		}
+		if p, ok = findChild(posYn, docSeq); !ok {
+			p = n
+		}
 
-		if node, err = buildSequenceNode(parent, termsT, term.Sequence, n, termsY); err != nil {
+		if node, err = buildSequenceNode(parent, termsT, term.Sequence, n, p, termsY); err != nil {
 			return nil, err
 		}
 
@@ -459,8 +538,11 @@ func nodeFromTerm(parent *NodeT, termsT map[string]ParseTermT, term ParseTermT,
 		if n, ok = findChild(yn, docSet); !ok {
 			n = yn
 		}
+		if p, ok = findChild(posYn, docSet); !ok {
+			p = n
+		}
 
-		if node, err = buildSetNode(parent, termsT, term.Set, n, termsY); err != nil {
+		if node, err = buildSetNode(parent, termsT, term.Set, n, p, termsY); err != nil {
 			return nil, err
 		}
 
@@ -470,8 +552,23 @@ func nodeFromTerm(parent *NodeT, termsT map[string]ParseTermT, term ParseTermT,
 			}
 			node.Metadata.NegateOpts = opts
 		}
-	case term.StrValue != "" || term.JqValue != "" || term.RegexValue != "":
-		return parseValue(term, parentNegate)
+	case len(term.Fields) > 0 || term.StrValue != "" || term.JqValue != "" || term.RegexValue != "":
+		var exclude []FieldT
+		if isOrgScope(parent) {
+			return nil, parent.WrapError(ErrOrgScopeTerm)
+		}
+		if len(term.Fields) > 0 {
+			if err = checkPredicates(parent, term); err != nil {
+				return nil, err
+			}
+		}
+		if exclude, err = excludeFields(parent, termsT, term.Exclude); err != nil {
+			return nil, err
+		}
+		if err = checkBindings(parent, term); err != nil {
+			return nil, err
+		}
+		return parseValue(term, exclude, parentNegate)
 
 	default:
 		parent.Metadata.Pos = pqerr.Pos{Line: yn.Line, Col: yn.Column}
@@ -481,6 +578,102 @@ func nodeFromTerm(parent *NodeT, termsT map[string]ParseTermT, term ParseTermT,
 	return node, nil
 }
 
+// checkPredicates validates the 'fields' list of a term, reporting errors at
+// the offending predicate.
+func checkPredicates(parent *NodeT, term ParseTermT) error {
+
+	wrap := func(pos pqerr.Pos, err error) error {
+		return pqerr.Wrap(pos, parent.Metadata.RuleId, parent.Metadata.RuleHash, parent.Metadata.CreId, err)
+	}
+
+	if term.Field != "" || term.StrValue != "" || term.JqValue != "" || term.RegexValue != "" {
+		return wrap(term.Fields[0].Pos, ErrPredicateMix)
+	}
+
+	for _, p := range term.Fields {
+		if p.Field == "" {
+			return wrap(p.Pos, ErrPredicateField)
+		}
+
+		count := 0
+		for _, v := range []string{p.StrValue, p.JqValue, p.RegexValue} {
+			if v != "" {
+				count++
+			}
+		}
+
+		if count > 1 {
+			return wrap(p.Pos, ErrPredicateValue)
+		}
+	}
+
+	return nil
+}
+
+// excludeFields resolves the 'exclude' entries of a term. Named terms are
+// looked up the same way as in buildChildren; every entry must be a plain
+// value, jq, regex or fields term.
+func excludeFields(parent *NodeT, termsT map[string]ParseTermT, terms []ParseTermT) ([]FieldT, error) {
+
+	var fields []FieldT
+
+	for _, term := range terms {
+		if resolved, ok := termsT[term.StrValue]; ok && term.StrValue != "" {
+			term = resolved
+		}
+
+		if term.Set != nil || term.Sequence != nil || term.NegateOpts != nil || term.Count > 0 || len(term.Exclude) > 0 || len(term.Bind) > 0 {
+			return nil, parent.WrapError(ErrExcludeTerm)
+		}
+
+		if len(term.Fields) > 0 {
+			if err := checkPredicates(parent, term); err != nil {
+				return nil, err
+			}
+		} else if term.StrValue == "" && term.JqValue == "" && term.RegexValue == "" {
+			return nil, parent.WrapError(ErrExcludeTerm)
+		}
+
+		fields = append(fields, FieldT{
+			Field:      term.Field,
+			StrValue:   term.StrValue,
+			JqValue:    term.JqValue,
+			RegexValue: term.RegexValue,
+			Fields:     predicates(term.Fields),
+		})
+	}
+
+	return fields, nil
+}
+
+// checkBindings validates the variables a term binds through 'bind' and
+// named regex capture groups.
+func checkBindings(parent *NodeT, term ParseTermT) error {
+
+	for name, expr := range term.Bind {
+		if !validBindNameRegex.MatchString(name) || expr == "" {
+			return parent.WrapError(fmt.Errorf("%w: %q", ErrBindName, name))
+		}
+	}
+
+	if term.RegexValue == "" {
+		return nil
+	}
+
+	re, err := regexp.Compile(term.RegexValue)
+	if err != nil {
+		return parent.WrapError(fmt.Errorf("%w: %w", ErrBindRegex, err))
+	}
+
+	for _, name := range re.SubexpNames() {
+		if name != "" && !validBindNameRegex.MatchString(name) {
+			return parent.WrapError(fmt.Errorf("%w: %q", ErrBindName, name))
+		}
+	}
+
+	return nil
+}
+
 func negateOpts(term ParseTermT) (*NegateOptsT, error) {
 	var (
 		opts = &NegateOptsT{}
@@ -505,13 +698,17 @@ func negateOpts(term ParseTermT) (*NegateOptsT, error) {
 	return opts, nil
 }
 
-func buildSequenceNode(parent *NodeT, termsT map[string]ParseTermT, seq *ParseSequenceT, yn *yaml.Node, termsY map[string]*yaml.Node) (*NodeT, error) {
+func buildSequenceNode(parent *NodeT, termsT map[string]ParseTermT, seq *ParseSequenceT, yn, posYn *yaml.Node, termsY map[string]*yaml.Node) (*NodeT, error) {
 	node, err := initNode(parent.Metadata.RuleId, parent.Metadata.RuleHash, parent.Metadata.CreId, yn)
 	if err != nil {
 		return nil, parent.WrapError(err)
 	}
 
-	pos, neg, err := buildPosNegChildren(node, termsT, seq.Order, seq.Negate, yn, termsY)
+	if err := nodeScope(node, parent, seq.Scope); err != nil {
+		return nil, err
+	}
+
+	pos, neg, err := buildPosNegChildren(node, termsT, seq.Order, seq.Negate, yn, posYn, termsY)
 	if err != nil {
 		return nil, err
 	}
@@ -529,13 +726,17 @@ func buildSequenceNode(parent *NodeT, termsT map[string]ParseTermT, seq *ParseSe
 	return node, nil
 }
 
-func buildSetNode(parent *NodeT, termsT map[string]ParseTermT, set *ParseSetT, yn *yaml.Node, termsY map[string]*yaml.Node) (*NodeT, error) {
+func buildSetNode(parent *NodeT, termsT map[string]ParseTermT, set *ParseSetT, yn, posYn *yaml.Node, termsY map[string]*yaml.Node) (*NodeT, error) {
 	node, err := initNode(parent.Metadata.RuleId, parent.Metadata.RuleHash, parent.Metadata.CreId, yn)
 	if err != nil {
 		return nil, parent.WrapError(err)
 	}
 
-	pos, neg, err := buildPosNegChildren(node, termsT, set.Match, set.Negate, yn, termsY)
+	if err := nodeScope(node, parent, set.Scope); err != nil {
+		return nil, err
+	}
+
+	pos, neg, err := buildPosNegChildren(node, termsT, set.Match, set.Negate, yn, posYn, termsY)
 	if err != nil {
 		return nil, err
 	}
@@ -555,12 +756,18 @@ func buildSetNode(parent *NodeT, termsT map[string]ParseTermT, set *ParseSetT, y
 
 // buildPosNegChildren is a helper for building
 // positive and negative children across Sequence and Set
-func buildPosNegChildren(node *NodeT, termsT map[string]ParseTermT, matches, negates []ParseTermT, yn *yaml.Node, termsY map[string]*yaml.Node) (pos []any, neg []any, err error) {
+func buildPosNegChildren(node *NodeT, termsT map[string]ParseTermT, matches, negates []ParseTermT, yn, posYn *yaml.Node, termsY map[string]*yaml.Node) (pos []any, neg []any, err error) {
 
 	pos, neg = []any{}, []any{}
 
+	matchYn, ok := findChild(posYn, docOrder)
+	if !ok {
+		matchYn, _ = findChild(posYn, docMatch)
+	}
+	negateYn, _ := findChild(posYn, docNegate)
+
 	if len(matches) > 0 {
-		cPos, err := buildChildren(node, termsT, matches, false, yn, termsY)
+		cPos, err := buildChildren(node, termsT, matches, false, yn, matchYn, termsY)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -568,7 +775,7 @@ func buildPosNegChildren(node *NodeT, termsT map[string]ParseTermT, matches, neg
 	}
 
 	if len(negates) > 0 {
-		cNeg, err := buildChildren(node, termsT, negates, true, yn, termsY)
+		cNeg, err := buildChildren(node, termsT, negates, true, yn, negateYn, termsY)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -578,7 +785,7 @@ func buildPosNegChildren(node *NodeT, termsT map[string]ParseTermT, matches, neg
 	return pos, neg, nil
 }
 
-func parseValue(term ParseTermT, negate bool) (*MatcherT, error) {
+func parseValue(term ParseTermT, exclude []FieldT, negate bool) (*MatcherT, error) {
 
 	var (
 		matcher = &MatcherT{}
@@ -592,6 +799,9 @@ func parseValue(term ParseTermT, negate bool) (*MatcherT, error) {
 			JqValue:    term.JqValue,
 			RegexValue: term.RegexValue,
 			Count:      term.Count,
+			Fields:     predicates(term.Fields),
+			Exclude:    exclude,
+			Bind:       term.Bind,
 		})
 	case true:
 
@@ -612,6 +822,9 @@ func parseValue(term ParseTermT, negate bool) (*MatcherT, error) {
 			JqValue:    term.JqValue,
 			RegexValue: term.RegexValue,
 			Count:      term.Count,
+			Fields:     predicates(term.Fields),
+			Exclude:    exclude,
+			Bind:       term.Bind,
 			NegateOpts: opts,
 		})
 	}
@@ -619,6 +832,26 @@ func parseValue(term ParseTermT, negate bool) (*MatcherT, error) {
 	return matcher, nil
 }
 
+func (m *MatcherT) setPos(pos pqerr.Pos) {
+	for i := range m.Match.Fields {
+		m.Match.Fields[i].Pos = pos
+	}
+	for i := range m.Negate.Fields {
+		m.Negate.Fields[i].Pos = pos
+	}
+}
+
+func predicates(fields []ParsePredicateT) []PredicateT {
+	if len(fields) == 0 {
+		return nil
+	}
+	out := make([]PredicateT, 0, len(fields))
+	for _, f := range fields {
+		out = append(out, PredicateT(f))
+	}
+	return out
+}
+
 func ParseCres(data []byte) (map[string]ParseCreT, error) {
 	var (
 		config RulesT
@@ -648,9 +881,42 @@ func Parse(data []byte, opts ...ParseOptT) (*TreeT, error) {
 		return nil, err
 	}
 
+	if o := parseOpts(opts...); o.strict {
+		return parseStrict(data, config, o, opts)
+	}
+
 	return ParseRules(config, opts)
 }
 
+// parseStrict reports unknown keys along with any rule errors. Outside of
+// diagnostics mode unknown keys fail the parse before rules are built.
+func parseStrict(data []byte, config *RulesT, o *parseOptsT, opts []ParseOptT) (*TreeT, error) {
+
+	var (
+		root *yaml.Node
+		tree *TreeT
+		errs pqerr.List
+		err  error
+	)
+
+	if root, err = RootNode(data); err != nil {
+		return nil, err
+	}
+
+	if errs = checkDocument(root); len(errs) > 0 && !o.diagnostics {
+		return nil, o.withFile(errs)
+	}
+
+	tree, err = ParseRules(config, opts)
+	if err != nil && !o.diagnostics {
+		return nil, err
+	}
+
+	errs.Add(err)
+
+	return tree, o.withFile(errs.Err())
+}
+
 func Unmarshal(data []byte) (*RulesT, error) {
 
 	var (
@@ -673,6 +939,8 @@ func Unmarshal(data []byte) (*RulesT, error) {
 		return nil, errors.New("rules not found")
 	}
 
+	config.RuleNodes = config.Root.Content
+
 	termsNode, ok = findChild(docMap, docTerms)
 	if ok {
 		config.TermsY = collectTermsY(termsNode)
@@ -705,8 +973,26 @@ func parseRules(rules []ParseRuleT, termsT map[string]ParseTermT, rulesRoot *yam
 		tree = &TreeT{
 			Nodes: make([]*NodeT, 0),
 		}
+		diags pqerr.List
 	)
 
+	// Terms that refer back to themselves would recurse forever in buildChildren
+	cyclic, cycleErrs := checkTermCycles(termsT, termsY)
+	if len(cycleErrs) > 0 {
+		if !o.diagnostics {
+			return nil, o.withFile(cycleErrs[0])
+		}
+		diags.Add(o.withFile(cycleErrs))
+	}
+
+	// Bare strings missing from the terms map silently become literal matchers
+	if err := o.checkTermRefs(tree, termsSectionRefIssues(termsT, termsY)); err != nil {
+		if !o.diagnostics {
+			return nil, err
+		}
+		diags.Add(err)
+	}
+
 	for i, rule := range rules {
 		var (
 			node     *NodeT
@@ -719,7 +1005,7 @@ func parseRules(rules []ParseRuleT, termsT map[string]ParseTermT, rulesRoot *yam
 			log.Error().
 				Int("index", i).
 				Msg("Rule not found")
-			return nil, ErrRuleNotFound
+			return nil, o.withFile(ErrRuleNotFound)
 		}
 
 		if o.genIds {
@@ -731,8 +1017,12 @@ func parseRules(rules []ParseRuleT, termsT map[string]ParseTermT, rulesRoot *yam
 					Msg("Rule id is empty, generating from cre id")
 			}
 			if rule.Metadata.Hash == "" {
-				if rule.Metadata.Hash, err = HashRule(rule); err != nil {
-					return nil, err
+				if rule.Metadata.Hash, err = o.hashRule(rule, termsT); err != nil {
+					if !o.diagnostics {
+						return nil, o.withFile(err)
+					}
+					diags.Add(o.withFile(ruleError(rule, ruleNode, err)))
+					continue
 				}
 				log.Warn().
 					Str("rule.Cre.Id", rule.Cre.Id).
@@ -742,14 +1032,79 @@ func parseRules(rules []ParseRuleT, termsT map[string]ParseTermT, rulesRoot *yam
 			}
 		}
 
+		if yn, ok := findChild(ruleNode, docRule); ok {
+			if err = o.checkTermRefs(tree, termRefIssues(termsT, yn, rule.Metadata.Id, rule.Metadata.Hash, rule.Cre.Id)); err != nil {
+				if !o.diagnostics {
+					return nil, err
+				}
+				diags.Add(err)
+				continue
+			}
+		}
+
+		if name, ok := reachesTerm(termsT, ruleTerms(rule), cyclic); ok {
+			// Only reachable in diagnostics mode; the cycle itself was reported above
+			diags.Add(o.withFile(ruleError(rule, ruleNode, fmt.Errorf("%w: rule references cyclic term %s", ErrTermCycle, name))))
+			continue
+		}
+
 		if node, err = buildTree(termsT, rule, ruleNode, termsY); err != nil {
-			return nil, err
+			if !o.diagnostics {
+				return nil, o.withFile(err)
+			}
+			// Keep going so every broken rule is reported in one pass
+			diags.Add(o.withFile(ruleError(rule, ruleNode, err)))
+			continue
 		}
 
 		tree.Nodes = append(tree.Nodes, node)
 	}
 
-	return tree, nil
+	// In diagnostics mode the partial tree is returned along with the errors
+	return tree, diags.Err()
+}
+
+// termRefIssues returns a diagnostic for every suspicious bare string under the set or sequence in yn.
+func termRefIssues(termsT map[string]ParseTermT, yn *yaml.Node, ruleId, ruleHash, creId string) pqerr.List {
+	var issues pqerr.List
+	warnNestedTermLikeValues(termsT, yn, func(n *yaml.Node, msg string) {
+		issues.Add(pqerr.Wrap(pqerr.Pos{Line: n.Line, Col: n.Column}, ruleId, ruleHash, creId, ErrUnknownTerm, msg))
+	})
+	return issues
+}
+
+func termsSectionRefIssues(termsT map[string]ParseTermT, termsY map[string]*yaml.Node) pqerr.List {
+
+	var (
+		issues pqerr.List
+		names  = make([]string, 0, len(termsY))
+	)
+
+	for name := range termsY {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		issues = append(issues, termRefIssues(termsT, termsY[name], "", "", "")...)
+	}
+
+	return issues
+}
+
+// ruleError attaches the rule position and identifiers to errors that
+// were returned without them (e.g. duration parse errors).
+func ruleError(r ParseRuleT, yn *yaml.Node, err error) error {
+	if _, ok := pqerr.PosOf(err); ok {
+		return err
+	}
+	return pqerr.Wrap(
+		pqerr.Pos{Line: yn.Line, Col: yn.Column},
+		r.Metadata.Id,
+		r.Metadata.Hash,
+		r.Cre.Id,
+		err,
+	)
 }
 
 func ParseRules(config *RulesT, opts []ParseOptT) (*TreeT, error) {
@@ -805,8 +1160,103 @@ func WithGenIds() func(*parseOptsT) {
 	}
 }
 
+// WithStructureOnly validates the structure of the documents without
+// checking rule ids and hashes for duplicates, e.g. to format a file that
+// is only part of a rule pack.
+func WithStructureOnly() func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.structureOnly = true
+	}
+}
+
+// WithDiagnostics keeps parsing past rules that fail to build. The valid
+// rules are returned as a partial tree along with a pqerr.List holding
+// every error found.
+func WithDiagnostics() func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.diagnostics = true
+	}
+}
+
+// WithFile records the file name on returned errors.
+func WithFile(name string) func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.file = name
+	}
+}
+
+// WithStrictRefs rejects bare strings that look like misspelled term names.
+// By default these are reported as warnings on the returned tree.
+func WithStrictRefs() func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.strictRefs = true
+	}
+}
+
+// WithStrict reports every key in a rule document that is not part of the
+// rule format, e.g. 'windw' or 'negat', instead of silently ignoring it.
+func WithStrict() func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.strict = true
+	}
+}
+
+// WithLegacyHash generates missing rule hashes from the raw rule with
+// HashRule instead of HashRuleSemantic, for compatibility with hashes
+// generated by earlier versions.
+func WithLegacyHash() func(*parseOptsT) {
+	return func(o *parseOptsT) {
+		o.legacyHash = true
+	}
+}
+
 type parseOptsT struct {
-	genIds bool
+	genIds        bool
+	legacyHash    bool
+	diagnostics   bool
+	strictRefs    bool
+	strict        bool
+	structureOnly bool
+	file          string
+}
+
+func (o *parseOptsT) hashRule(rule ParseRuleT, termsT map[string]ParseTermT) (string, error) {
+	if o.legacyHash {
+		return HashRule(rule)
+	}
+	return HashRuleSemantic(rule, termsT)
+}
+
+// checkTermRefs returns issues as errors in strict mode; otherwise they are
+// logged and recorded as warnings on the tree.
+func (o *parseOptsT) checkTermRefs(tree *TreeT, issues pqerr.List) error {
+
+	if len(issues) == 0 {
+		return nil
+	}
+
+	if o.strictRefs {
+		return o.withFile(issues)
+	}
+
+	o.withFile(issues)
+	for _, issue := range issues {
+		log.Warn().
+			Str("cre_id", issue.CreId).
+			Int("line", issue.Pos.Line).
+			Int("col", issue.Pos.Col).
+			Msg(issue.Msg)
+	}
+	tree.Warnings = append(tree.Warnings, issues...)
+
+	return nil
+}
+
+func (o *parseOptsT) withFile(err error) error {
+	if o.file == "" {
+		return err
+	}
+	return pqerr.WithFile(err, o.file)
 }
 
 func parseOpts(opts ...ParseOptT) *parseOptsT {
@@ -825,11 +1275,12 @@ func Read(rdr io.Reader, opts ...ParseOptT) (*RulesT, error) {
 			TermsT: make(map[string]ParseTermT),
 			TermsY: make(map[string]*yaml.Node),
 		}
-		root    *yaml.Node
-		dupes   = make(map[string]struct{})
-		decoder *yaml.Decoder
-		o       = parseOpts(opts...)
-		ok      bool
+		root       *yaml.Node
+		dupes      = make(map[string]struct{})
+		decoder    *yaml.Decoder
+		o          = parseOpts(opts...)
+		strictErrs pqerr.List
+		ok         bool
 	)
 
 	decoder = yaml.NewDecoder(rdr)
@@ -860,6 +1311,10 @@ LOOP:
 			}
 		}
 
+		if o.strict {
+			strictErrs = append(strictErrs, checkDocument(root)...)
+		}
+
 		allRules.Root, ok = findChild(root, docRules)
 		if !ok {
 			return nil, errors.New("rules not found")
@@ -875,12 +1330,13 @@ LOOP:
 				if err := vNode.Decode(&rules); err != nil {
 					return nil, err
 				}
-				if !o.genIds {
+				if !o.genIds && !o.structureOnly {
 					if err := checkDuplicates(rules, dupes); err != nil {
 						return nil, err
 					}
 				}
 				allRules.Rules = append(allRules.Rules, rules...)
+				allRules.RuleNodes = append(allRules.RuleNodes, vNode.Content...)
 
 			case "terms":
 
@@ -896,12 +1352,26 @@ LOOP:
 				if err := mergeTerms(allRules.TermsT, allRules.TermsY, termsTNew, termsYNew); err != nil {
 					return nil, err
 				}
+			case docTests:
+				var tests []ParseTestT
+				if err := vNode.Decode(&tests); err != nil {
+					return nil, err
+				}
+				allRules.Tests = append(allRules.Tests, tests...)
+
 			default:
-				// unknown section – ignore or warn
+				// unknown section – ignore, or reported above in strict mode
 			}
 		}
 	}
 
+	if len(strictErrs) > 0 {
+		if !o.diagnostics {
+			return nil, o.withFile(strictErrs)
+		}
+		return allRules, o.withFile(strictErrs)
+	}
+
 	return allRules, nil
 }
 
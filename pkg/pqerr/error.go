@@ -3,6 +3,8 @@ package pqerr
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 )
 
 type Pos struct{ Line, Col int }
@@ -89,7 +91,18 @@ func PosOf(err error) (Pos, bool) {
 }
 
 func WithFile(err error, file string) error {
-	var perr *Error
+	var (
+		list List
+		perr *Error
+	)
+	if errors.As(err, &list) {
+		for _, e := range list {
+			if e.File == "" {
+				e.File = file
+			}
+		}
+		return err
+	}
 	if errors.As(err, &perr) {
 		if perr.File == "" {
 			perr.File = file
@@ -97,3 +110,73 @@ func WithFile(err error, file string) error {
 	}
 	return err
 }
+
+// List collects every positioned error found in a single pass, e.g. when
+// parsing a rule pack in diagnostics mode.
+type List []*Error
+
+func (l List) Error() string {
+	msgs := make([]string, 0, len(l))
+	for _, e := range l {
+		msgs = append(msgs, e.Error())
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (l List) Unwrap() []error {
+	errs := make([]error, 0, len(l))
+	for _, e := range l {
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// Add appends err to the list. Errors that do not carry a *Error are
+// wrapped without position information.
+func (l *List) Add(err error) {
+	if err == nil {
+		return
+	}
+
+	var (
+		list List
+		perr *Error
+	)
+
+	switch {
+	case errors.As(err, &list):
+		*l = append(*l, list...)
+	case errors.As(err, &perr):
+		*l = append(*l, perr)
+	default:
+		*l = append(*l, &Error{Err: err})
+	}
+}
+
+// Sort orders the list by file, line and column.
+func (l List) Sort() {
+	sort.SliceStable(l, func(i, j int) bool {
+		if l[i].File != l[j].File {
+			return l[i].File < l[j].File
+		}
+		if l[i].Pos.Line != l[j].Pos.Line {
+			return l[i].Pos.Line < l[j].Pos.Line
+		}
+		return l[i].Pos.Col < l[j].Pos.Col
+	})
+}
+
+// Err returns nil for an empty list so callers can return it directly.
+func (l List) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// ListOf flattens err into a List.
+func ListOf(err error) List {
+	var l List
+	l.Add(err)
+	return l
+}
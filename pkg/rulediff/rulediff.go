@@ -0,0 +1,366 @@
+package rulediff
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+)
+
+var (
+	ErrDuplicateRule = errors.New("duplicate rule")
+)
+
+type ChangeT string
+
+const (
+	ChangeAdded    ChangeT = "added"
+	ChangeRemoved  ChangeT = "removed"
+	ChangeLogic    ChangeT = "logic_changed"
+	ChangeTerms    ChangeT = "term_changed"
+	ChangeMetadata ChangeT = "metadata_changed"
+	ChangeModified ChangeT = "changed"
+)
+
+// RuleDiffT describes how one rule differs between two rule packs. Rules
+// are matched by metadata.id.
+type RuleDiffT struct {
+	Id             string   `json:"id"`
+	CreId          string   `json:"cre_id"`
+	Change         ChangeT  `json:"change"`
+	Fields         []string `json:"fields,omitempty"` // changed cre and metadata keys, e.g. cre.title
+	Terms          []string `json:"terms,omitempty"`  // changed terms the rule depends on
+	PrevGeneration uint     `json:"prev_generation,omitempty"`
+	Generation     uint     `json:"generation,omitempty"`
+}
+
+// TermDiffT describes a term whose definition was added, removed or changed,
+// along with the ids of the rules that depend on it.
+type TermDiffT struct {
+	Name   string   `json:"name"`
+	Change ChangeT  `json:"change"`
+	Rules  []string `json:"rules,omitempty"`
+}
+
+type DiffT struct {
+	Rules []RuleDiffT `json:"rules"`
+	Terms []TermDiffT `json:"terms"`
+}
+
+// Empty reports whether the two rule packs are equivalent.
+func (d *DiffT) Empty() bool {
+	return len(d.Rules) == 0 && len(d.Terms) == 0
+}
+
+// JSON renders the diff as indented JSON.
+func (d *DiffT) JSON() ([]byte, error) {
+	return json.MarshalIndent(d, "", "  ")
+}
+
+// Diff compares two rule packs. Rules in next are reported in document
+// order, followed by rules removed from prev. Unchanged rules are omitted.
+//
+// A rule is logic_changed when its own body changed, term_changed when only
+// the terms it references changed and metadata_changed when only cre or
+// metadata fields changed. Formatting and duration spelling are ignored.
+func Diff(prev, next *parser.RulesT) (*DiffT, error) {
+
+	var (
+		diff    = &DiffT{Rules: []RuleDiffT{}, Terms: []TermDiffT{}}
+		prevIds = make(map[string]parser.ParseRuleT, len(prev.Rules))
+		nextIds = make(map[string]struct{}, len(next.Rules))
+	)
+
+	terms, err := diffTerms(prev.TermsT, next.TermsT)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, rule := range prev.Rules {
+		prevIds[ruleId(rule)] = rule
+	}
+
+	for _, rule := range next.Rules {
+
+		var (
+			id      = ruleId(rule)
+			old, ok = prevIds[id]
+		)
+
+		nextIds[id] = struct{}{}
+
+		if !ok {
+			diff.Rules = append(diff.Rules, RuleDiffT{
+				Id:         id,
+				CreId:      rule.Cre.Id,
+				Change:     ChangeAdded,
+				Generation: rule.Metadata.Gen,
+			})
+			continue
+		}
+
+		rd, changed, err := diffRule(old, prev.TermsT, rule, next.TermsT, terms)
+		if err != nil {
+			return nil, err
+		}
+
+		if changed {
+			diff.Rules = append(diff.Rules, rd)
+		}
+	}
+
+	for _, rule := range prev.Rules {
+		id := ruleId(rule)
+		if _, ok := nextIds[id]; ok {
+			continue
+		}
+		diff.Rules = append(diff.Rules, RuleDiffT{
+			Id:             id,
+			CreId:          rule.Cre.Id,
+			Change:         ChangeRemoved,
+			PrevGeneration: rule.Metadata.Gen,
+		})
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(terms)) {
+		td := TermDiffT{Name: name, Change: terms[name]}
+
+		// Removed terms are attributed to the rules that used them before
+		rules, termsT := next.Rules, next.TermsT
+		if td.Change == ChangeRemoved {
+			rules, termsT = prev.Rules, prev.TermsT
+		}
+
+		for _, rule := range rules {
+			if slices.Contains(parser.RuleTermRefs(rule, termsT), name) {
+				td.Rules = append(td.Rules, ruleId(rule))
+			}
+		}
+
+		diff.Terms = append(diff.Terms, td)
+	}
+
+	return diff, nil
+}
+
+// DiffDirs reads every .yaml and .yml file below prevDir and nextDir with
+// parser.Read and compares the resulting rule packs.
+func DiffDirs(prevDir, nextDir string, opts ...parser.ParseOptT) (*DiffT, error) {
+
+	prev, err := readDir(prevDir, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	next, err := readDir(nextDir, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return Diff(prev, next)
+}
+
+func readDir(dir string, opts ...parser.ParseOptT) (*parser.RulesT, error) {
+
+	var (
+		rules = &parser.RulesT{
+			Rules:  make([]parser.ParseRuleT, 0),
+			TermsT: make(map[string]parser.ParseTermT),
+		}
+		files = make(map[string]string) // File of each rule id and cre id
+	)
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		switch filepath.Ext(path) {
+		case ".yaml", ".yml":
+		default:
+			return nil
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r, err := parser.Read(f, append(opts, parser.WithFile(path))...)
+		if err != nil {
+			return err
+		}
+
+		// Read only checks duplicates within a file
+		for _, rule := range r.Rules {
+			for _, id := range []string{"id=" + ruleId(rule), "cre=" + rule.Cre.Id} {
+				if prev, dup := files[id]; dup && prev != path {
+					return fmt.Errorf("%w: %s in %s and %s", ErrDuplicateRule, id, prev, path)
+				}
+				files[id] = path
+			}
+		}
+
+		rules.Rules = append(rules.Rules, r.Rules...)
+
+		for name, term := range r.TermsT {
+			if _, dup := rules.TermsT[name]; dup {
+				return parser.ErrDuplicateTerm
+			}
+			rules.TermsT[name] = term
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+// ruleId mirrors parser.WithGenIds, which derives missing ids from the CRE id.
+func ruleId(rule parser.ParseRuleT) string {
+	if rule.Metadata.Id == "" {
+		return parser.Hash(rule.Cre.Id)
+	}
+	return rule.Metadata.Id
+}
+
+func diffRule(old parser.ParseRuleT, oldTerms map[string]parser.ParseTermT, rule parser.ParseRuleT, terms map[string]parser.ParseTermT, changedTerms map[string]ChangeT) (RuleDiffT, bool, error) {
+
+	var rd = RuleDiffT{
+		Id:             ruleId(rule),
+		CreId:          rule.Cre.Id,
+		PrevGeneration: old.Metadata.Gen,
+		Generation:     rule.Metadata.Gen,
+	}
+
+	// Hashing without terms compares the rule body with references unexpanded
+	oldBody, err := parser.HashRuleSemantic(old, nil)
+	if err != nil {
+		return rd, false, err
+	}
+
+	body, err := parser.HashRuleSemantic(rule, nil)
+	if err != nil {
+		return rd, false, err
+	}
+
+	oldHash, err := parser.HashRuleSemantic(old, oldTerms)
+	if err != nil {
+		return rd, false, err
+	}
+
+	hash, err := parser.HashRuleSemantic(rule, terms)
+	if err != nil {
+		return rd, false, err
+	}
+
+	rd.Fields = append(diffFields("cre", old.Cre, rule.Cre), diffFields("metadata", old.Metadata, rule.Metadata)...)
+
+	for _, name := range parser.RuleTermRefs(rule, terms) {
+		if _, ok := changedTerms[name]; ok {
+			rd.Terms = append(rd.Terms, name)
+		}
+	}
+
+	switch {
+	case oldBody != body:
+		rd.Change = ChangeLogic
+	case oldHash != hash:
+		rd.Change = ChangeTerms
+	case len(rd.Fields) > 0:
+		rd.Change = ChangeMetadata
+	default:
+		return rd, false, nil
+	}
+
+	return rd, true, nil
+}
+
+// diffTerms compares term definitions without expanding the terms they
+// reference, so only directly edited terms are reported.
+func diffTerms(prev, next map[string]parser.ParseTermT) (map[string]ChangeT, error) {
+
+	var changes = make(map[string]ChangeT)
+
+	for name, term := range next {
+		old, ok := prev[name]
+		if !ok {
+			changes[name] = ChangeAdded
+			continue
+		}
+
+		oldHash, err := termHash(old)
+		if err != nil {
+			return nil, err
+		}
+
+		hash, err := termHash(term)
+		if err != nil {
+			return nil, err
+		}
+
+		if oldHash != hash {
+			changes[name] = ChangeModified
+		}
+	}
+
+	for name := range prev {
+		if _, ok := next[name]; !ok {
+			changes[name] = ChangeRemoved
+		}
+	}
+
+	return changes, nil
+}
+
+func termHash(term parser.ParseTermT) (string, error) {
+	return parser.HashRuleSemantic(parser.ParseRuleT{
+		Rule: parser.ParseRuleDataT{
+			Set: &parser.ParseSetT{Match: []parser.ParseTermT{term}},
+		},
+	}, nil)
+}
+
+// diffFields returns the yaml keys of the top level fields that differ
+// between a and b, prefixed with section.
+func diffFields(section string, a, b any) []string {
+
+	var (
+		va     = reflect.ValueOf(a)
+		vb     = reflect.ValueOf(b)
+		fields []string
+	)
+
+	for i := range va.NumField() {
+		f := va.Type().Field(i)
+		if reflect.DeepEqual(va.Field(i).Interface(), vb.Field(i).Interface()) {
+			continue
+		}
+
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+
+		fields = append(fields, section+"."+name)
+	}
+
+	return fields
+}
@@ -0,0 +1,119 @@
+package rulediff
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/testdata"
+)
+
+func read(t *testing.T, data string) *parser.RulesT {
+	rules, err := parser.Read(strings.NewReader(data))
+	if err != nil {
+		t.Fatalf("Error reading rules: %v", err)
+	}
+	return rules
+}
+
+func TestDiff(t *testing.T) {
+
+	diff, err := Diff(read(t, testdata.TestRuleDiffPrev), read(t, testdata.TestRuleDiffNext))
+	if err != nil {
+		t.Fatalf("Error diffing rules: %v", err)
+	}
+
+	var expectedRules = []RuleDiffT{
+		{Id: "J7uRQTGpGMyL1iFpssnBeS", CreId: "TestRuleDiffLogic", Change: ChangeLogic, Fields: []string{"metadata.generation"}, PrevGeneration: 1, Generation: 2},
+		{Id: "5UD8bYwDn6ztFMsZkSg3PW", CreId: "TestRuleDiffTerms", Change: ChangeTerms, Terms: []string{"term2"}, PrevGeneration: 1, Generation: 1},
+		{Id: "7eBFk2Mb5xHwV1cmVbE9rL", CreId: "TestRuleDiffMetadata", Change: ChangeMetadata, Fields: []string{"cre.severity", "cre.title"}, PrevGeneration: 1, Generation: 1},
+		{Id: "2Wq8mHcVx4rYbN7kLp5TeA", CreId: "TestRuleDiffAdded", Change: ChangeAdded, Generation: 1},
+		{Id: "Fz1UJqCeMvG8u9mWn4bR7K", CreId: "TestRuleDiffRemoved", Change: ChangeRemoved, PrevGeneration: 1},
+	}
+
+	var expectedTerms = []TermDiffT{
+		{Name: "term2", Change: ChangeModified, Rules: []string{"5UD8bYwDn6ztFMsZkSg3PW"}},
+		{Name: "term3", Change: ChangeRemoved, Rules: []string{"Fz1UJqCeMvG8u9mWn4bR7K"}},
+		{Name: "term4", Change: ChangeAdded, Rules: []string{"2Wq8mHcVx4rYbN7kLp5TeA"}},
+	}
+
+	if !reflect.DeepEqual(diff.Rules, expectedRules) {
+		t.Errorf("Expected rules %+v, got %+v", expectedRules, diff.Rules)
+	}
+
+	if !reflect.DeepEqual(diff.Terms, expectedTerms) {
+		t.Errorf("Expected terms %+v, got %+v", expectedTerms, diff.Terms)
+	}
+
+	data, err := diff.JSON()
+	if err != nil {
+		t.Fatalf("Error rendering diff: %v", err)
+	}
+
+	var decoded DiffT
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Error decoding diff: %v", err)
+	}
+
+	if !reflect.DeepEqual(&decoded, diff) {
+		t.Errorf("Expected JSON round trip to match, got %s", data)
+	}
+
+	same, err := Diff(read(t, testdata.TestRuleDiffPrev), read(t, testdata.TestRuleDiffPrev))
+	if err != nil {
+		t.Fatalf("Error diffing rules: %v", err)
+	}
+
+	if !same.Empty() {
+		t.Errorf("Expected empty diff against itself, got %+v", same)
+	}
+}
+
+func TestDiffDirs(t *testing.T) {
+
+	var (
+		prevDir = t.TempDir()
+		nextDir = t.TempDir()
+	)
+
+	for dir, data := range map[string]string{prevDir: testdata.TestRuleDiffPrev, nextDir: testdata.TestRuleDiffNext} {
+		if err := os.WriteFile(filepath.Join(dir, "rules.yaml"), []byte(data), 0644); err != nil {
+			t.Fatalf("Error writing rules: %v", err)
+		}
+	}
+
+	diff, err := DiffDirs(prevDir, nextDir)
+	if err != nil {
+		t.Fatalf("Error diffing directories: %v", err)
+	}
+
+	if len(diff.Rules) != 5 || len(diff.Terms) != 3 {
+		t.Errorf("Expected 5 rule and 3 term changes, got %d and %d", len(diff.Rules), len(diff.Terms))
+	}
+}
+
+func TestDiffDirsDuplicate(t *testing.T) {
+
+	var dir = t.TempDir()
+
+	// The same rule in two files, e.g. moved without removing the original
+	for _, name := range []string{"a.yaml", "b.yaml"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(testdata.TestRuleDiffPrev), 0644); err != nil {
+			t.Fatalf("Error writing rules: %v", err)
+		}
+	}
+
+	_, err := DiffDirs(dir, dir)
+	if !errors.Is(err, ErrDuplicateRule) {
+		t.Fatalf("Expected %v, got %v", ErrDuplicateRule, err)
+	}
+
+	if !strings.Contains(err.Error(), "a.yaml") || !strings.Contains(err.Error(), "b.yaml") {
+		t.Errorf("Expected both file names in %v", err)
+	}
+}
@@ -0,0 +1,274 @@
+package ruletest
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/ast"
+	"github.com/prequel-dev/prequel-compiler/pkg/evaluator"
+	"github.com/prequel-dev/prequel-compiler/pkg/parser"
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+)
+
+var (
+	ErrNoTests             = errors.New("document has no 'tests'")
+	ErrNoEvents            = errors.New("test has no 'events'")
+	ErrTimestamp           = errors.New("'timestamp' must be RFC 3339 or a duration offset")
+	ErrUnknownCre          = errors.New("'expect' names a CRE without a rule")
+	ErrMissingDetection    = errors.New("expected detection did not fire")
+	ErrUnexpectedDetection = errors.New("counterexample fired")
+)
+
+// ResultT is the outcome of a test case or counterexample.
+type ResultT struct {
+	Name           string                 `json:"name"`
+	Pos            pqerr.Pos              `json:"pos"`
+	Counterexample bool                   `json:"counterexample,omitempty"`
+	Detections     []evaluator.DetectionT `json:"detections,omitempty"`
+	Err            error                  `json:"-"`
+}
+
+// Passed reports whether the test case or counterexample behaved as expected.
+func (r ResultT) Passed() bool {
+	return r.Err == nil
+}
+
+type OptT func(*optsT)
+
+// WithFile records the file name on returned errors.
+func WithFile(name string) OptT {
+	return func(o *optsT) {
+		o.file = name
+	}
+}
+
+// WithParseOpts passes options to the parser when compiling the rules.
+func WithParseOpts(opts ...parser.ParseOptT) OptT {
+	return func(o *optsT) {
+		o.parseOpts = append(o.parseOpts, opts...)
+	}
+}
+
+type optsT struct {
+	file      string
+	parseOpts []parser.ParseOptT
+}
+
+func testOpts(opts ...OptT) *optsT {
+	o := &optsT{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	return o
+}
+
+// Run compiles the rules of a document and replays the events of each of
+// its tests through a fresh evaluator. A result is returned per test case
+// and counterexample. Failures are also returned as a pqerr.List positioned
+// at the failing test cases.
+func Run(data []byte, opts ...OptT) ([]ResultT, error) {
+
+	var (
+		o       = testOpts(opts...)
+		config  *parser.RulesT
+		tree    *ast.AstT
+		results []ResultT
+		errs    pqerr.List
+		err     error
+	)
+
+	if config, err = parser.Unmarshal(data); err != nil {
+		return nil, withFile(err, o.file)
+	}
+
+	if len(config.Tests) == 0 {
+		return nil, ErrNoTests
+	}
+
+	if tree, err = build(data, o); err != nil {
+		return nil, withFile(err, o.file)
+	}
+
+	var cres = make(map[string]struct{})
+	for _, rule := range config.Rules {
+		cres[rule.Cre.Id] = struct{}{}
+	}
+
+	for i, test := range config.Tests {
+
+		var name = test.Name
+		if name == "" {
+			name = fmt.Sprintf("test %d", i+1)
+		}
+
+		if err = checkExpect(test, cres); err != nil {
+			errs.Add(err)
+			results = append(results, ResultT{Name: name, Pos: test.Pos, Err: err})
+			continue
+		}
+
+		res := runCase(tree, name, test.Pos, test.Events)
+		if res.Err == nil {
+			for _, cre := range test.Expect {
+				if !fired(res.Detections, cre) {
+					res.Err = pqerr.Wrap(test.Pos, "", "", cre, ErrMissingDetection, fmt.Sprintf("test %q", name))
+					break
+				}
+			}
+		}
+		errs.Add(res.Err)
+		results = append(results, res)
+
+		for j, ce := range test.Counterexamples {
+
+			var ceName = ce.Name
+			if ceName == "" {
+				ceName = fmt.Sprintf("%s counterexample %d", name, j+1)
+			}
+
+			res := runCase(tree, ceName, ce.Pos, ce.Events)
+			res.Counterexample = true
+			if res.Err == nil {
+				if cre, ok := unexpected(res.Detections, test.Expect); ok {
+					res.Err = pqerr.Wrap(ce.Pos, "", "", cre, ErrUnexpectedDetection, fmt.Sprintf("counterexample %q", ceName))
+				}
+			}
+			errs.Add(res.Err)
+			results = append(results, res)
+		}
+	}
+
+	errs.Sort()
+
+	return results, withFile(errs.Err(), o.file)
+}
+
+func build(data []byte, o *optsT) (*ast.AstT, error) {
+
+	tree, err := parser.Parse(data, o.parseOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return ast.BuildTree(tree)
+}
+
+func withFile(err error, file string) error {
+	if err == nil || file == "" {
+		return err
+	}
+	return pqerr.WithFile(err, file)
+}
+
+func checkExpect(test parser.ParseTestT, cres map[string]struct{}) error {
+	for _, cre := range test.Expect {
+		if _, ok := cres[cre]; !ok {
+			return pqerr.Wrap(test.Pos, "", "", cre, ErrUnknownCre)
+		}
+	}
+	return nil
+}
+
+// runCase replays the events of a test case in timestamp order. Events with
+// the same timestamp are delivered by source name, then in document order.
+func runCase(tree *ast.AstT, name string, pos pqerr.Pos, sources map[string][]parser.ParseTestEventT) ResultT {
+
+	var res = ResultT{Name: name, Pos: pos}
+
+	events, err := caseEvents(sources)
+	if err == nil && len(events) == 0 {
+		err = pqerr.Wrap(pos, "", "", "", ErrNoEvents)
+	}
+	if err != nil {
+		res.Err = err
+		return res
+	}
+
+	e, err := evaluator.New(tree)
+	if err != nil {
+		res.Err = pqerr.Wrap(pos, "", "", "", err)
+		return res
+	}
+
+	for _, ev := range events {
+		out, err := e.Scan(ev)
+		if err != nil {
+			res.Err = pqerr.Wrap(pos, "", "", "", err)
+			return res
+		}
+		res.Detections = append(res.Detections, out...)
+	}
+
+	// Let the pending windows run out so negated terms can fire
+	out, err := e.Flush()
+	if err != nil {
+		res.Err = pqerr.Wrap(pos, "", "", "", err)
+		return res
+	}
+	res.Detections = append(res.Detections, out...)
+
+	return res
+}
+
+func caseEvents(sources map[string][]parser.ParseTestEventT) ([]evaluator.EventT, error) {
+
+	var events []evaluator.EventT
+
+	for _, source := range slices.Sorted(maps.Keys(sources)) {
+		for _, ev := range sources[source] {
+			ts, err := timestamp(ev.Timestamp)
+			if err != nil {
+				return nil, pqerr.Wrap(ev.Pos, "", "", "", fmt.Errorf("%w: %q", ErrTimestamp, ev.Timestamp))
+			}
+			events = append(events, evaluator.EventT{
+				Source:    source,
+				Timestamp: ts,
+				Line:      ev.Line,
+				Keys:      ev.Keys,
+			})
+		}
+	}
+
+	slices.SortStableFunc(events, func(a, b evaluator.EventT) int {
+		return cmp.Compare(a.Timestamp, b.Timestamp)
+	})
+
+	return events, nil
+}
+
+// timestamp parses an RFC 3339 time, or a duration offset from zero.
+func timestamp(s string) (int64, error) {
+
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t.UnixNano(), nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, ErrTimestamp
+	}
+
+	return d.Nanoseconds(), nil
+}
+
+func fired(detections []evaluator.DetectionT, cre string) bool {
+	return slices.ContainsFunc(detections, func(d evaluator.DetectionT) bool {
+		return d.CreId == cre
+	})
+}
+
+// unexpected returns the first detection of a CRE in expect, or of any CRE
+// when the test expects none.
+func unexpected(detections []evaluator.DetectionT, expect []string) (string, bool) {
+	for _, d := range detections {
+		if len(expect) == 0 || slices.Contains(expect, d.CreId) {
+			return d.CreId, true
+		}
+	}
+	return "", false
+}
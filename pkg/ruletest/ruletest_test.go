@@ -0,0 +1,75 @@
+package ruletest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prequel-dev/prequel-compiler/pkg/pqerr"
+	"github.com/prequel-dev/prequel-compiler/pkg/testdata"
+)
+
+func TestRunSuccess(t *testing.T) {
+
+	results, err := Run([]byte(testdata.TestSuccessRuleTests))
+	if err != nil {
+		t.Fatalf("Unexpected error %v", err)
+	}
+
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %d", len(results))
+	}
+
+	if len(results[0].Detections) != 1 || results[0].Counterexample {
+		t.Errorf("Expected the test case to detect once, got %+v", results[0])
+	}
+
+	for _, res := range results[1:] {
+		if !res.Counterexample || !res.Passed() || len(res.Detections) != 0 {
+			t.Errorf("Expected counterexample %q to pass, got %+v", res.Name, res)
+		}
+	}
+}
+
+func TestRunFailures(t *testing.T) {
+
+	_, err := Run([]byte(testdata.TestFailRuleTests), WithFile("rules.yaml"))
+
+	var list pqerr.List
+	if !errors.As(err, &list) {
+		t.Fatalf("Expected a pqerr.List, got %v", err)
+	}
+
+	var expected = []struct {
+		err  error
+		line int
+		col  int
+	}{
+		{ErrMissingDetection, 18, 5},
+		{ErrUnexpectedDetection, 28, 9},
+		{ErrTimestamp, 38, 11},
+		{ErrUnknownCre, 42, 5},
+	}
+
+	if len(list) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d: %v", len(expected), len(list), err)
+	}
+
+	for i, exp := range expected {
+		e := list[i]
+		if !errors.Is(e, exp.err) {
+			t.Errorf("Error %d: expected %v, got %v", i, exp.err, e)
+		}
+		if e.Pos.Line != exp.line || e.Pos.Col != exp.col {
+			t.Errorf("Error %d: expected %d:%d, got %d:%d", i, exp.line, exp.col, e.Pos.Line, e.Pos.Col)
+		}
+		if e.File != "rules.yaml" {
+			t.Errorf("Error %d: expected the file name, got %q", i, e.File)
+		}
+	}
+}
+
+func TestRunNoTests(t *testing.T) {
+	if _, err := Run([]byte(testdata.TestSuccessBind)); !errors.Is(err, ErrNoTests) {
+		t.Errorf("Expected %v, got %v", ErrNoTests, err)
+	}
+}
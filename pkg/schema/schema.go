@@ -14,6 +14,9 @@ const (
 	NodeTypeLogSeq NodeTypeT = "log_seq"
 	NodeTypeLogSet NodeTypeT = "log_set"
 	NodeTypeDesc   NodeTypeT = "desc"
+
+	// Term of an organization scope machine matching cluster-level detections
+	NodeTypeDetection NodeTypeT = "detection"
 )
 
 func (t NodeTypeT) String() string {
@@ -1059,3 +1059,1276 @@ rules:
         match:
           - regex: "io.vertx.core.VertxException: Thread blocked"
 `
+
+/* Diagnostics cases */
+var TestDiagnosticsParseRules = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestDiagnosticsGood
+      severity: 1
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: kafka
+        match:
+          - value: "Thread blocked"
+  - cre:
+      id: TestDiagnosticsBadWindow
+      severity: 1
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeT"
+      hash: "rdJLgqYgkEp8jg8Qks1qir"
+      generation: 1
+    rule:
+      set:
+        window: 10d                                                       # invalid window
+        event:
+          source: kafka
+        match:
+          - value: "Thread blocked"
+  - cre:
+      severity: 1                                                         # missing cre id
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeU"
+      hash: "rdJLgqYgkEp8jg8Qks1qis"
+      generation: 1
+    rule:
+      set:
+        event:
+          source: kafka
+        match:
+          - value: "Thread blocked"
+`
+
+var TestDiagnosticsAstRules = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestDiagnosticsSingleMatchWindow
+      severity: 1
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s                                                       # window requires two or more conditions
+        event:
+          source: kafka
+        match:
+          - value: "Thread blocked"
+  - cre:
+      id: TestDiagnosticsGood
+      severity: 1
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeT"
+      hash: "rdJLgqYgkEp8jg8Qks1qir"
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: kafka
+        order:
+          - value: "Thread blocked"
+          - value: "Shutting down"
+`
+
+var TestFailTermsCycle = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailTermsCycle
+      severity: 1
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        order:
+          - term1
+          - term2
+terms:
+  term1:
+    sequence:
+      window: 10s
+      order:
+        - term3
+        - term2
+  term2:
+    set:
+      event:
+        source: k8s
+      match:
+        - value: "Killing"
+  term3:
+    set:
+      match:
+        - term1
+`
+
+var TestFailTermsSelfCycle = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailTermsSelfCycle
+      severity: 1
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        match:
+          - term1
+terms:
+  term1:
+    set:
+      window: 10s
+      match:
+        - set:
+            match:
+              - term1
+        - value: "Killing"
+`
+
+var TestTermsMisspelled = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestTermsMisspelled
+      severity: 1
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        order:
+          - term1
+          - term_2                                                        # typo of term2
+terms:
+  term1:
+    set:
+      event:
+        source: k8s
+      match:
+        - value: "Killing"
+  term2:
+    set:
+      event:
+        source: k8s
+      match:
+        - kafka_broker_down                                               # looks like an undefined term
+        - SIGTERM
+`
+
+var TestTermsLiteralWords = `
+rules:
+  - cre:
+      id: TestTermsLiteralWords
+      severity: 1
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        order:
+          - oom_killed
+          - ipv4
+          - http2
+          - utf8
+terms:
+  oom_killed:
+    set:
+      event:
+        source: k8s
+      match:
+        - value: "OOMKilled"
+`
+
+var TestStrictUnknownKeys = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestStrictUnknownKeys
+      severity: 1
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        windw: 10s                                                        # typo of window
+        event:
+          source: kafka
+        match:
+          - value: "Thread blocked"
+        negat:                                                            # typo of negate
+          - value: "Shutting down"
+terms:
+  term1:
+    sequence:
+      window: 10s
+      event:
+        source: kafka
+      order:
+        - value: "Thread blocked"
+        - value: "Shutting down"
+      negate:
+        - value: "Restarted"
+          window: 5s
+          anchor: 1
+          abs: true                                                       # typo of absolute
+extra: true
+`
+
+/* Formatter cases */
+var TestFormatUnformatted = `# Kafka rules
+rules:
+  - metadata: {id: "J7uRQTGpGMyL1iFpssnBeS", hash: "rdJLgqYgkEp8jg8Qks1qiq", generation: 1}
+    rule:
+      sequence:
+        order: [ term2, term1 ]
+        event:
+          source: "kafka"
+        window: 10000ms # ten seconds
+    cre:
+      severity: 1
+      id: "TestFormatUnformatted"
+terms:
+  term2:
+    value: "Shutting down"
+  # First term
+  term1:
+    regex: 'Thread blocked for \d+ ms'
+---
+section: version
+version: "0.1"
+`
+
+// Quoted scalars that would read as other types without their quotes
+var TestFormatQuotedScalars = `
+rules:
+  - cre:
+      id: TestFormatQuotedScalars
+    metadata:
+      id: "J7uRQTGpGMyL1iFpssnBeS"
+      hash: "rdJLgqYgkEp8jg8Qks1qiq"
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.app
+        match:
+          - value: "123"
+          - value: "true"
+          - value: "null"
+          - value: "1h"
+          - value: "~"
+          - value: "0x1F"
+          - value: "1e3"
+          - value: 'yes'
+          - field: "level"
+            value: "false"
+          - regex: "[0-9]+"
+`
+
+var TestFormatFormatted = `# Kafka rules
+rules:
+  - cre:
+      id: TestFormatUnformatted
+      severity: 1
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      sequence:
+        window: 10s # ten seconds
+        event:
+          source: kafka
+        order:
+          - term2
+          - term1
+
+terms:
+  # First term
+  term1:
+    regex: Thread blocked for \d+ ms
+  term2:
+    value: Shutting down
+---
+section: version
+version: "0.1"
+`
+
+/* Semantic hash cases; rules without a hash are hashed with WithGenIds */
+var TestHashSemanticInline = `
+rules:
+  - cre:
+      id: TestHashSemantic
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.kafka
+        order:
+          - regex: "Thread blocked for \\d+ ms"
+          - value: "Shutting down"
+        negate:
+          - value: "Restarted"
+            window: 1s
+`
+
+var TestHashSemanticTerms = `
+rules:
+  - cre:
+      id: TestHashSemantic
+      title: Kafka shutdown after blocked thread
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+    rule:
+      sequence:
+        window: 10000ms
+        event:
+          source: cre.log.kafka
+        order:
+          - term1
+          - term2
+        negate:
+          - term3
+terms:
+  term1:
+    regex: "Thread blocked for \\d+ ms"
+  term2:
+    value: "Shutting down"
+  term3:
+    value: "Restarted"
+    window: 1000ms
+`
+
+var TestHashSemanticChanged = `
+rules:
+  - cre:
+      id: TestHashSemantic
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.kafka
+        order:
+          - regex: "Thread blocked for \\d+ ms"
+          - value: "Shutting down"
+        negate:
+          - value: "Restarted"
+            window: 2s
+`
+
+/* Generation checks; TestGenerationsNext is the successor of TestGenerationsPrev */
+var TestGenerationsPrev = `
+rules:
+  - cre:
+      id: TestGenerationsChanged
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - term1
+  - cre:
+      id: TestGenerationsBumped
+    metadata:
+      id: 5UD8bYwDn6ztFMsZkSg3PW
+      hash: 9bTfXrr4X3GVkDcBhF4XTX
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - value: "Shutting down"
+  - cre:
+      id: TestGenerationsDecreased
+    metadata:
+      id: 7eBFk2Mb5xHwV1cmVbE9rL
+      hash: 3xXpt2hCwd3pP1nLm2TfZ9
+      generation: 3
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - value: "Restarted"
+  - cre:
+      id: TestGenerationsReused
+    metadata:
+      id: Fz1UJqCeMvG8u9mWn4bR7K
+      hash: 6jR3vNa5Ybq8TfwPz2KcUd
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - value: "Connection refused"
+terms:
+  term1:
+    value: "Thread blocked"
+`
+
+var TestGenerationsNext = `
+rules:
+  - cre:
+      id: TestGenerationsChanged
+      title: Logic changed through a term without a generation bump
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - term1
+  - cre:
+      id: TestGenerationsBumped
+    metadata:
+      id: 5UD8bYwDn6ztFMsZkSg3PW
+      hash: 2Wq8mHcVx4rYbN7kLp5TeA
+      generation: 2
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - value: "Shutting down now"
+  - cre:
+      id: TestGenerationsDecreased
+    metadata:
+      id: 7eBFk2Mb5xHwV1cmVbE9rL
+      hash: 3xXpt2hCwd3pP1nLm2TfZ9
+      generation: 2
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - value: "Restarted"
+  - cre:
+      id: TestGenerationsOther
+    metadata:
+      id: Fz1UJqCeMvG8u9mWn4bR7K
+      hash: 6jR3vNa5Ybq8TfwPz2KcUd
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - value: "Connection refused"
+terms:
+  term1:
+    value: "Thread blocked for"
+`
+
+/* Rule pack diff; TestRuleDiffNext is the successor of TestRuleDiffPrev */
+var TestRuleDiffPrev = `
+rules:
+  - cre:
+      id: TestRuleDiffLogic
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.kafka
+        match:
+          - value: "Shutting down"
+          - term1
+  - cre:
+      id: TestRuleDiffTerms
+    metadata:
+      id: 5UD8bYwDn6ztFMsZkSg3PW
+      hash: 9bTfXrr4X3GVkDcBhF4XTX
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.kafka
+        order:
+          - term2
+          - term1
+  - cre:
+      id: TestRuleDiffMetadata
+      severity: 2
+      title: Kafka restarted
+    metadata:
+      id: 7eBFk2Mb5xHwV1cmVbE9rL
+      hash: 3xXpt2hCwd3pP1nLm2TfZ9
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - value: "Restarted"
+  - cre:
+      id: TestRuleDiffRemoved
+    metadata:
+      id: Fz1UJqCeMvG8u9mWn4bR7K
+      hash: 6jR3vNa5Ybq8TfwPz2KcUd
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - term3
+terms:
+  term1:
+    value: "Thread blocked"
+  term2:
+    regex: "Connection (refused|reset)"
+  term3:
+    value: "Out of memory"
+`
+
+var TestRuleDiffNext = `
+rules:
+  - cre:
+      id: TestRuleDiffLogic
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 2
+    rule:
+      set:
+        window: 20s
+        event:
+          source: cre.log.kafka
+        match:
+          - value: "Shutting down"
+          - term1
+  - cre:
+      id: TestRuleDiffTerms
+    metadata:
+      id: 5UD8bYwDn6ztFMsZkSg3PW
+      hash: 9bTfXrr4X3GVkDcBhF4XTX
+      generation: 1
+    rule:
+      sequence:
+        window: 10000ms
+        event:
+          source: cre.log.kafka
+        order:
+          - term2
+          - term1
+  - cre:
+      id: TestRuleDiffMetadata
+      severity: 1
+      title: Kafka restarted unexpectedly
+    metadata:
+      id: 7eBFk2Mb5xHwV1cmVbE9rL
+      hash: 3xXpt2hCwd3pP1nLm2TfZ9
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - value: "Restarted"
+  - cre:
+      id: TestRuleDiffAdded
+    metadata:
+      id: 2Wq8mHcVx4rYbN7kLp5TeA
+      hash: 8kPz3JqRvTnY6wXc2LmB4d
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.log.kafka
+        match:
+          - term4
+terms:
+  term1:
+    value: "Thread blocked"
+  term2:
+    regex: "Connection (refused|reset|timed out)"
+  term4:
+    value: "Disk full"
+`
+
+/* Field scoped matching on structured k8s events */
+var TestFieldScoped = `
+rules:
+  - cre:
+      id: TestFieldScoped
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.k8s.event
+        match:
+          - field: reason
+            value: Killing
+          - field: involvedObject.kind
+            regex: "^Pod$"
+          - field: metadata.labels.app-name
+            jq: '. == "kafka"'
+`
+
+/* Multi-field terms; all predicates must hold on the same event */
+var TestSuccessMultiField = `
+rules:
+  - cre:
+      id: TestSuccessMultiField
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.k8s.event
+        match:
+          - term1
+terms:
+  term1:
+    fields:
+      - field: reason
+        value: Killing
+      - field: involvedObject.namespace
+        regex: "^kafka$"
+      - field: involvedObject.uid
+`
+
+var TestFailMultiFieldValue = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailMultiFieldValue
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.k8s.event
+        match:
+          - fields:
+              - field: reason
+                value: Killing
+              - field: involvedObject.namespace                           # two values
+                value: kafka
+                regex: "^kafka$"
+`
+
+var TestFailMultiFieldMissing = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailMultiFieldMissing
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.k8s.event
+        match:
+          - term1
+terms:
+  term1:
+    fields:
+      - field: reason
+        value: Killing
+      - value: kafka                                                      # missing field
+`
+
+/* Per-event exclusions */
+var TestSuccessExclude = `
+rules:
+  - cre:
+      id: TestSuccessExclude
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.log.kafka
+        match:
+          - value: "Connection refused"
+            exclude:
+              - healthcheck
+              - regex: "127\\.0\\.0\\.1"
+          - term1
+terms:
+  term1:
+    regex: "Broker \\d+ shutting down"
+    exclude:
+      - value: "controlled shutdown"
+`
+
+var TestFailExcludeScope = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailExcludeScope
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.kafka
+        order:
+          - set:
+              match:
+                - "Connection refused"
+            exclude:                                                      # not allowed on a set
+              - healthcheck
+          - "Shutting down"
+`
+
+var TestSuccessBind = `
+rules:
+  - cre:
+      id: TestSuccessBind
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.haproxy
+        order:
+          - regex: "connection to host (?P<host>\\S+) failed"
+          - regex: "host (?P<host>\\S+) removed from pool"
+`
+
+var TestSuccessBindJq = `
+rules:
+  - cre:
+      id: TestSuccessBindJq
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        window: 10s
+        event:
+          source: cre.k8s.events
+        match:
+          - field: reason
+            value: Killing
+            bind:
+              pod: .involvedObject.name
+          - field: reason
+            value: BackOff
+            bind:
+              pod: .involvedObject.name
+          - field: reason
+            value: NodeNotReady
+`
+
+var TestSuccessBindMixed = `
+rules:
+  - cre:
+      id: TestSuccessBindMixed
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.auth
+        order:
+          - regex: "(?P<user>\\w+) login"
+          - regex: "(?P<session>\\w+) closed"
+`
+
+var TestSuccessBindOverlap = `
+rules:
+  - cre:
+      id: TestSuccessBindOverlap
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.auth
+        order:
+          - regex: "user (?P<user>\\w+) opened session (?P<session>\\w+)"
+          - regex: "session (?P<session>\\w+) closed"
+`
+
+var TestFailBindName = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailBindName
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.k8s.events
+        match:
+          - field: reason
+            value: Killing
+            bind:
+              pod-name: .involvedObject.name                            # not an identifier
+`
+
+var TestSuccessCorrelationKeys = `
+rules:
+  - cre:
+      id: TestSuccessCorrelationKeys
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        correlations:
+          - name: hostname
+            sources:
+              rabbitmq:
+                regex: "host=(\\S+)"
+              k8s:
+                field: involvedObject.nodeName
+          - container_id
+        order:
+          - set:
+              event:
+                source: rabbitmq
+                origin: true
+              match:
+                - Mnesia overloaded
+          - set:
+              event:
+                source: k8s
+              match:
+                - field: reason
+                  value: NodeShutdown
+`
+
+var TestFailCorrelationKey = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCorrelationKey
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        correlations:
+          - name: hostname
+            sources:
+              rabbitmq:
+                field: host
+                jq: .host                                                 # only one of field, jq or regex
+        order:
+          - set:
+              event:
+                source: rabbitmq
+              match:
+                - Mnesia overloaded
+          - set:
+              event:
+                source: rabbitmq
+              match:
+                - SIGTERM
+`
+
+var TestFailCorrelationSource = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailCorrelationSource
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        correlations:
+          - name: hostname
+            sources:
+              rabbitmq:
+                field: host
+        order:
+          - set:
+              event:
+                source: rabbitmq
+              match:
+                - Mnesia overloaded
+          - set:
+              event:
+                source: nginx                                           # no hostname key for nginx
+              match:
+                - shutdown
+`
+
+var TestSuccessOrgClusters = `
+rules:
+  - cre:
+      id: TestSuccessOrgClusters
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        scope: organization
+        window: 1h
+        match:
+          - detection:
+              cre: CRE-2025-0071
+              clusters: 3
+`
+
+var TestSuccessOrgSequence = `
+rules:
+  - cre:
+      id: TestSuccessOrgSequence
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      sequence:
+        scope: organization
+        window: 10m
+        correlations:
+          - topic
+        order:
+          - detection:
+              cre: KAFKA-BROKER-DOWN
+              cluster: kafka-a
+          - detection:
+              cre: KAFKA-CONSUMER-LAG
+              cluster: consumers-b
+        negate:
+          - detection:
+              cre: KAFKA-BROKER-RECOVERED
+              cluster: kafka-a
+`
+
+var TestFailDetectionScope = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailDetectionScope
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        window: 1h                                                    # missing scope: organization
+        match:
+          - detection:
+              cre: CRE-2025-0071
+              clusters: 3
+`
+
+var TestFailOrgScopeTerm = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailOrgScopeTerm
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      sequence:
+        scope: organization
+        window: 10m
+        order:
+          - detection:
+              cre: KAFKA-BROKER-DOWN
+          - set:
+              event:
+                source: kafka
+              match:
+                - consumer lag                                        # log terms are evaluated in clusters
+`
+
+var TestFailDetectionWindow = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailDetectionWindow
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        scope: organization
+        match:
+          - detection:
+              cre: CRE-2025-0071
+              clusters: 3                                             # distinct clusters need a window
+`
+
+var TestSuccessRuleTests = `
+rules:
+  - cre:
+      id: TestSuccessRuleTests
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.haproxy
+        order:
+          - regex: "connection to host (?P<host>\\S+) failed"
+          - regex: "host (?P<host>\\S+) removed from pool"
+        negate:
+          - value: "pool drained"
+            window: 5s
+tests:
+  - name: host removed after failure
+    events:
+      cre.log.haproxy:
+        - timestamp: 1s
+          line: connection to host a failed
+        - timestamp: 3s
+          line: host a removed from pool
+    expect:
+      - TestSuccessRuleTests
+    counterexamples:
+      - name: another host removed
+        events:
+          cre.log.haproxy:
+            - timestamp: 1s
+              line: connection to host a failed
+            - timestamp: 3s
+              line: host b removed from pool
+      - name: pool drained
+        events:
+          cre.log.haproxy:
+            - timestamp: 2025-06-01T10:00:01Z
+              line: connection to host a failed
+            - timestamp: 2025-06-01T10:00:03Z
+              line: host a removed from pool
+            - timestamp: 2025-06-01T10:00:05Z
+              line: pool drained
+`
+
+var TestFailRuleTests = ` # Line 1 starts here
+rules:
+  - cre:
+      id: TestFailRuleTests
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      sequence:
+        window: 10s
+        event:
+          source: cre.log.haproxy
+        order:
+          - regex: "connection to host (?P<host>\\S+) failed"
+          - regex: "host (?P<host>\\S+) removed from pool"
+tests:
+  - name: removed too late
+    events:
+      cre.log.haproxy:
+        - timestamp: 1s
+          line: connection to host a failed
+        - timestamp: 30s
+          line: host a removed from pool
+    expect:
+      - TestFailRuleTests
+    counterexamples:
+      - name: same host
+        events:
+          cre.log.haproxy:
+            - timestamp: 1s
+              line: connection to host a failed
+            - timestamp: 2s
+              line: host a removed from pool
+  - name: bad timestamp
+    events:
+      cre.log.haproxy:
+        - timestamp: yesterday
+          line: connection to host a failed
+    expect:
+      - TestFailRuleTests
+  - name: unknown cre
+    events:
+      cre.log.haproxy:
+        - timestamp: 1s
+          line: connection to host a failed
+    expect:
+      - CRE-2025-9999
+`
+
+var TestSuccessSharedTerms = `
+rules:
+  - cre:
+      id: TestSuccessSharedTerms1
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.k8s
+        match:
+          - oom_killed
+  - cre:
+      id: TestSuccessSharedTerms2
+    metadata:
+      id: 5UD5gJ6ZmznpwKJHqMBoLd
+      hash: 9GJSdx4smGJeJCdiw6tiK5
+      generation: 1
+    rule:
+      sequence:
+        window: 30s
+        order:
+          - oom_killed
+          - back_off
+terms:
+  oom_killed:
+    set:
+      event:
+        source: cre.k8s
+        origin: true
+      match:
+        - value: OOMKilled
+  back_off:
+    set:
+      event:
+        source: cre.k8s
+      match:
+        - value: BackOff
+`
+
+var TestSuccessSharedTermsPartial = `
+rules:
+  - cre:
+      id: TestSuccessSharedTermsPartial1
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.k8s
+        match:
+          - value: OOMKilled
+  - cre:
+      id: TestSuccessSharedTermsPartial2
+    metadata:
+      id: 5UD5gJ6ZmznpwKJHqMBoLd
+      hash: 9GJSdx4smGJeJCdiw6tiK5
+      generation: 1
+    rule:
+      set:
+        window: 30s
+        event:
+          source: cre.k8s
+        match:
+          - value: OOMKilled
+          - value: BackOff
+`
+
+var TestSuccessPrefilter = `
+rules:
+  - cre:
+      id: Prefilter1
+    metadata:
+      id: J7uRQTGpGMyL1iFpssnBeS
+      hash: rdJLgqYgkEp8jg8Qks1qiq
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.k8s
+        match:
+          - OOMKilled
+  - cre:
+      id: Prefilter2
+    metadata:
+      id: 5UD5gJ6ZmznpwKJHqMBoLd
+      hash: 9GJSdx4smGJeJCdiw6tiK5
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.k8s
+        match:
+          - regex: "restarted \\d+ times"
+  - cre:
+      id: Prefilter3
+    metadata:
+      id: 9GJSdx4smGJeJCdiw6tiK5
+      hash: 2KdXQZDAfRbYcH9FBDteBS
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.k8s
+        match:
+          - field: reason
+            value: BackOff
+  - cre:
+      id: Prefilter4
+    metadata:
+      id: 2KdXQZDAfRbYcH9FBDteBS
+      hash: 5UD5gJ6ZmznpwKJHqMBoLd
+      generation: 1
+    rule:
+      set:
+        event:
+          source: cre.k8s
+        match:
+          - regex: "(?i)evicted"
+`